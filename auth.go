@@ -0,0 +1,555 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 本地账号：邀请码注册、bcrypt 密码、Cookie 会话 + CSRF 令牌、admin/user 角色
+// 账号、邀请码和会话都保存在 data/users.json
+
+const usersFile = "data/users.json"
+
+const (
+	sessionCookie = "session"
+	csrfCookie    = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+	sessionTTL    = 30 * 24 * time.Hour
+)
+
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+)
+
+type User struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	Role         string    `json:"role"`
+	InvitedBy    int       `json:"invited_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type Invite struct {
+	Code      string     `json:"code"`
+	Role      string     `json:"role"`
+	CreatedBy int        `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UsedBy    int        `json:"used_by,omitempty"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+type Session struct {
+	UserID    int       `json:"user_id"`
+	CSRF      string    `json:"csrf"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type userData struct {
+	NextID   int                 `json:"next_id"`
+	Users    []*User             `json:"users"`
+	Invites  []*Invite           `json:"invites"`
+	Sessions map[string]*Session `json:"sessions"` // sha256(令牌) -> 会话，文件泄露也拿不到可用的 Cookie
+}
+
+type userStore struct {
+	mu   sync.Mutex
+	path string
+	data userData
+}
+
+var users *userStore
+
+var (
+	errBadCredentials = errors.New("用户名或密码错误")
+	errBadInvite      = errors.New("邀请码无效或已使用")
+	errUserExists     = errors.New("用户名已存在")
+)
+
+// initUsers 加载账号数据；还没有管理员时生成一个管理员邀请码并打印到日志
+func initUsers() {
+	s := &userStore{path: usersFile}
+	if data, err := os.ReadFile(s.path); err == nil {
+		if err := json.Unmarshal(data, &s.data); err != nil {
+			log.Fatalf("账号数据格式错误: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("无法读取账号数据: %v", err)
+	}
+	if s.data.Sessions == nil {
+		s.data.Sessions = make(map[string]*Session)
+	}
+	if s.data.NextID == 0 {
+		s.data.NextID = 1
+	}
+	users = s
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.data.Users {
+		if u.Role == roleAdmin {
+			return
+		}
+	}
+	for _, inv := range s.data.Invites {
+		if inv.Role == roleAdmin && inv.UsedBy == 0 {
+			log.Printf("尚无管理员账号，管理员邀请码: %s", inv.Code)
+			return
+		}
+	}
+	inv := &Invite{Code: randomToken(12), Role: roleAdmin, CreatedAt: time.Now()}
+	s.data.Invites = append(s.data.Invites, inv)
+	if err := s.save(); err != nil {
+		log.Printf("警告: 保存账号数据失败: %v", err)
+	}
+	log.Printf("尚无管理员账号，管理员邀请码: %s", inv.Code)
+}
+
+// 调用方持有 s.mu；先写临时文件再改名，避免写一半时崩溃损坏数据
+func (s *userStore) save() error {
+	now := time.Now()
+	for k, sess := range s.data.Sessions {
+		if now.After(sess.ExpiresAt) {
+			delete(s.data.Sessions, k)
+		}
+	}
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *userStore) findUser(username string) *User {
+	for _, u := range s.data.Users {
+		if strings.EqualFold(u.Username, username) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *userStore) userByID(id int) *User {
+	for _, u := range s.data.Users {
+		if u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *userStore) Register(username, password, code string) (*User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var inv *Invite
+	for _, i := range s.data.Invites {
+		if i.UsedBy == 0 && subtle.ConstantTimeCompare([]byte(i.Code), []byte(code)) == 1 {
+			inv = i
+			break
+		}
+	}
+	if inv == nil {
+		return nil, errBadInvite
+	}
+	if s.findUser(username) != nil {
+		return nil, errUserExists
+	}
+	u := &User{
+		ID: s.data.NextID, Username: username, PasswordHash: string(hash),
+		Role: inv.Role, InvitedBy: inv.CreatedBy, CreatedAt: time.Now(),
+	}
+	s.data.NextID++
+	s.data.Users = append(s.data.Users, u)
+	inv.UsedBy, inv.UsedAt = u.ID, &u.CreatedAt
+	return u, s.save()
+}
+
+// 用户不存在时也做一次 bcrypt 比较，避免通过响应时间判断用户名是否存在
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+func (s *userStore) Authenticate(username, password string) (*User, error) {
+	s.mu.Lock()
+	u := s.findUser(username)
+	s.mu.Unlock()
+	hash := dummyHash
+	if u != nil {
+		hash = []byte(u.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || u == nil {
+		return nil, errBadCredentials
+	}
+	return u, nil
+}
+
+// NewSession 返回 Cookie 中的会话令牌和 CSRF 令牌
+func (s *userStore) NewSession(u *User) (string, *Session, error) {
+	token := randomToken(32)
+	sess := &Session{UserID: u.ID, CSRF: randomToken(16), ExpiresAt: time.Now().Add(sessionTTL)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Sessions[hashToken(token)] = sess
+	return token, sess, s.save()
+}
+
+func (s *userStore) Session(token string) (*User, *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.data.Sessions[hashToken(token)]
+	if !ok || time.Now().After(sess.ExpiresAt) {
+		return nil, nil
+	}
+	u := s.userByID(sess.UserID)
+	if u == nil {
+		return nil, nil
+	}
+	return u, sess
+}
+
+func (s *userStore) DeleteSession(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data.Sessions, hashToken(token))
+	s.save()
+}
+
+func (s *userStore) CreateInvite(role string, by int) (*Invite, error) {
+	inv := &Invite{Code: randomToken(12), Role: role, CreatedBy: by, CreatedAt: time.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Invites = append(s.data.Invites, inv)
+	return inv, s.save()
+}
+
+func (s *userStore) SetRole(id int, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userByID(id)
+	if u == nil {
+		return errors.New("用户不存在")
+	}
+	if u.Role == roleAdmin && role != roleAdmin {
+		admins := 0
+		for _, o := range s.data.Users {
+			if o.Role == roleAdmin {
+				admins++
+			}
+		}
+		if admins <= 1 {
+			return errors.New("至少保留一个管理员")
+		}
+	}
+	u.Role = role
+	return s.save()
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// currentUser 从会话 Cookie 取当前用户，未登录返回 nil
+func currentUser(r *http.Request) (*User, *Session) {
+	if users == nil {
+		return nil, nil
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+	return users.Session(cookie.Value)
+}
+
+// 修改数据的请求需带上与会话一致的 X-CSRF-Token
+func checkCSRF(r *http.Request, sess *Session) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	token := r.Header.Get(csrfHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRF)) == 1
+}
+
+// requireUser 要求已登录且通过 CSRF 校验，失败时直接写错误响应
+func requireUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	u, sess := currentUser(r)
+	if u == nil {
+		http.Error(w, "login required", 401)
+		return nil, false
+	}
+	if !checkCSRF(r, sess) {
+		http.Error(w, "invalid csrf token", 403)
+		return nil, false
+	}
+	return u, true
+}
+
+// requireAdmin 接受管理员令牌（脚本调用）或管理员账号的会话
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if checkAdminToken(r) {
+		return true
+	}
+	u, ok := requireUser(w, r)
+	if !ok {
+		return false
+	}
+	if u.Role != roleAdmin {
+		http.Error(w, "forbidden", 403)
+		return false
+	}
+	return true
+}
+
+func setSessionCookies(w http.ResponseWriter, r *http.Request, token string, sess *Session) {
+	secure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookie, Value: token, Path: "/", Expires: sess.ExpiresAt,
+		HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode,
+	})
+	// 前端从这个 Cookie 读出 CSRF 令牌放到请求头里
+	http.SetCookie(w, &http.Cookie{
+		Name: csrfCookie, Value: sess.CSRF, Path: "/", Expires: sess.ExpiresAt,
+		Secure: secure, SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1})
+	}
+}
+
+type publicUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+func toPublicUser(u *User) publicUser {
+	return publicUser{ID: u.ID, Username: u.Username, Role: u.Role}
+}
+
+func validUsername(name string) bool {
+	n := utf8.RuneCountInString(name)
+	if n < 2 || n > 32 {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+type authRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Invite   string `json:"invite"`
+}
+
+// 表单只接受 JSON，跨站表单无法直接提交
+func decodeAuthRequest(w http.ResponseWriter, r *http.Request) (authRequest, bool) {
+	var req authRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return req, false
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, "json required", 415)
+		return req, false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid request", 400)
+		return req, false
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	return req, true
+}
+
+func writeSession(w http.ResponseWriter, r *http.Request, u *User) {
+	token, sess, err := users.NewSession(u)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	setSessionCookies(w, r, token, sess)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": toPublicUser(u), "csrf_token": sess.CSRF})
+}
+
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAuthRequest(w, r)
+	if !ok {
+		return
+	}
+	if !validUsername(req.Username) {
+		http.Error(w, "用户名需为 2-32 位字母、数字、下划线或横线", 400)
+		return
+	}
+	if len(req.Password) < 8 || len(req.Password) > 72 {
+		http.Error(w, "密码长度需为 8-72 位", 400)
+		return
+	}
+	u, err := users.Register(req.Username, req.Password, strings.TrimSpace(req.Invite))
+	switch {
+	case errors.Is(err, errBadInvite):
+		http.Error(w, err.Error(), 403)
+		return
+	case errors.Is(err, errUserExists):
+		http.Error(w, err.Error(), 409)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	log.Printf("新用户注册: %s (%s)", u.Username, u.Role)
+	writeSession(w, r, u)
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAuthRequest(w, r)
+	if !ok {
+		return
+	}
+	u, err := users.Authenticate(req.Username, req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), 401)
+		return
+	}
+	writeSession(w, r, u)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if _, ok := requireUser(w, r); !ok {
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		users.DeleteSession(cookie.Value)
+	}
+	clearSessionCookies(w)
+	w.WriteHeader(204)
+}
+
+// 当前登录用户，未登录时 user 为 null
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u, sess := currentUser(r)
+	if u == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"user": nil})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": toPublicUser(u), "csrf_token": sess.CSRF})
+}
+
+// GET 列出邀请码，POST {"role": "user"} 生成新邀请码
+func handleAdminInvites(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		users.mu.Lock()
+		list := make([]Invite, 0, len(users.data.Invites))
+		for _, inv := range users.data.Invites {
+			list = append(list, *inv)
+		}
+		users.mu.Unlock()
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		var req struct {
+			Role string `json:"role"`
+		}
+		json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req)
+		if req.Role == "" {
+			req.Role = roleUser
+		}
+		if req.Role != roleUser && req.Role != roleAdmin {
+			http.Error(w, "invalid role", 400)
+			return
+		}
+		by := 0
+		if u, _ := currentUser(r); u != nil {
+			by = u.ID
+		}
+		inv, err := users.CreateInvite(req.Role, by)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(inv)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+// GET 列出用户，POST {"id": 2, "role": "admin"} 修改角色
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		users.mu.Lock()
+		list := make([]publicUser, 0, len(users.data.Users))
+		for _, u := range users.data.Users {
+			list = append(list, toPublicUser(u))
+		}
+		users.mu.Unlock()
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		var req struct {
+			ID   int    `json:"id"`
+			Role string `json:"role"`
+		}
+		json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req)
+		if req.Role != roleUser && req.Role != roleAdmin {
+			http.Error(w, "invalid role", 400)
+			return
+		}
+		if err := users.SetRole(req.ID, req.Role); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
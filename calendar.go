@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 新番时间表：按首播日期把番剧分到季度（1/4/7/10 月）和星期
+
+var weekdayNames = []string{"星期一", "星期二", "星期三", "星期四", "星期五", "星期六", "星期日"}
+
+type calendarDay struct {
+	Weekday   int         `json:"weekday"` // 1=星期一 ... 7=星期日，与 bgm.tv 一致
+	Name      string      `json:"name"`
+	Available int         `json:"available"`
+	Items     []AnimeInfo `json:"items"`
+}
+
+type seasonCount struct {
+	Year   int    `json:"year"`
+	Season string `json:"season"`
+	Count  int    `json:"count"`
+}
+
+// currentSeason 返回当前所在的季度
+func currentSeason() (int, string) {
+	now := time.Now()
+	return now.Year(), seasonNames[(int(now.Month())-1)/3]
+}
+
+// /api/calendar?year=2023&season=autumn，不带参数时为本季新番
+func handleCalendar(w http.ResponseWriter, r *http.Request) {
+	c := currentCatalog()
+	year, season := currentSeason()
+	if y, _ := strconv.Atoi(r.URL.Query().Get("year")); y > 0 {
+		year = y
+	}
+	if s := r.URL.Query().Get("season"); s != "" && s != "current" {
+		if !containsString(seasonNames, s) {
+			http.Error(w, "invalid season", 400)
+			return
+		}
+		season = s
+	}
+
+	days := make([]calendarDay, 7)
+	for i := range days {
+		days[i] = calendarDay{Weekday: i + 1, Name: weekdayNames[i], Items: []AnimeInfo{}}
+	}
+	seasons := make(map[seasonCount]int)
+	total := 0
+	for _, a := range c.AnimeDB {
+		t, err := time.Parse("2006-01-02", a.Date)
+		if err != nil {
+			continue
+		}
+		y, s := animeSeason(a)
+		seasons[seasonCount{Year: y, Season: s}]++
+		if y != year || s != season {
+			continue
+		}
+		a.HasResource = c.Mapping[a.ID]
+		day := &days[(int(t.Weekday())+6)%7]
+		day.Items = append(day.Items, a)
+		if a.HasResource {
+			day.Available++
+		}
+		total++
+	}
+	for _, d := range days {
+		sortAnime(d.Items, "score", "desc")
+	}
+
+	// 所有有数据的季度，供前端切换
+	list := make([]seasonCount, 0, len(seasons))
+	for k, n := range seasons {
+		k.Count = n
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Year != list[j].Year {
+			return list[i].Year > list[j].Year
+		}
+		return seasonIndex(list[i].Season) > seasonIndex(list[j].Season)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"year":     year,
+		"season":   season,
+		"total":    total,
+		"weekdays": days,
+		"seasons":  list,
+	})
+}
+
+func seasonIndex(s string) int {
+	for i, v := range seasonNames {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
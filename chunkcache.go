@@ -0,0 +1,256 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 热门剧集的本地分块缓存：按固定大小切块存到磁盘，超出容量时淘汰最久未用的块
+type chunkCache struct {
+	dir       string
+	chunkSize int64
+	maxBytes  int64
+
+	mu    sync.Mutex
+	lru   *list.List // 头部为最近使用
+	index map[string]*list.Element
+	used  int64
+
+	flights flightGroup
+
+	hits          atomic.Int64
+	misses        atomic.Int64
+	evictions     atomic.Int64
+	upstreamBytes atomic.Int64
+}
+
+type chunkEntry struct {
+	key  string
+	size int64
+}
+
+var cache *chunkCache
+
+func initChunkCache() {
+	if config.CacheDir == "" {
+		return
+	}
+	sizeMB := config.CacheSizeMB
+	if sizeMB <= 0 {
+		sizeMB = 10240
+	}
+	chunkMB := config.CacheChunkMB
+	if chunkMB <= 0 {
+		chunkMB = 4
+	}
+	c := &chunkCache{
+		dir:       config.CacheDir,
+		chunkSize: int64(chunkMB) << 20,
+		maxBytes:  int64(sizeMB) << 20,
+		lru:       list.New(),
+		index:     make(map[string]*list.Element),
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		log.Printf("警告: 无法创建缓存目录: %v", err)
+		return
+	}
+	c.loadExisting()
+	cache = c
+	log.Printf("分块缓存: %s，已用 %d/%d MB", c.dir, c.used>>20, c.maxBytes>>20)
+}
+
+// 重启后按修改时间恢复 LRU 顺序
+func (c *chunkCache) loadExisting() {
+	type found struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var files []found
+	filepath.WalkDir(c.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(p, ".tmp") {
+			os.Remove(p)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, found{d.Name(), info.Size(), info.ModTime()})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		c.index[f.key] = c.lru.PushFront(&chunkEntry{f.key, f.size})
+		c.used += f.size
+	}
+	c.evict()
+}
+
+// 文件内容变化后 key 随之变化，旧块自然被淘汰
+func (c *chunkCache) fileKey(path string, info FileInfo) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%d", path, info.Size, info.ModTime.Unix())))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *chunkCache) chunkFile(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// Chunk 返回第 idx 块的内容，未命中时从存储后端读取；同一块的并发请求只读一次上游
+func (c *chunkCache) Chunk(ctx context.Context, path string, info FileInfo, idx int64) ([]byte, error) {
+	key := c.fileKey(path, info) + "-" + strconv.FormatInt(idx, 10)
+	if data, ok := c.read(key); ok {
+		c.hits.Add(1)
+		return data, nil
+	}
+
+	v, err := c.flights.Do(key, func() (interface{}, error) {
+		// 等待期间可能已被其他请求写入
+		if data, ok := c.read(key); ok {
+			c.hits.Add(1)
+			return data, nil
+		}
+		c.misses.Add(1)
+		return c.fetch(ctx, path, info, idx, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+func (c *chunkCache) read(key string) ([]byte, bool) {
+	c.mu.Lock()
+	el, ok := c.index[key]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.chunkFile(key))
+	if err != nil {
+		c.remove(key)
+		return nil, false
+	}
+	return data, true
+}
+
+func (c *chunkCache) fetch(ctx context.Context, path string, info FileInfo, idx int64, key string) ([]byte, error) {
+	offset := idx * c.chunkSize
+	length := min(c.chunkSize, info.Size-offset)
+	if length <= 0 {
+		return nil, io.EOF
+	}
+
+	// 上游读取不随第一个请求者断开而取消，其他等待者还要用
+	fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*time.Minute)
+	defer cancel()
+	body, err := storage.Open(fetchCtx, path, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data := make([]byte, length)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, err
+	}
+	c.upstreamBytes.Add(length)
+
+	file := c.chunkFile(key)
+	os.MkdirAll(filepath.Dir(file), 0755)
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("写入缓存失败: %v", err)
+		return data, nil
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return data, nil
+	}
+
+	c.mu.Lock()
+	if _, ok := c.index[key]; !ok {
+		c.index[key] = c.lru.PushFront(&chunkEntry{key, length})
+		c.used += length
+	}
+	c.evict()
+	c.mu.Unlock()
+	return data, nil
+}
+
+// 调用方持有 c.mu
+func (c *chunkCache) evict() {
+	for c.used > c.maxBytes && c.lru.Len() > 0 {
+		el := c.lru.Back()
+		e := el.Value.(*chunkEntry)
+		c.lru.Remove(el)
+		delete(c.index, e.key)
+		c.used -= e.size
+		os.Remove(c.chunkFile(e.key))
+		c.evictions.Add(1)
+	}
+}
+
+func (c *chunkCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.index[key]; ok {
+		c.used -= el.Value.(*chunkEntry).size
+		c.lru.Remove(el)
+		delete(c.index, key)
+	}
+}
+
+// 缓存命中统计
+func handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if cache == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+		return
+	}
+	cache.mu.Lock()
+	entries, used := cache.lru.Len(), cache.used
+	cache.mu.Unlock()
+	hits, misses := cache.hits.Load(), cache.misses.Load()
+	hitRate := 0.0
+	if hits+misses > 0 {
+		hitRate = float64(hits) / float64(hits+misses)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":        true,
+		"hits":           hits,
+		"misses":         misses,
+		"hit_rate":       hitRate,
+		"evictions":      cache.evictions.Load(),
+		"entries":        entries,
+		"used_bytes":     used,
+		"max_bytes":      cache.maxBytes,
+		"chunk_size":     cache.chunkSize,
+		"upstream_bytes": cache.upstreamBytes.Load(),
+	})
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 收藏：每个用户对番剧的观看状态（想看/在看/看过/抛弃，对应 Bangumi 收藏状态），
+// 以及用户自建的公开/私有片单，管理员可以把片单推荐到首页
+
+const collectionsFile = "data/collections.json"
+
+var watchStatuses = []string{"want", "watching", "completed", "dropped"}
+
+type Collection struct {
+	ID          int       `json:"id"`
+	OwnerID     int       `json:"owner_id"`
+	Owner       string    `json:"owner,omitempty"` // 仅在响应中填充
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Public      bool      `json:"public"`
+	Featured    bool      `json:"featured"` // 管理员推荐到首页
+	Items       []int     `json:"items"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type collectionData struct {
+	NextID      int                    `json:"next_id"`
+	Status      map[int]map[int]string `json:"status"` // 用户 ID -> 番剧 ID -> 状态
+	Collections []*Collection          `json:"collections"`
+}
+
+type collectionStore struct {
+	mu   sync.Mutex
+	path string
+	data collectionData
+}
+
+var collections *collectionStore
+
+var (
+	errNotFound  = errors.New("not found")
+	errForbidden = errors.New("forbidden")
+
+	errLoginRequired = errors.New("login required")
+)
+
+func initCollections() {
+	s := &collectionStore{path: collectionsFile}
+	if data, err := os.ReadFile(s.path); err == nil {
+		if err := json.Unmarshal(data, &s.data); err != nil {
+			log.Fatalf("收藏数据格式错误: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("无法读取收藏数据: %v", err)
+	}
+	if s.data.Status == nil {
+		s.data.Status = make(map[int]map[int]string)
+	}
+	if s.data.NextID == 0 {
+		s.data.NextID = 1
+	}
+	collections = s
+}
+
+// 调用方持有 s.mu
+func (s *collectionStore) save() error {
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// SetStatus 设置观看状态，status 为空时取消
+func (s *collectionStore) SetStatus(userID, animeID int, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.data.Status[userID]
+	if m == nil {
+		m = make(map[int]string)
+		s.data.Status[userID] = m
+	}
+	if status == "" {
+		delete(m, animeID)
+	} else {
+		m[animeID] = status
+	}
+	return s.save()
+}
+
+func (s *collectionStore) Statuses(userID int) map[int]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[int]string, len(s.data.Status[userID]))
+	for id, st := range s.data.Status[userID] {
+		out[id] = st
+	}
+	return out
+}
+
+func (s *collectionStore) find(id int) *Collection {
+	for _, c := range s.data.Collections {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// canView 公开片单所有人可见，私有片单只有创建者和管理员可见
+func canView(col *Collection, u *User) bool {
+	return col.Public || (u != nil && (u.ID == col.OwnerID || u.Role == roleAdmin))
+}
+
+func canEdit(col *Collection, u *User) bool {
+	return u != nil && (u.ID == col.OwnerID || u.Role == roleAdmin)
+}
+
+// Get 返回片单副本
+func (s *collectionStore) Get(id int, u *User) (Collection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	col := s.find(id)
+	if col == nil || !canView(col, u) {
+		return Collection{}, errNotFound
+	}
+	out := *col
+	out.Items = append([]int{}, col.Items...)
+	return out, nil
+}
+
+// List 返回可见的片单；featured 为 true 时只返回首页推荐
+func (s *collectionStore) List(u *User, featured bool) []Collection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Collection{}
+	for _, col := range s.data.Collections {
+		if featured && !(col.Featured && col.Public) {
+			continue
+		}
+		if !featured && !canView(col, u) {
+			continue
+		}
+		c := *col
+		c.Items = append([]int{}, col.Items...)
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UpdatedAt.After(out[j].UpdatedAt) })
+	return out
+}
+
+func (s *collectionStore) Create(u *User, col Collection) (Collection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	col.ID, col.OwnerID, col.Items = s.data.NextID, u.ID, []int{}
+	col.CreatedAt, col.UpdatedAt = now, now
+	s.data.NextID++
+	s.data.Collections = append(s.data.Collections, &col)
+	return col, s.save()
+}
+
+// Edit 在持锁状态下修改片单，fn 返回错误时不保存
+func (s *collectionStore) Edit(id int, u *User, fn func(*Collection) error) (Collection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	col := s.find(id)
+	if col == nil || !canView(col, u) {
+		return Collection{}, errNotFound
+	}
+	if !canEdit(col, u) {
+		return Collection{}, errForbidden
+	}
+	if err := fn(col); err != nil {
+		return Collection{}, err
+	}
+	col.UpdatedAt = time.Now()
+	return *col, s.save()
+}
+
+func (s *collectionStore) Delete(id int, u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, col := range s.data.Collections {
+		if col.ID != id {
+			continue
+		}
+		if !canView(col, u) {
+			break
+		}
+		if !canEdit(col, u) {
+			return errForbidden
+		}
+		s.data.Collections = append(s.data.Collections[:i], s.data.Collections[i+1:]...)
+		return s.save()
+	}
+	return errNotFound
+}
+
+func writeCollectionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNotFound):
+		http.Error(w, "collection not found", 404)
+	case errors.Is(err, errForbidden):
+		http.Error(w, "forbidden", 403)
+	case errors.Is(err, errLoginRequired):
+		http.Error(w, err.Error(), 401)
+	default:
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+// withOwner 填充创建者用户名
+func withOwner(col Collection) Collection {
+	users.mu.Lock()
+	if u := users.userByID(col.OwnerID); u != nil {
+		col.Owner = u.Username
+	}
+	users.mu.Unlock()
+	return col
+}
+
+// animeIDFilter 把 /api/anime 的 status 和 collection 参数转成 ID 集合，未使用时返回 nil
+func animeIDFilter(r *http.Request) (map[int]bool, error) {
+	q := r.URL.Query()
+	var ids map[int]bool
+	intersect := func(set map[int]bool) {
+		if ids == nil {
+			ids = set
+			return
+		}
+		for id := range ids {
+			if !set[id] {
+				delete(ids, id)
+			}
+		}
+	}
+
+	if status := splitParams(q["status"]); len(status) > 0 {
+		u, _ := currentUser(r)
+		if u == nil {
+			return nil, errLoginRequired
+		}
+		set := make(map[int]bool)
+		for id, st := range collections.Statuses(u.ID) {
+			if containsString(status, st) {
+				set[id] = true
+			}
+		}
+		intersect(set)
+	}
+	if v := q.Get("collection"); v != "" {
+		id, _ := strconv.Atoi(v)
+		u, _ := currentUser(r)
+		col, err := collections.Get(id, u)
+		if err != nil {
+			return nil, err
+		}
+		set := make(map[int]bool, len(col.Items))
+		for _, id := range col.Items {
+			set[id] = true
+		}
+		intersect(set)
+	}
+	return ids, nil
+}
+
+// GET 返回当前用户所有番剧的状态；POST {"anime_id": 1, "status": "watching"}，status 为空时取消
+func handleWatchStatus(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(collections.Statuses(u.ID))
+	case http.MethodPost:
+		var req struct {
+			AnimeID int    `json:"anime_id"`
+			Status  string `json:"status"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+			http.Error(w, "invalid request", 400)
+			return
+		}
+		if _, ok := currentCatalog().animeByID[req.AnimeID]; !ok {
+			http.Error(w, "anime not found", 404)
+			return
+		}
+		if req.Status != "" && !containsString(watchStatuses, req.Status) {
+			http.Error(w, "invalid status", 400)
+			return
+		}
+		if err := collections.SetStatus(u.ID, req.AnimeID, req.Status); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"anime_id": req.AnimeID, "status": req.Status})
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+type collectionRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Public      *bool   `json:"public"`
+	Featured    *bool   `json:"featured"`
+	AnimeID     int     `json:"anime_id"`
+}
+
+// apply 先校验全部字段再写入，出错时不改动 col
+func (req collectionRequest) apply(col *Collection, u *User) error {
+	var name string
+	if req.Name != nil {
+		name = strings.TrimSpace(*req.Name)
+		if name == "" || utf8.RuneCountInString(name) > 50 {
+			return errors.New("片单名需为 1-50 个字符")
+		}
+	}
+	if req.Description != nil && utf8.RuneCountInString(*req.Description) > 1000 {
+		return errors.New("简介过长")
+	}
+	if req.Featured != nil && u.Role != roleAdmin {
+		return errForbidden
+	}
+	if req.Name != nil {
+		col.Name = name
+	}
+	if req.Description != nil {
+		col.Description = *req.Description
+	}
+	if req.Public != nil {
+		col.Public = *req.Public
+	}
+	if req.Featured != nil {
+		col.Featured = *req.Featured
+	}
+	return nil
+}
+
+// /api/collections：GET 列出可见片单（?featured=1 为首页推荐，?mine=1 为自己的），POST 新建片单
+func handleCollections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		u, _ := currentUser(r)
+		list := collections.List(u, r.URL.Query().Get("featured") == "1")
+		mine := r.URL.Query().Get("mine") == "1"
+		out := []Collection{}
+		for _, col := range list {
+			if mine && (u == nil || col.OwnerID != u.ID) {
+				continue
+			}
+			out = append(out, withOwner(col))
+		}
+		json.NewEncoder(w).Encode(out)
+	case http.MethodPost:
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		var req collectionRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8192)).Decode(&req); err != nil || req.Name == nil {
+			http.Error(w, "invalid request", 400)
+			return
+		}
+		var col Collection
+		if err := req.apply(&col, u); err != nil {
+			writeCollectionError(w, err)
+			return
+		}
+		col, err := collections.Create(u, col)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(withOwner(col))
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+// /api/collections/{id}：GET 片单及番剧，POST 修改，DELETE 删除；
+// /api/collections/{id}/items：POST {"anime_id": 1} 添加，DELETE ?anime_id=1 移除
+func handleCollection(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/collections/")
+	idStr, sub, _ := strings.Cut(rest, "/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil || (sub != "" && sub != "items") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodGet {
+		u, _ := currentUser(r)
+		col, err := collections.Get(id, u)
+		if err != nil {
+			writeCollectionError(w, err)
+			return
+		}
+		c := currentCatalog()
+		anime := []AnimeInfo{}
+		for _, aid := range col.Items {
+			if a, ok := c.animeByID[aid]; ok {
+				a.HasResource = c.Mapping[a.ID]
+				c.setFranchise(&a)
+				anime = append(anime, a)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"collection": withOwner(col), "anime": anime})
+		return
+	}
+
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var col Collection
+	switch {
+	case sub == "" && r.Method == http.MethodPost:
+		var req collectionRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8192)).Decode(&req); err != nil {
+			http.Error(w, "invalid request", 400)
+			return
+		}
+		col, err = collections.Edit(id, u, func(c *Collection) error { return req.apply(c, u) })
+	case sub == "" && r.Method == http.MethodDelete:
+		if err := collections.Delete(id, u); err != nil {
+			writeCollectionError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+		return
+	case sub == "items" && r.Method == http.MethodPost:
+		var req collectionRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+			http.Error(w, "invalid request", 400)
+			return
+		}
+		if _, ok := currentCatalog().animeByID[req.AnimeID]; !ok {
+			http.Error(w, "anime not found", 404)
+			return
+		}
+		col, err = collections.Edit(id, u, func(c *Collection) error {
+			for _, aid := range c.Items {
+				if aid == req.AnimeID {
+					return nil
+				}
+			}
+			c.Items = append(c.Items, req.AnimeID)
+			return nil
+		})
+	case sub == "items" && r.Method == http.MethodDelete:
+		animeID, _ := strconv.Atoi(r.URL.Query().Get("anime_id"))
+		col, err = collections.Edit(id, u, func(c *Collection) error {
+			for i, aid := range c.Items {
+				if aid == animeID {
+					c.Items = append(c.Items[:i], c.Items[i+1:]...)
+					break
+				}
+			}
+			return nil
+		})
+	default:
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if err != nil {
+		writeCollectionError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(withOwner(col))
+}
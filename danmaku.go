@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 弹幕：实现 DPlayer 的 v3 弹幕接口（GET/POST {api}v3/?id=），
+// 播放器里配置 danmaku: { id, api: '/api/danmaku/' } 即可使用
+// 弹幕 id 为 "番剧ID:集数"（如 55770:3），识别不出集数的文件用存储路径
+// 数据以追加日志保存在 data/danmaku.jsonl，删除也记为一行，启动时重放
+
+const danmakuFile = "data/danmaku.jsonl"
+
+// 发送频率限制：同一用户/IP 两条之间至少间隔 3 秒，每分钟最多 20 条
+const (
+	danmakuMinInterval = 3 * time.Second
+	danmakuPerMinute   = 20
+	danmakuMaxLength   = 100
+)
+
+type Danmaku struct {
+	CID    int64   `json:"cid"`
+	Video  string  `json:"id"`
+	Time   float64 `json:"time"`
+	Type   int     `json:"type"` // 0 滚动 1 顶部 2 底部
+	Color  int     `json:"color"`
+	Author string  `json:"author"`
+	Text   string  `json:"text"`
+	UserID int     `json:"user_id,omitempty"`
+	IP     string  `json:"ip,omitempty"`
+	At     int64   `json:"at"`
+}
+
+type danmakuLogEntry struct {
+	*Danmaku
+	Deleted int64 `json:"deleted,omitempty"` // 被删除的弹幕 cid
+}
+
+type danmakuStore struct {
+	mu     sync.Mutex
+	file   *os.File
+	byID   map[string][]*Danmaku
+	nextID int64
+
+	rateMu sync.Mutex
+	recent map[string][]time.Time // 用户/IP -> 最近发送时间
+}
+
+var danmaku *danmakuStore
+
+func initDanmaku() {
+	s := &danmakuStore{byID: make(map[string][]*Danmaku), recent: make(map[string][]time.Time), nextID: 1}
+	if f, err := os.Open(danmakuFile); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e danmakuLogEntry
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				continue
+			}
+			if e.Deleted > 0 {
+				s.remove(e.Deleted)
+				continue
+			}
+			if e.Danmaku != nil {
+				s.byID[e.Video] = append(s.byID[e.Video], e.Danmaku)
+				s.nextID = max(s.nextID, e.CID+1)
+			}
+		}
+		f.Close()
+	}
+	f, err := os.OpenFile(danmakuFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("警告: 无法打开弹幕文件，弹幕不会保存: %v", err)
+	}
+	s.file = f
+	danmaku = s
+}
+
+// 调用方持有 s.mu
+func (s *danmakuStore) appendLog(e danmakuLogEntry) {
+	if s.file == nil {
+		return
+	}
+	data, _ := json.Marshal(e)
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		log.Printf("保存弹幕失败: %v", err)
+	}
+}
+
+// 调用方持有 s.mu
+func (s *danmakuStore) remove(cid int64) bool {
+	for id, list := range s.byID {
+		for i, d := range list {
+			if d.CID == cid {
+				s.byID[id] = append(list[:i], list[i+1:]...)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *danmakuStore) Add(d *Danmaku) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d.CID = s.nextID
+	s.nextID++
+	s.byID[d.Video] = append(s.byID[d.Video], d)
+	s.appendLog(danmakuLogEntry{Danmaku: d})
+}
+
+func (s *danmakuStore) Delete(cid int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.remove(cid) {
+		return false
+	}
+	s.appendLog(danmakuLogEntry{Deleted: cid})
+	return true
+}
+
+// List 返回某个视频的弹幕，超过 max 条时取最新的
+func (s *danmakuStore) List(id string, max int) []Danmaku {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.byID[id]
+	if max > 0 && len(list) > max {
+		list = list[len(list)-max:]
+	}
+	out := make([]Danmaku, len(list))
+	for i, d := range list {
+		out[i] = *d
+	}
+	return out
+}
+
+// allow 检查发送频率，通过时记下本次发送
+func (s *danmakuStore) allow(key string) bool {
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+	now := time.Now()
+	var kept []time.Time
+	for _, t := range s.recent[key] {
+		if now.Sub(t) < time.Minute {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) > 0 && now.Sub(kept[len(kept)-1]) < danmakuMinInterval || len(kept) >= danmakuPerMinute {
+		s.recent[key] = kept
+		return false
+	}
+	s.recent[key] = append(kept, now)
+	// 顺便清理长时间不发言的记录
+	if len(s.recent) > 1000 {
+		for k, times := range s.recent {
+			if len(times) == 0 || now.Sub(times[len(times)-1]) > time.Minute {
+				delete(s.recent, k)
+			}
+		}
+	}
+	return true
+}
+
+// blockedWord 返回弹幕中包含的屏蔽词，忽略大小写和空白
+func blockedWord(text string) string {
+	norm := strings.ToLower(strings.Join(strings.Fields(text), ""))
+	for _, w := range config.DanmakuBlockWords {
+		if w != "" && strings.Contains(norm, strings.ToLower(w)) {
+			return w
+		}
+	}
+	return ""
+}
+
+// danmakuID 正片按 "番剧ID:集数" 共用弹幕，分季的加上季数，其余按文件路径
+func danmakuID(animeID int, ep EpisodeInfo) string {
+	switch {
+	case ep.Special != "" || ep.Episode <= 0:
+		return ep.Path
+	case ep.Season > 0:
+		return fmt.Sprintf("%d:S%dE%g", animeID, ep.Season, ep.Episode)
+	}
+	return fmt.Sprintf("%d:%g", animeID, ep.Episode)
+}
+
+// fromLocalProxy 请求是否来自本机，即经过同机的反向代理，只有这时才信任 X-Forwarded-* 头
+func fromLocalProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// clientIP 只有请求来自本机（反向代理）时才信任 X-Forwarded-For，避免伪造绕过频率限制
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !fromLocalProxy(r) {
+		return host
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		parts := strings.Split(fwd, ",")
+		return strings.TrimSpace(parts[len(parts)-1])
+	}
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	return host
+}
+
+// parseColor 兼容数字和 "#rrggbb" 两种格式
+func parseColor(v interface{}) int {
+	switch c := v.(type) {
+	case float64:
+		return int(c) & 0xFFFFFF
+	case string:
+		n, _ := strconv.ParseInt(strings.TrimPrefix(c, "#"), 16, 32)
+		return int(n) & 0xFFFFFF
+	}
+	return 0xFFFFFF
+}
+
+func writeDanmakuResult(w http.ResponseWriter, code int, msg string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"code": code, "data": data}
+	if msg != "" {
+		resp["msg"] = msg
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// /api/danmaku/v3/：GET ?id=&max= 读取，POST {"id","author","time","text","color","type"} 发送
+func handleDanmaku(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			writeDanmakuResult(w, 1, "id required", []interface{}{})
+			return
+		}
+		max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		// DPlayer 的格式：[时间, 类型, 颜色, 作者, 内容]
+		data := [][]interface{}{}
+		for _, d := range danmaku.List(id, max) {
+			data = append(data, []interface{}{d.Time, d.Type, d.Color, d.Author, d.Text})
+		}
+		writeDanmakuResult(w, 0, "", data)
+	case http.MethodPost:
+		postDanmaku(w, r)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func postDanmaku(w http.ResponseWriter, r *http.Request) {
+	// 只接受 JSON，跨站表单无法提交
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, "json required", 415)
+		return
+	}
+	var req struct {
+		ID     string      `json:"id"`
+		Author string      `json:"author"`
+		Time   float64     `json:"time"`
+		Text   string      `json:"text"`
+		Color  interface{} `json:"color"`
+		Type   interface{} `json:"type"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeDanmakuResult(w, 1, "invalid request", nil)
+		return
+	}
+	text := strings.TrimSpace(req.Text)
+	switch {
+	case req.ID == "" || text == "":
+		writeDanmakuResult(w, 1, "弹幕内容不能为空", nil)
+		return
+	case utf8.RuneCountInString(text) > danmakuMaxLength:
+		writeDanmakuResult(w, 1, "弹幕太长了", nil)
+		return
+	case req.Time < 0:
+		writeDanmakuResult(w, 1, "invalid time", nil)
+		return
+	}
+	if word := blockedWord(text); word != "" {
+		writeDanmakuResult(w, 1, "弹幕包含屏蔽词", nil)
+		return
+	}
+
+	d := &Danmaku{Video: req.ID, Time: req.Time, Color: parseColor(req.Color), Text: text, IP: clientIP(r), At: time.Now().Unix()}
+	// DPlayer 旧版本 type 传 "right"/"top"/"bottom"
+	switch t := req.Type.(type) {
+	case float64:
+		if t >= 0 && t <= 2 {
+			d.Type = int(t)
+		}
+	case string:
+		d.Type = map[string]int{"top": 1, "bottom": 2}[t]
+	}
+	rateKey := "ip:" + d.IP
+	if u, _ := currentUser(r); u != nil {
+		d.UserID, d.Author, rateKey = u.ID, u.Username, "user:"+strconv.Itoa(u.ID)
+	} else {
+		d.Author = "匿名"
+	}
+	if !danmaku.allow(rateKey) {
+		writeDanmakuResult(w, 1, "发送太频繁，请稍后再试", nil)
+		return
+	}
+	danmaku.Add(d)
+	writeDanmakuResult(w, 0, "", map[string]interface{}{
+		"time": d.Time, "type": d.Type, "color": d.Color, "author": d.Author, "text": d.Text,
+	})
+}
+
+// 管理弹幕：GET ?id= 列出带 cid、用户和 IP 的完整记录，DELETE ?cid= 删除
+func handleAdminDanmaku(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list := danmaku.List(r.URL.Query().Get("id"), 0)
+		sort.Slice(list, func(i, j int) bool { return list[i].At > list[j].At })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodDelete:
+		cid, _ := strconv.ParseInt(r.URL.Query().Get("cid"), 10, 64)
+		if !danmaku.Delete(cid) {
+			http.Error(w, "danmaku not found", 404)
+			return
+		}
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
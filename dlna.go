@@ -0,0 +1,629 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DLNA 媒体服务器：让只支持 DLNA 的电视直接浏览和播放番剧
+//   SSDP 宣告见 ssdp.go
+//   /dlna/device.xml                 设备描述
+//   /dlna/ContentDirectory.xml 等    服务描述（SCPD）
+//   /dlna/control/{service}          SOAP 控制
+//   /dlna/media/{id}/{n}.mkv         剧集文件，按 /api/get 的规则重定向到直链或代理
+// 目录结构：年份 / 番剧 / 剧集
+
+type DLNAConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Name      string `json:"name"`      // 电视上显示的名称，默认“动漫站 (主机名)”
+	Interface string `json:"interface"` // 只在该网卡上宣告，为空时使用系统默认网卡
+}
+
+const (
+	dlnaDeviceType        = "urn:schemas-upnp-org:device:MediaServer:1"
+	dlnaContentDirectory  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	dlnaConnectionManager = "urn:schemas-upnp-org:service:ConnectionManager:1"
+
+	// 允许按字节区间拖动、流式传输
+	dlnaFeatures = "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+)
+
+var (
+	dlnaUUID string
+	dlnaName string
+)
+
+func initDLNA() {
+	if !config.DLNA.Enabled {
+		return
+	}
+	host, _ := os.Hostname()
+	dlnaName = config.DLNA.Name
+	if dlnaName == "" {
+		dlnaName = "动漫站 (" + host + ")"
+	}
+	// 按主机名和端口生成固定的 UUID，重启后电视不会看到重复的设备
+	sum := sha1.Sum([]byte("anime-site/dlna/" + host + "/" + config.Port))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	h := hex.EncodeToString(sum[:16])
+	dlnaUUID = h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+
+	http.HandleFunc("/dlna/device.xml", handleDLNADevice)
+	http.HandleFunc("/dlna/ContentDirectory.xml", handleDLNASCPD(contentDirectorySCPD))
+	http.HandleFunc("/dlna/ConnectionManager.xml", handleDLNASCPD(connectionManagerSCPD))
+	http.HandleFunc("/dlna/control/ContentDirectory", handleContentDirectory)
+	http.HandleFunc("/dlna/control/ConnectionManager", handleConnectionManager)
+	http.HandleFunc("/dlna/event/", handleDLNAEvent)
+	http.HandleFunc("/dlna/media/", handleDLNAMedia)
+
+	s := &ssdpAnnouncer{uuid: dlnaUUID, port: config.Port}
+	if config.DLNA.Interface != "" {
+		ifi, err := net.InterfaceByName(config.DLNA.Interface)
+		if err != nil {
+			log.Printf("DLNA 网卡 %s 不存在: %v", config.DLNA.Interface, err)
+			return
+		}
+		s.iface = ifi
+	}
+	if err := s.start(); err != nil {
+		log.Printf("DLNA 启动 SSDP 失败: %v", err)
+		return
+	}
+	log.Printf("DLNA 媒体服务器已启用: %s (uuid:%s)", dlnaName, dlnaUUID)
+}
+
+func handleDLNADevice(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>%s</deviceType>
+<friendlyName>%s</friendlyName>
+<manufacturer>anime-site</manufacturer>
+<modelName>anime-site</modelName>
+<modelNumber>1.0</modelNumber>
+<UDN>uuid:%s</UDN>
+<dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
+<serviceList>
+<service><serviceType>%s</serviceType><serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId><SCPDURL>/dlna/ContentDirectory.xml</SCPDURL><controlURL>/dlna/control/ContentDirectory</controlURL><eventSubURL>/dlna/event/ContentDirectory</eventSubURL></service>
+<service><serviceType>%s</serviceType><serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId><SCPDURL>/dlna/ConnectionManager.xml</SCPDURL><controlURL>/dlna/control/ConnectionManager</controlURL><eventSubURL>/dlna/event/ConnectionManager</eventSubURL></service>
+</serviceList>
+</device>
+</root>`, dlnaDeviceType, xmlText(dlnaName), dlnaUUID, dlnaContentDirectory, dlnaConnectionManager)
+}
+
+// ---- 服务描述 ----
+
+type scpdArg struct{ name, dir, variable string }
+
+type scpdAction struct {
+	name string
+	args []scpdArg
+}
+
+type scpdVar struct {
+	name, typ string
+	values    []string
+	events    bool
+}
+
+type scpd struct {
+	actions []scpdAction
+	vars    []scpdVar
+}
+
+var contentDirectorySCPD = scpd{
+	actions: []scpdAction{
+		{"GetSearchCapabilities", []scpdArg{{"SearchCaps", "out", "SearchCapabilities"}}},
+		{"GetSortCapabilities", []scpdArg{{"SortCaps", "out", "SortCapabilities"}}},
+		{"GetSystemUpdateID", []scpdArg{{"Id", "out", "SystemUpdateID"}}},
+		{"Browse", []scpdArg{
+			{"ObjectID", "in", "A_ARG_TYPE_ObjectID"},
+			{"BrowseFlag", "in", "A_ARG_TYPE_BrowseFlag"},
+			{"Filter", "in", "A_ARG_TYPE_Filter"},
+			{"StartingIndex", "in", "A_ARG_TYPE_Index"},
+			{"RequestedCount", "in", "A_ARG_TYPE_Count"},
+			{"SortCriteria", "in", "A_ARG_TYPE_SortCriteria"},
+			{"Result", "out", "A_ARG_TYPE_Result"},
+			{"NumberReturned", "out", "A_ARG_TYPE_Count"},
+			{"TotalMatches", "out", "A_ARG_TYPE_Count"},
+			{"UpdateID", "out", "A_ARG_TYPE_UpdateID"},
+		}},
+	},
+	vars: []scpdVar{
+		{name: "SearchCapabilities", typ: "string"},
+		{name: "SortCapabilities", typ: "string"},
+		{name: "SystemUpdateID", typ: "ui4", events: true},
+		{name: "A_ARG_TYPE_ObjectID", typ: "string"},
+		{name: "A_ARG_TYPE_BrowseFlag", typ: "string", values: []string{"BrowseMetadata", "BrowseDirectChildren"}},
+		{name: "A_ARG_TYPE_Filter", typ: "string"},
+		{name: "A_ARG_TYPE_Index", typ: "ui4"},
+		{name: "A_ARG_TYPE_Count", typ: "ui4"},
+		{name: "A_ARG_TYPE_SortCriteria", typ: "string"},
+		{name: "A_ARG_TYPE_Result", typ: "string"},
+		{name: "A_ARG_TYPE_UpdateID", typ: "ui4"},
+	},
+}
+
+var connectionManagerSCPD = scpd{
+	actions: []scpdAction{
+		{"GetProtocolInfo", []scpdArg{{"Source", "out", "SourceProtocolInfo"}, {"Sink", "out", "SinkProtocolInfo"}}},
+		{"GetCurrentConnectionIDs", []scpdArg{{"ConnectionIDs", "out", "CurrentConnectionIDs"}}},
+		{"GetCurrentConnectionInfo", []scpdArg{
+			{"ConnectionID", "in", "A_ARG_TYPE_ConnectionID"},
+			{"RcsID", "out", "A_ARG_TYPE_RcsID"},
+			{"AVTransportID", "out", "A_ARG_TYPE_AVTransportID"},
+			{"ProtocolInfo", "out", "A_ARG_TYPE_ProtocolInfo"},
+			{"PeerConnectionManager", "out", "A_ARG_TYPE_ConnectionManager"},
+			{"PeerConnectionID", "out", "A_ARG_TYPE_ConnectionID"},
+			{"Direction", "out", "A_ARG_TYPE_Direction"},
+			{"Status", "out", "A_ARG_TYPE_ConnectionStatus"},
+		}},
+	},
+	vars: []scpdVar{
+		{name: "SourceProtocolInfo", typ: "string", events: true},
+		{name: "SinkProtocolInfo", typ: "string", events: true},
+		{name: "CurrentConnectionIDs", typ: "string", events: true},
+		{name: "A_ARG_TYPE_ConnectionStatus", typ: "string", values: []string{"OK", "ContentFormatMismatch", "InsufficientBandwidth", "UnreliableChannel", "Unknown"}},
+		{name: "A_ARG_TYPE_ConnectionManager", typ: "string"},
+		{name: "A_ARG_TYPE_Direction", typ: "string", values: []string{"Input", "Output"}},
+		{name: "A_ARG_TYPE_ProtocolInfo", typ: "string"},
+		{name: "A_ARG_TYPE_ConnectionID", typ: "i4"},
+		{name: "A_ARG_TYPE_AVTransportID", typ: "i4"},
+		{name: "A_ARG_TYPE_RcsID", typ: "i4"},
+	},
+}
+
+func (d scpd) String() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+		`<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>0</minor></specVersion><actionList>`)
+	for _, a := range d.actions {
+		b.WriteString("<action><name>" + a.name + "</name><argumentList>")
+		for _, arg := range a.args {
+			b.WriteString("<argument><name>" + arg.name + "</name><direction>" + arg.dir +
+				"</direction><relatedStateVariable>" + arg.variable + "</relatedStateVariable></argument>")
+		}
+		b.WriteString("</argumentList></action>")
+	}
+	b.WriteString("</actionList><serviceStateTable>")
+	for _, v := range d.vars {
+		events := "no"
+		if v.events {
+			events = "yes"
+		}
+		b.WriteString(`<stateVariable sendEvents="` + events + `"><name>` + v.name + "</name><dataType>" + v.typ + "</dataType>")
+		if len(v.values) > 0 {
+			b.WriteString("<allowedValueList>")
+			for _, val := range v.values {
+				b.WriteString("<allowedValue>" + val + "</allowedValue>")
+			}
+			b.WriteString("</allowedValueList>")
+		}
+		b.WriteString("</stateVariable>")
+	}
+	b.WriteString("</serviceStateTable></scpd>")
+	return b.String()
+}
+
+func handleDLNASCPD(d scpd) http.HandlerFunc {
+	doc := d.String()
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, doc)
+	}
+}
+
+// handleDLNAEvent 不推送事件，只应答订阅，部分电视订阅失败会拒绝使用设备
+func handleDLNAEvent(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid := r.Header.Get("SID")
+		if sid == "" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			sid = "uuid:" + hex.EncodeToString(b)
+		}
+		w.Header()["SID"] = []string{sid}
+		w.Header()["TIMEOUT"] = []string{"Second-1800"}
+	case "UNSUBSCRIBE":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ---- SOAP ----
+
+type soapArg struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+type soapEnvelope struct {
+	Body struct {
+		Action struct {
+			XMLName xml.Name
+			Args    []soapArg `xml:",any"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// readSOAP 返回动作名和参数
+func readSOAP(r *http.Request) (string, map[string]string, error) {
+	var env soapEnvelope
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&env); err != nil {
+		return "", nil, err
+	}
+	args := make(map[string]string)
+	for _, a := range env.Body.Action.Args {
+		args[a.XMLName.Local] = strings.TrimSpace(a.Value)
+	}
+	return env.Body.Action.XMLName.Local, args, nil
+}
+
+// writeSOAP 输出动作响应，参数按给定顺序
+func writeSOAP(w http.ResponseWriter, service, action string, out [][2]string) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	b.WriteString("<u:" + action + `Response xmlns:u="` + service + `">`)
+	for _, kv := range out {
+		b.WriteString("<" + kv[0] + ">" + xmlText(kv[1]) + "</" + kv[0] + ">")
+	}
+	b.WriteString("</u:" + action + "Response></s:Body></s:Envelope>")
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header()["EXT"] = []string{""}
+	io.WriteString(w, b.String())
+}
+
+// UPnP 错误码：401 没有该动作，402 参数错误，701 没有该对象
+func writeSOAPFault(w http.ResponseWriter, code int, desc string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(500)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, xmlText(desc))
+}
+
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func handleConnectionManager(w http.ResponseWriter, r *http.Request) {
+	action, _, err := readSOAP(r)
+	if err != nil {
+		writeSOAPFault(w, 402, "Invalid Args")
+		return
+	}
+	switch action {
+	case "GetProtocolInfo":
+		var source []string
+		for _, t := range []string{"video/x-matroska", "video/mp4", "video/webm", "video/x-msvideo", "video/mp2t"} {
+			source = append(source, "http-get:*:"+t+":*")
+		}
+		writeSOAP(w, dlnaConnectionManager, action, [][2]string{{"Source", strings.Join(source, ",")}, {"Sink", ""}})
+	case "GetCurrentConnectionIDs":
+		writeSOAP(w, dlnaConnectionManager, action, [][2]string{{"ConnectionIDs", "0"}})
+	case "GetCurrentConnectionInfo":
+		writeSOAP(w, dlnaConnectionManager, action, [][2]string{
+			{"RcsID", "-1"}, {"AVTransportID", "-1"}, {"ProtocolInfo", ""},
+			{"PeerConnectionManager", ""}, {"PeerConnectionID", "-1"}, {"Direction", "Output"}, {"Status", "OK"},
+		})
+	default:
+		writeSOAPFault(w, 401, "Invalid Action")
+	}
+}
+
+func handleContentDirectory(w http.ResponseWriter, r *http.Request) {
+	action, args, err := readSOAP(r)
+	if err != nil {
+		writeSOAPFault(w, 402, "Invalid Args")
+		return
+	}
+	ix := currentDLNAIndex()
+	switch action {
+	case "GetSearchCapabilities":
+		writeSOAP(w, dlnaContentDirectory, action, [][2]string{{"SearchCaps", ""}})
+	case "GetSortCapabilities":
+		writeSOAP(w, dlnaContentDirectory, action, [][2]string{{"SortCaps", ""}})
+	case "GetSystemUpdateID":
+		writeSOAP(w, dlnaContentDirectory, action, [][2]string{{"Id", ix.updateID()}})
+	case "Browse":
+		base := "http://" + r.Host
+		var objs []dlnaObject
+		var total int
+		switch args["BrowseFlag"] {
+		case "BrowseMetadata":
+			obj, ok := ix.lookup(args["ObjectID"], base)
+			if !ok {
+				writeSOAPFault(w, 701, "No such object")
+				return
+			}
+			objs, total = []dlnaObject{obj}, 1
+		case "BrowseDirectChildren":
+			children, ok := ix.children(args["ObjectID"], base)
+			if !ok {
+				writeSOAPFault(w, 701, "No such object")
+				return
+			}
+			total = len(children)
+			start, _ := strconv.Atoi(args["StartingIndex"])
+			count, _ := strconv.Atoi(args["RequestedCount"])
+			if start < 0 || start > total {
+				start = total
+			}
+			end := total
+			if count > 0 && start+count < end {
+				end = start + count
+			}
+			objs = children[start:end]
+		default:
+			writeSOAPFault(w, 402, "Invalid Args")
+			return
+		}
+		writeSOAP(w, dlnaContentDirectory, action, [][2]string{
+			{"Result", didl(objs)},
+			{"NumberReturned", strconv.Itoa(len(objs))},
+			{"TotalMatches", strconv.Itoa(total)},
+			{"UpdateID", ix.updateID()},
+		})
+	default:
+		writeSOAPFault(w, 401, "Invalid Action")
+	}
+}
+
+// ---- 目录树 ----
+// 对象 ID：0 根目录，y<年份> 年份，a<番剧 ID> 番剧，e<番剧 ID>_<序号> 剧集
+
+type dlnaObject struct {
+	ID, Parent, Title string
+	Class             string
+	Container         bool
+	ChildCount        int
+	Art               string // 封面
+	URL               string // 剧集地址
+	Mime              string
+	Size              int64   // 未知为 0
+	Duration          float64 // 秒，未知为 0
+}
+
+// dlnaIndex 按年份分组的番剧，随数据快照重建
+type dlnaIndex struct {
+	catalog *Catalog
+	years   []int         // 从新到旧，0 为未知年份
+	byYear  map[int][]int // 年份 -> 番剧 ID，按放送日期排序
+}
+
+var (
+	dlnaIndexMu  sync.Mutex
+	dlnaIndexCur *dlnaIndex
+)
+
+func currentDLNAIndex() *dlnaIndex {
+	c := currentCatalog()
+	dlnaIndexMu.Lock()
+	defer dlnaIndexMu.Unlock()
+	if dlnaIndexCur != nil && dlnaIndexCur.catalog == c {
+		return dlnaIndexCur
+	}
+	ix := &dlnaIndex{catalog: c, byYear: make(map[int][]int)}
+	for id := range c.FolderPath {
+		a := c.animeByID[id]
+		if ix.byYear[a.Year] == nil {
+			ix.years = append(ix.years, a.Year)
+		}
+		ix.byYear[a.Year] = append(ix.byYear[a.Year], id)
+	}
+	sort.Slice(ix.years, func(i, j int) bool {
+		a, b := ix.years[i], ix.years[j]
+		if (a == 0) != (b == 0) {
+			return b == 0
+		}
+		return a > b
+	})
+	for _, ids := range ix.byYear {
+		sort.Slice(ids, func(i, j int) bool {
+			a, b := c.animeByID[ids[i]], c.animeByID[ids[j]]
+			if a.Date != b.Date {
+				return a.Date < b.Date
+			}
+			return ids[i] < ids[j]
+		})
+	}
+	dlnaIndexCur = ix
+	return ix
+}
+
+// updateID 数据重新加载后变化，电视据此刷新缓存的目录
+func (ix *dlnaIndex) updateID() string {
+	return strconv.FormatUint(uint64(uint32(ix.catalog.LoadedAt.Unix())), 10)
+}
+
+func yearTitle(year int) string {
+	if year == 0 {
+		return "未知年份"
+	}
+	return strconv.Itoa(year) + "年"
+}
+
+func (ix *dlnaIndex) yearObject(year int) dlnaObject {
+	return dlnaObject{ID: "y" + strconv.Itoa(year), Parent: "0", Title: yearTitle(year),
+		Class: "object.container.storageFolder", Container: true, ChildCount: len(ix.byYear[year])}
+}
+
+func (ix *dlnaIndex) animeObject(id int) dlnaObject {
+	a := ix.catalog.animeByID[id]
+	title := animeTitle(a)
+	if title == "" {
+		title = strconv.Itoa(id)
+	}
+	return dlnaObject{ID: "a" + strconv.Itoa(id), Parent: "y" + strconv.Itoa(a.Year), Title: title,
+		Class: "object.container.storageFolder", Container: true, ChildCount: len(ix.catalog.Episodes[id]), Art: a.Cover}
+}
+
+func (ix *dlnaIndex) episodeObject(id, n int, ep EpisodeInfo, base string) dlnaObject {
+	title := ep.Label
+	if title == "" {
+		title = strings.TrimSuffix(ep.Name, path.Ext(ep.Name))
+	}
+	obj := dlnaObject{ID: fmt.Sprintf("e%d_%d", id, n), Parent: "a" + strconv.Itoa(id), Title: title,
+		Class: "object.item.videoItem", Mime: contentTypeOf(ep.Name),
+		URL: fmt.Sprintf("%s/dlna/media/%d/%d%s", base, id, n, strings.ToLower(path.Ext(ep.Name)))}
+	// 不逐个查询存储，只用已探测过的大小和时长
+	if info, ok := mediaInfos.FileInfo(ep.Path); ok {
+		obj.Size = info.Size
+	}
+	if m := mediaInfos.Cached(ep.Path); m != nil {
+		obj.Duration = m.Duration
+	}
+	return obj
+}
+
+// parseEpisodeID 解析 e<番剧 ID>_<序号>
+func parseEpisodeID(s string) (int, int, bool) {
+	a, b, ok := strings.Cut(strings.TrimPrefix(s, "e"), "_")
+	if !ok || !strings.HasPrefix(s, "e") {
+		return 0, 0, false
+	}
+	id, err1 := strconv.Atoi(a)
+	n, err2 := strconv.Atoi(b)
+	return id, n, err1 == nil && err2 == nil
+}
+
+func (ix *dlnaIndex) lookup(objID, base string) (dlnaObject, bool) {
+	c := ix.catalog
+	switch {
+	case objID == "0":
+		return dlnaObject{ID: "0", Parent: "-1", Title: dlnaName, Class: "object.container.storageFolder",
+			Container: true, ChildCount: len(ix.years)}, true
+	case strings.HasPrefix(objID, "y"):
+		year, err := strconv.Atoi(objID[1:])
+		if err != nil || ix.byYear[year] == nil {
+			return dlnaObject{}, false
+		}
+		return ix.yearObject(year), true
+	case strings.HasPrefix(objID, "a"):
+		id, err := strconv.Atoi(objID[1:])
+		if _, ok := c.FolderPath[id]; err != nil || !ok {
+			return dlnaObject{}, false
+		}
+		return ix.animeObject(id), true
+	case strings.HasPrefix(objID, "e"):
+		id, n, ok := parseEpisodeID(objID)
+		if !ok {
+			return dlnaObject{}, false
+		}
+		_, episodes, ok := animeEpisodes(c, id)
+		if !ok || n < 0 || n >= len(episodes) {
+			return dlnaObject{}, false
+		}
+		return ix.episodeObject(id, n, episodes[n], base), true
+	}
+	return dlnaObject{}, false
+}
+
+func (ix *dlnaIndex) children(objID, base string) ([]dlnaObject, bool) {
+	var out []dlnaObject
+	switch {
+	case objID == "0":
+		for _, y := range ix.years {
+			out = append(out, ix.yearObject(y))
+		}
+	case strings.HasPrefix(objID, "y"):
+		year, err := strconv.Atoi(objID[1:])
+		if err != nil || ix.byYear[year] == nil {
+			return nil, false
+		}
+		for _, id := range ix.byYear[year] {
+			out = append(out, ix.animeObject(id))
+		}
+	case strings.HasPrefix(objID, "a"):
+		id, err := strconv.Atoi(objID[1:])
+		if err != nil {
+			return nil, false
+		}
+		_, episodes, ok := animeEpisodes(ix.catalog, id)
+		if !ok {
+			return nil, false
+		}
+		for n, ep := range episodes {
+			out = append(out, ix.episodeObject(id, n, ep, base))
+		}
+	case strings.HasPrefix(objID, "e"):
+		if _, ok := ix.lookup(objID, base); !ok {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	return out, true
+}
+
+// didl 生成 Browse 结果里的 DIDL-Lite 文档
+func didl(objs []dlnaObject) string {
+	var b strings.Builder
+	b.WriteString(`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/" xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/">`)
+	for _, o := range objs {
+		if o.Container {
+			fmt.Fprintf(&b, `<container id="%s" parentID="%s" restricted="1" searchable="0" childCount="%d">`, o.ID, o.Parent, o.ChildCount)
+		} else {
+			fmt.Fprintf(&b, `<item id="%s" parentID="%s" restricted="1">`, o.ID, o.Parent)
+		}
+		b.WriteString("<dc:title>" + xmlText(o.Title) + "</dc:title><upnp:class>" + o.Class + "</upnp:class>")
+		if o.Art != "" {
+			b.WriteString("<upnp:albumArtURI>" + xmlText(o.Art) + "</upnp:albumArtURI>")
+		}
+		if o.Container {
+			b.WriteString("</container>")
+			continue
+		}
+		b.WriteString(`<res protocolInfo="http-get:*:` + o.Mime + ":" + dlnaFeatures + `"`)
+		if o.Size > 0 {
+			fmt.Fprintf(&b, ` size="%d"`, o.Size)
+		}
+		if o.Duration > 0 {
+			d := int(o.Duration * 1000)
+			fmt.Fprintf(&b, ` duration="%d:%02d:%02d.%03d"`, d/3600000, d/60000%60, d/1000%60, d%1000)
+		}
+		b.WriteString(">" + xmlText(o.URL) + "</res></item>")
+	}
+	b.WriteString("</DIDL-Lite>")
+	return b.String()
+}
+
+// handleDLNAMedia /dlna/media/{番剧 ID}/{序号}.ext
+func handleDLNAMedia(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/dlna/media/")
+	idStr, name, _ := strings.Cut(rest, "/")
+	id, err1 := strconv.Atoi(idStr)
+	n, err2 := strconv.Atoi(strings.TrimSuffix(name, path.Ext(name)))
+	if err1 != nil || err2 != nil {
+		http.NotFound(w, r)
+		return
+	}
+	_, episodes, ok := animeEpisodes(currentCatalog(), id)
+	if !ok || n < 0 || n >= len(episodes) {
+		http.NotFound(w, r)
+		return
+	}
+	// 部分电视区分头部大小写，不用 Set 的规范化写法
+	w.Header()["transferMode.dlna.org"] = []string{"Streaming"}
+	w.Header()["contentFeatures.dlna.org"] = []string{dlnaFeatures}
+	redirectOrStream(w, r, episodes[n].Path)
+}
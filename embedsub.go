@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 内封字幕：按需从 MKV 的 Cluster 里取出字幕轨的块，拼成 ASS 或 SRT，
+// 结果存到 data/subtitle_cache（超过 embedSubCacheMax 时删掉最久没用过的），之后由 subtitle.go 转成 WebVTT。
+// Cues 里有字幕轨的索引时只读需要的块，否则从第一个 Cluster 顺序扫到最后
+
+const embedSubDir = "data/subtitle_cache"
+
+const (
+	embedSubCacheMax = 200 << 20 // 字幕缓存目录的容量上限
+	embedSubTimeout  = 10 * time.Minute
+	embedSubWorkers  = 4
+	embedSubWindow   = 64 << 10  // 按索引读取时每次区间请求的大小
+	embedSubScanBuf  = 256 << 10 // 顺序扫描的缓冲
+	embedSubDuration = 5.0       // 块没有时长时最多显示几秒
+)
+
+// embeddedSubtitleFormat 返回字幕轨拼出来的格式，图形字幕返回空
+func embeddedSubtitleFormat(codecID string) string {
+	switch codecID {
+	case "S_TEXT/ASS", "S_TEXT/SSA", "S_ASS", "S_SSA":
+		return "ass"
+	case "S_TEXT/UTF8", "S_TEXT/ASCII", "S_TEXT/WEBVTT":
+		return "srt"
+	}
+	return ""
+}
+
+// embeddedSubtitleLang 从轨道名和语言代码推断字幕语言，取值同 subtitleLangTags
+func embeddedSubtitleLang(t MediaTrack) string {
+	name := strings.ToLower(t.Name)
+	hasJpn := strings.Contains(name, "日") || strings.Contains(name, "jp")
+	switch {
+	case strings.Contains(name, "简") && hasJpn:
+		return "chs_jpn"
+	case strings.Contains(name, "繁") && hasJpn:
+		return "cht_jpn"
+	case strings.Contains(name, "简") || strings.Contains(name, "chs"):
+		return "chs"
+	case strings.Contains(name, "繁") || strings.Contains(name, "cht"):
+		return "cht"
+	}
+	lang := strings.ToLower(t.Language)
+	if l, ok := subtitleLangTags[lang]; ok {
+		return l
+	}
+	switch {
+	case strings.HasPrefix(lang, "zh-hant"), strings.HasPrefix(lang, "zh-tw"), strings.HasPrefix(lang, "zh-hk"):
+		return "cht"
+	case lang == "chi", lang == "zho", strings.HasPrefix(lang, "zh"):
+		return "chs"
+	case strings.HasPrefix(lang, "ja"):
+		return "jpn"
+	case strings.HasPrefix(lang, "en"):
+		return "eng"
+	}
+	return ""
+}
+
+func embeddedSubtitleURL(p string, track int, format string) string {
+	return subtitleURL(p, format) + "&track=" + strconv.Itoa(track)
+}
+
+// embeddedSubtitles 列出文件里能转换的文本字幕轨
+func embeddedSubtitles(p string, m *MediaInfo) []SubtitleInfo {
+	var out []SubtitleInfo
+	for _, t := range m.Tracks {
+		format := embeddedSubtitleFormat(t.CodecID)
+		if t.Type != "subtitle" || format == "" {
+			continue
+		}
+		lang := embeddedSubtitleLang(t)
+		label := t.Name
+		if label == "" {
+			label = subtitleLangLabels[lang]
+		}
+		if label == "" {
+			label = "字幕"
+		}
+		out = append(out, SubtitleInfo{
+			Name:   fmt.Sprintf("轨道 %d (%s)", t.Number, t.Codec),
+			Lang:   lang,
+			Label:  label + "（内封）",
+			Format: format,
+			URL:    embeddedSubtitleURL(p, t.Number, "vtt"),
+			RawURL: embeddedSubtitleURL(p, t.Number, "raw"),
+		})
+	}
+	return out
+}
+
+// ---- 提取 ----
+
+type subEvent struct {
+	start, end float64 // 秒
+	data       []byte
+}
+
+// extractSubtitle 取出内封字幕轨，返回 UTF-8 文本和格式（ass/srt），结果缓存在磁盘上
+func extractSubtitle(ctx context.Context, p string, track int) (string, string, error) {
+	e, err := mediaInfos.Probe(ctx, p)
+	if err != nil {
+		return "", "", err
+	}
+	if e.Info == nil {
+		return "", "", errors.New(e.Error)
+	}
+	var t *MediaTrack
+	for i := range e.Info.Tracks {
+		if e.Info.Tracks[i].Number == track {
+			t = &e.Info.Tracks[i]
+		}
+	}
+	if t == nil || t.Type != "subtitle" {
+		return "", "", fmt.Errorf("没有字幕轨 %d", track)
+	}
+	format := embeddedSubtitleFormat(t.CodecID)
+	if format == "" {
+		return "", "", fmt.Errorf("%s 是图形字幕，无法转换成文本", t.Codec)
+	}
+
+	cacheFile := filepath.Join(embedSubDir, fmt.Sprintf("%x-%d-%d-%d.%s",
+		sha1.Sum([]byte(p)), track, e.Size, e.ModTime.Unix(), format))
+	if data, err := os.ReadFile(cacheFile); err == nil {
+		// 修改时间当作最近使用时间，清理时按它淘汰
+		now := time.Now()
+		os.Chtimes(cacheFile, now, now)
+		return string(data), format, nil
+	}
+
+	info := FileInfo{Size: e.Size, ModTime: e.ModTime}
+	events, err := readSubtitleEvents(ctx, p, info, e.Layout, t)
+	if err != nil {
+		return "", "", err
+	}
+	var text string
+	if format == "ass" {
+		text = buildASS(t, events)
+	} else {
+		text = buildSRT(events)
+	}
+
+	if err := os.MkdirAll(embedSubDir, 0755); err == nil {
+		tmp := cacheFile + ".tmp"
+		if err := os.WriteFile(tmp, []byte(text), 0644); err == nil {
+			os.Rename(tmp, cacheFile)
+		}
+		pruneEmbedSubCache()
+	}
+	return text, format, nil
+}
+
+var embedSubPruneMu sync.Mutex
+
+// pruneEmbedSubCache 缓存超过上限时按修改时间从旧到新删除，直到回到上限以内
+func pruneEmbedSubCache() {
+	embedSubPruneMu.Lock()
+	defer embedSubPruneMu.Unlock()
+	entries, err := os.ReadDir(embedSubDir)
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	var used int64
+	for _, d := range entries {
+		if d.IsDir() {
+			continue
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, info)
+			used += info.Size()
+		}
+	}
+	if used <= embedSubCacheMax {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, f := range files {
+		if used <= embedSubCacheMax {
+			break
+		}
+		if os.Remove(filepath.Join(embedSubDir, f.Name())) == nil {
+			used -= f.Size()
+		}
+	}
+}
+
+// readSubtitleEvents 读出字幕轨的所有块，按开始时间排序，补上缺失的结束时间
+func readSubtitleEvents(ctx context.Context, p string, info FileInfo, layout mkvLayout, t *MediaTrack) ([]subEvent, error) {
+	scale := float64(layout.TimestampScale) / 1e9
+	var (
+		mu     sync.Mutex
+		events []subEvent
+		total  int
+	)
+	collect := func(b mkvBlock) error {
+		if b.Track != t.Number {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, f := range b.Frames {
+			data, err := decodeFrame(t, f)
+			if err != nil {
+				return err
+			}
+			total += len(data)
+			if total > maxSubtitleSize {
+				return fmt.Errorf("字幕过大")
+			}
+			ev := subEvent{start: float64(b.Time) * scale, end: -1, data: data}
+			if b.Duration >= 0 {
+				ev.end = float64(b.Time+b.Duration) * scale
+			}
+			events = append(events, ev)
+		}
+		return nil
+	}
+
+	cues, err := readCues(&rangeReader{ctx: ctx, path: p, info: info, window: embedSubWindow, direct: true}, layout)
+	if err != nil {
+		return nil, err
+	}
+	var own []cuePoint
+	for _, c := range cues {
+		if c.Track == t.Number {
+			own = append(own, c)
+		}
+	}
+	if len(own) > 0 {
+		err = readIndexedBlocks(ctx, p, info, own, t.Number, collect)
+	} else {
+		err = scanClusters(ctx, p, info, layout, t.Number, collect)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].start < events[j].start })
+	for i := range events {
+		if events[i].end >= 0 {
+			continue
+		}
+		events[i].end = events[i].start + embedSubDuration
+		if i+1 < len(events) && events[i+1].start > events[i].start && events[i+1].start < events[i].end {
+			events[i].end = events[i+1].start
+		}
+	}
+	return events, nil
+}
+
+// readIndexedBlocks 按 Cues 只读字幕块，每个 Cluster 先读时间戳，
+// 没有 CueRelativePosition 的整个 Cluster 读一遍
+func readIndexedBlocks(ctx context.Context, p string, info FileInfo, cues []cuePoint, track int, fn func(mkvBlock) error) error {
+	byCluster := make(map[int64][]int64)
+	var clusters []int64
+	for _, c := range cues {
+		if _, ok := byCluster[c.Cluster]; !ok {
+			clusters = append(clusters, c.Cluster)
+		}
+		byCluster[c.Cluster] = append(byCluster[c.Cluster], c.Relative)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan int64)
+	errs := make(chan error, embedSubWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < embedSubWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e := &ebmlReader{r: &rangeReader{ctx: ctx, path: p, info: info, window: embedSubWindow, direct: true}}
+			for cluster := range jobs {
+				if err := readIndexedCluster(e, cluster, byCluster[cluster], track, fn); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	for _, c := range clusters {
+		select {
+		case jobs <- c:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+func readIndexedCluster(e *ebmlReader, cluster int64, relatives []int64, track int, fn func(mkvBlock) error) error {
+	want := func(t int) bool { return t == track }
+	clusterTime, dataStart, err := clusterTimestamp(e, cluster)
+	if err != nil {
+		return err
+	}
+	for _, rel := range relatives {
+		if rel < 0 {
+			_, err := readClusterBlocks(e, cluster, want, fn)
+			return err
+		}
+	}
+	seen := make(map[int64]bool)
+	for _, rel := range relatives {
+		if seen[rel] {
+			continue
+		}
+		seen[rel] = true
+		b, err := readBlockAt(e, dataStart+rel, clusterTime)
+		if err != nil {
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanClusters 没有索引时从第一个 Cluster 顺序读到最后一个，只解析字幕块
+func scanClusters(ctx context.Context, p string, info FileInfo, layout mkvLayout, track int, fn func(mkvBlock) error) error {
+	rc, err := storage.Open(ctx, p, layout.ClusterOffset, -1)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	e := &ebmlReader{r: &forwardSeeker{r: bufio.NewReaderSize(rc, embedSubScanBuf), pos: layout.ClusterOffset}, pos: layout.ClusterOffset}
+	want := func(t int) bool { return t == track }
+	for pos := layout.ClusterOffset; pos < info.Size; {
+		next, err := readClusterBlocks(e, pos, want, fn)
+		if err == io.EOF || errors.Is(err, errNotCluster) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pos = next
+	}
+	return nil
+}
+
+// ---- 拼接 ----
+
+func assEventTime(t float64) string {
+	cs := int64(t*100 + 0.5)
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+}
+
+// buildASS 用 CodecPrivate 里的脚本头加上各个块拼成完整的 ASS，
+// 块内容为 ReadOrder,Layer,Style,Name,MarginL,MarginR,MarginV,Effect,Text
+func buildASS(t *MediaTrack, events []subEvent) string {
+	header := strings.TrimRight(decodeSubtitle(t.CodecPrivate, ""), "\r\n")
+	var b strings.Builder
+	b.WriteString(header)
+	b.WriteString("\n")
+	if !strings.Contains(strings.ToLower(header), "[events]") {
+		b.WriteString("\n[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n")
+	}
+
+	type line struct {
+		order int
+		text  string
+	}
+	lines := make([]line, 0, len(events))
+	for _, ev := range events {
+		fields := strings.SplitN(strings.TrimRight(string(ev.data), "\r\n"), ",", 9)
+		if len(fields) < 9 {
+			continue
+		}
+		order, _ := strconv.Atoi(fields[0])
+		lines = append(lines, line{order, fmt.Sprintf("Dialogue: %s,%s,%s,%s",
+			fields[1], assEventTime(ev.start), assEventTime(ev.end), strings.Join(fields[2:], ","))})
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].order < lines[j].order })
+	for _, l := range lines {
+		b.WriteString(l.text)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func buildSRT(events []subEvent) string {
+	stamp := func(t float64) string {
+		ms := int64(t*1000 + 0.5)
+		return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+	}
+	var b strings.Builder
+	n := 0
+	for _, ev := range events {
+		text := strings.TrimSpace(strings.ReplaceAll(string(ev.data), "\r\n", "\n"))
+		if text == "" {
+			continue
+		}
+		n++
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", n, stamp(ev.start), stamp(ev.end), text)
+	}
+	return b.String()
+}
+
+// embeddedSubtitleName 下载原始字幕时用的文件名
+func embeddedSubtitleName(p string, track int, format string) string {
+	base := path.Base(p)
+	return fmt.Sprintf("%s.track%d.%s", strings.TrimSuffix(base, path.Ext(base)), track, format)
+}
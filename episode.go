@@ -0,0 +1,382 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 从发布文件名解析出的剧集信息
+type EpisodeInfo struct {
+	Name       string         `json:"name"`
+	Path       string         `json:"path"`
+	Label      string         `json:"label"`                // 第3集 / SP1 / NCOP
+	Episode    float64        `json:"episode"`              // 集数，无法识别为 0
+	Season     int            `json:"season,omitempty"`     // 季数，未标注为 0
+	Special    string         `json:"special,omitempty"`    // SP/OVA/NCOP/NCED/PV 等
+	Version    int            `json:"version,omitempty"`    // v2 等修正版本
+	Group      string         `json:"group,omitempty"`      // 字幕组/压制组
+	Resolution string         `json:"resolution,omitempty"` // 1080p
+	Codec      string         `json:"codec,omitempty"`      // HEVC/AVC/AV1
+	BitDepth   int            `json:"bit_depth,omitempty"`  // 8/10
+	Audio      string         `json:"audio,omitempty"`      // FLAC/AAC/OPUS
+	Source     string         `json:"source,omitempty"`     // BDRip/WEB/DVD/TV
+	CRC32      string         `json:"crc32,omitempty"`
+	Languages  []string       `json:"languages,omitempty"` // chs/cht/jpn/eng
+	Container  string         `json:"container,omitempty"` // mkv/mp4
+	Watched    bool           `json:"watched,omitempty"`   // 当前用户已看过
+	Position   float64        `json:"position,omitempty"`  // 当前用户上次播放到的秒数
+	Danmaku    string         `json:"danmaku,omitempty"`   // 弹幕 id，同一集的不同版本共用
+	Subtitles  []SubtitleInfo `json:"subtitles,omitempty"` // 外挂字幕，默认字幕排在最前
+	Media      *episodeMedia  `json:"media,omitempty"`     // 解析 MKV 得到的媒体信息，后台探测完成后才有
+}
+
+var (
+	reBracket    = regexp.MustCompile(`\[([^\]]*)\]|【([^】]*)】|\(([^)]*)\)|（([^）]*)）`)
+	reCRC32      = regexp.MustCompile(`^[0-9A-Fa-f]{8}$`)
+	reSxxExx     = regexp.MustCompile(`(?i)\bS(\d{1,2})\s?E(\d{1,4}(?:\.\d)?)(?:v(\d))?`)
+	reSeasonWord = regexp.MustCompile(`(?i)(?:\bS(\d{1,2})\b|\bSeason\s*(\d{1,2})\b|\b(\d)(?:st|nd|rd|th)\s+Season\b|第([一二三四五六七八九十\d]+)[季期])`)
+	reEpCN       = regexp.MustCompile(`第\s*(\d{1,4}(?:\.\d)?)\s*[话話集回]`)
+	reEpDash     = regexp.MustCompile(`\s-\s(\d{1,4}(?:\.\d)?)(?:v(\d))?(?:\s|$)`)
+	reEpPrefix   = regexp.MustCompile(`(?i)^(?:EP?|#|Part\s?)?(\d{1,4}(?:\.\d)?)(?:v(\d))?(?:\s*(?:END|Fin))?$`)
+	reEpRange    = regexp.MustCompile(`^(\d{1,4})\s*[-~]\s*(\d{1,4})`)
+	reSpecial    = regexp.MustCompile(`(?i)^(SP|OVA|OAD|NCOP|NCED|OP|ED|PV|CM|Menu|Preview|Yokoku|\w*Spot|Trailer|Teaser|Fonts?)\s*(\d{1,3})?(?:v\d)?$`)
+	reSpecialAny = regexp.MustCompile(`(?i)\b(NCOP|NCED|OVA|OAD|SP|PV|CM|Menu)(\d{1,3})?\b`)
+	// \b 把下划线当作单词字符，[Ma10p_1080p] 这类标签要用显式的边界
+	reResolution = regexp.MustCompile(`(?i)(?:^|[^0-9A-Za-z])(\d{3,4})[pi](?:$|[^0-9A-Za-z])|(?:^|[^0-9A-Za-z])\d{3,4}x(\d{3,4})`)
+	reBitDepth   = regexp.MustCompile(`(?i)(\d{1,2})[-_ ]?(?:bit|bpp)|(?:^|[^0-9A-Za-z])(?:Hi|Ma)(10)p(?:$|[^0-9A-Za-z])`)
+	reLooseNum   = regexp.MustCompile(`(?:^|[\s_\-])(\d{1,4}(?:\.\d)?)(?:v(\d))?(?:$|[\s_\-])`)
+)
+
+// 中文季数
+var cnNumbers = map[string]int{"一": 1, "二": 2, "三": 3, "四": 4, "五": 5, "六": 6, "七": 7, "八": 8, "九": 9, "十": 10}
+
+// 特殊集名称归一化
+var specialNames = map[string]string{
+	"sp": "SP", "ova": "OVA", "oad": "OAD", "ncop": "NCOP", "nced": "NCED", "op": "NCOP", "ed": "NCED",
+	"pv": "PV", "cm": "CM", "menu": "Menu", "preview": "PV", "yokoku": "PV", "tvspot": "CM",
+	"trailer": "PV", "teaser": "PV", "font": "Fonts", "fonts": "Fonts",
+	"特别篇": "SP", "特別篇": "SP", "总集篇": "SP", "總集篇": "SP", "番外": "SP", "番外篇": "SP",
+}
+
+// parseEpisodeName 从发布文件名中解析集数、季数、字幕组、分辨率、编码等信息
+func parseEpisodeName(name string) EpisodeInfo {
+	info := EpisodeInfo{Name: name}
+	ext := path.Ext(name)
+	info.Container = strings.ToLower(strings.TrimPrefix(ext, "."))
+	base := strings.TrimSuffix(name, ext)
+
+	// 下划线常被用作空格（[CBM]_Tamako_Market_-_06_...）
+	if !strings.Contains(base, " ") {
+		base = strings.ReplaceAll(base, "_", " ")
+	}
+
+	// 拆出括号内的标签，剩下的部分视为标题
+	var tags []string
+	title := reBracket.ReplaceAllStringFunc(base, func(m string) string {
+		tags = append(tags, strings.TrimSpace(bracketContent(m)))
+		return " "
+	})
+	title = strings.TrimSpace(title)
+
+	// 开头的括号一般是字幕组
+	if strings.HasPrefix(base, "[") || strings.HasPrefix(base, "【") {
+		if len(tags) > 0 && !isMetaTag(tags[0]) && !reEpPrefix.MatchString(tags[0]) {
+			info.Group = tags[0]
+			tags = tags[1:]
+		}
+	}
+
+	// 技术参数在标签和标题里都可能出现
+	meta := strings.Join(tags, " ") + " " + title
+	parseMeta(&info, meta)
+
+	// 季数 + 集数：S02E08
+	if m := reSxxExx.FindStringSubmatch(base); m != nil {
+		info.Season, _ = strconv.Atoi(m[1])
+		info.Episode, _ = strconv.ParseFloat(m[2], 64)
+		info.Version, _ = strconv.Atoi(m[3])
+	} else {
+		info.Season = parseSeason(title + " " + strings.Join(tags, " "))
+		parseEpisodeNumber(&info, title, tags)
+	}
+	// NCOP(EP01).mkv：集数在括号里，特典标记在标题里
+	if info.Special == "" {
+		if m := reSpecialAny.FindStringSubmatch(title); m != nil {
+			info.Special = specialNames[strings.ToLower(m[1])]
+		}
+	}
+
+	info.Label = episodeLabel(info)
+	return info
+}
+
+// 集数：依次尝试标签 [05]、第05话、" - 05"、标题中的独立数字
+func parseEpisodeNumber(info *EpisodeInfo, title string, tags []string) {
+	for i, t := range tags {
+		if s, ok := specialNames[strings.ToLower(t)]; ok {
+			info.Special = s
+			// [OVA][03] 这种写法，后一个标签才是序号
+			if i+1 < len(tags) {
+				if m := reEpPrefix.FindStringSubmatch(tags[i+1]); m != nil {
+					info.Episode, _ = strconv.ParseFloat(m[1], 64)
+				}
+			}
+			return
+		}
+		if m := reSpecial.FindStringSubmatch(t); m != nil {
+			info.Special = specialNames[strings.ToLower(m[1])]
+			if strings.HasSuffix(strings.ToLower(m[1]), "spot") {
+				info.Special = "CM"
+			}
+			info.Episode, _ = strconv.ParseFloat(m[2], 64)
+			return
+		}
+		if m := reEpPrefix.FindStringSubmatch(t); m != nil && !isMetaTag(t) {
+			info.Episode, _ = strconv.ParseFloat(m[1], 64)
+			info.Version, _ = strconv.Atoi(m[2])
+			return
+		}
+		if m := reEpRange.FindStringSubmatch(t); m != nil {
+			info.Episode, _ = strconv.ParseFloat(m[1], 64)
+			return
+		}
+	}
+
+	if m := reEpCN.FindStringSubmatch(title); m != nil {
+		info.Episode, _ = strconv.ParseFloat(m[1], 64)
+		return
+	}
+	if m := reEpDash.FindStringSubmatch(title + " "); m != nil {
+		info.Episode, _ = strconv.ParseFloat(m[1], 64)
+		info.Version, _ = strconv.Atoi(m[2])
+		return
+	}
+	// NCOP(EP01).mkv / NCED2.mkv 这类没有字幕组的特典
+	if m := reSpecialAny.FindStringSubmatch(title); m != nil {
+		info.Special = specialNames[strings.ToLower(m[1])]
+		info.Episode, _ = strconv.ParseFloat(m[2], 64)
+		return
+	}
+	// 兜底：标题最后一个独立数字（跳过季数标记）
+	cleaned := reSeasonWord.ReplaceAllString(title, " ")
+	if ms := reLooseNum.FindAllStringSubmatch(cleaned, -1); ms != nil {
+		m := ms[len(ms)-1]
+		info.Episode, _ = strconv.ParseFloat(m[1], 64)
+		info.Version, _ = strconv.Atoi(m[2])
+	}
+}
+
+func parseSeason(s string) int {
+	m := reSeasonWord.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	for _, g := range m[1:4] {
+		if g != "" {
+			n, _ := strconv.Atoi(g)
+			return n
+		}
+	}
+	if n, err := strconv.Atoi(m[4]); err == nil {
+		return n
+	}
+	return cnNumbers[m[4]]
+}
+
+// 分辨率、编码、来源、字幕语言、CRC32
+func parseMeta(info *EpisodeInfo, meta string) {
+	upper := strings.ToUpper(meta)
+	tokens := map[string]bool{}
+	for _, t := range strings.FieldsFunc(upper, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		tokens[t] = true
+	}
+	hasToken := func(ts ...string) bool {
+		for _, t := range ts {
+			if tokens[t] {
+				return true
+			}
+		}
+		return false
+	}
+
+	if m := reResolution.FindStringSubmatch(meta); m != nil {
+		if m[1] != "" {
+			info.Resolution = m[1] + "p"
+		} else {
+			info.Resolution = m[2] + "p"
+		}
+	} else if strings.Contains(upper, "4K") || strings.Contains(upper, "2160") {
+		info.Resolution = "2160p"
+	}
+
+	switch {
+	case containsAny(upper, "HEVC", "X265", "H265", "H.265"):
+		info.Codec = "HEVC"
+	case containsAny(upper, "AV1"):
+		info.Codec = "AV1"
+	case containsAny(upper, "AVC", "X264", "H264", "H.264"):
+		info.Codec = "AVC"
+	case containsAny(upper, "VP9"):
+		info.Codec = "VP9"
+	}
+
+	if m := reBitDepth.FindStringSubmatch(meta); m != nil {
+		if m[1] != "" {
+			if n, _ := strconv.Atoi(m[1]); n == 8 || n == 10 || n == 12 {
+				info.BitDepth = n
+			}
+		} else {
+			info.BitDepth = 10
+		}
+	}
+
+	switch {
+	case containsAny(upper, "FLAC"):
+		info.Audio = "FLAC"
+	case containsAny(upper, "OPUS"):
+		info.Audio = "OPUS"
+	case containsAny(upper, "AAC"):
+		info.Audio = "AAC"
+	case containsAny(upper, "AC3", "EAC3", "DTS"):
+		info.Audio = "AC3"
+	}
+
+	switch {
+	case containsAny(upper, "BDRIP", "BD-RIP", "BLURAY", "BLU-RAY", "BDMV") || hasToken("BD"):
+		info.Source = "BDRip"
+	case containsAny(upper, "WEB-DL", "WEBRIP", "WEB-RIP", "WEB"):
+		info.Source = "WEB"
+	case containsAny(upper, "DVDRIP", "DVD"):
+		info.Source = "DVD"
+	case containsAny(upper, "HDTV", "TVRIP"):
+		info.Source = "TV"
+	}
+
+	langs := map[string]bool{}
+	if hasToken("CHS", "GB", "SC", "JPSC", "CHS&CHT") || containsAny(meta, "简", "簡") {
+		langs["chs"] = true
+	}
+	if hasToken("CHT", "BIG5", "TC", "JPTC") || containsAny(meta, "繁") {
+		langs["cht"] = true
+	}
+	if hasToken("JPSC", "JPTC", "JAP", "JPN") || containsAny(meta, "简日", "繁日", "日文", "日语") {
+		langs["jpn"] = true
+	}
+	if hasToken("ENG", "EN") || containsAny(meta, "英文", "英字") {
+		langs["eng"] = true
+	}
+	for _, l := range []string{"chs", "cht", "jpn", "eng"} {
+		if langs[l] {
+			info.Languages = append(info.Languages, l)
+		}
+	}
+
+	for _, f := range strings.Fields(meta) {
+		if reCRC32.MatchString(f) {
+			info.CRC32 = strings.ToUpper(f)
+		}
+	}
+}
+
+// 是否为技术参数标签（[1080P]、[BDRip]、[HEVC-10bit] 等）
+func isMetaTag(tag string) bool {
+	var probe EpisodeInfo
+	parseMeta(&probe, tag)
+	return probe.Resolution != "" || probe.Codec != "" || probe.Source != "" || probe.Audio != "" ||
+		probe.CRC32 != "" || len(probe.Languages) > 0 || probe.BitDepth != 0
+}
+
+// 括号内的文本
+func bracketContent(m string) string {
+	for _, g := range reBracket.FindStringSubmatch(m)[1:] {
+		if g != "" {
+			return g
+		}
+	}
+	return ""
+}
+
+func containsAny(s string, subs ...string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// 供前端展示的集名
+func episodeLabel(info EpisodeInfo) string {
+	num := strconv.FormatFloat(info.Episode, 'f', -1, 64)
+	if info.Special != "" {
+		if info.Episode > 0 {
+			return info.Special + num
+		}
+		return info.Special
+	}
+	if info.Episode <= 0 {
+		return ""
+	}
+	if info.Season > 1 {
+		return "第" + strconv.Itoa(info.Season) + "季 第" + num + "集"
+	}
+	return "第" + num + "集"
+}
+
+// sortEpisodes 按季数、正片在前、集数、文件名排序
+func sortEpisodes(eps []EpisodeInfo) {
+	sort.SliceStable(eps, func(i, j int) bool {
+		a, b := eps[i], eps[j]
+		if a.Season != b.Season {
+			return a.Season < b.Season
+		}
+		if (a.Special == "") != (b.Special == "") {
+			return a.Special == ""
+		}
+		if a.Special != b.Special {
+			return a.Special < b.Special
+		}
+		if a.Episode != b.Episode {
+			return a.Episode < b.Episode
+		}
+		if a.Version != b.Version {
+			return a.Version > b.Version
+		}
+		return naturalLess(a.Name, b.Name)
+	})
+}
+
+// naturalLess 自然排序，数字按数值比较（"2" < "10"）
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if da != "" && db != "" {
+			na, _ := strconv.Atoi(da)
+			nb, _ := strconv.Atoi(db)
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 番剧列表的筛选、排序和分面统计
+
+var seasonNames = []string{"winter", "spring", "summer", "autumn"}
+
+// animeSeason 按首播日期划分季度：1/4/7/10 月开播分别为冬/春/夏/秋季番
+func animeSeason(a AnimeInfo) (year int, season string) {
+	t, err := time.Parse("2006-01-02", a.Date)
+	if err != nil {
+		return a.Year, ""
+	}
+	return t.Year(), seasonNames[(int(t.Month())-1)/3]
+}
+
+type animeFilter struct {
+	Query       string
+	Years       map[int]bool
+	Season      string
+	Tags        []string // 需全部包含
+	MinScore    float64
+	MaxScore    float64
+	HasResource *bool
+	IDs         map[int]bool // 观看状态/片单筛选出的番剧，nil 表示不限
+}
+
+// parseAnimeFilter 解析查询参数，year 和 tag 可重复或用逗号分隔
+func parseAnimeFilter(q url.Values) animeFilter {
+	f := animeFilter{Query: strings.TrimSpace(q.Get("q")), Season: strings.ToLower(q.Get("season"))}
+	for _, v := range splitParams(q["year"]) {
+		if y, _ := strconv.Atoi(v); y > 0 {
+			if f.Years == nil {
+				f.Years = make(map[int]bool)
+			}
+			f.Years[y] = true
+		}
+	}
+	f.Tags = splitParams(q["tag"])
+	f.MinScore, _ = strconv.ParseFloat(q.Get("min_score"), 64)
+	f.MaxScore, _ = strconv.ParseFloat(q.Get("max_score"), 64)
+	if v := q.Get("has_resource"); v != "" {
+		b := v == "1" || v == "true"
+		f.HasResource = &b
+	}
+	return f
+}
+
+func splitParams(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// match 判断是否满足筛选条件，skip 指定忽略的条件（统计该分面时不受自身选择影响）
+func (f animeFilter) match(a AnimeInfo, skip string) bool {
+	if f.IDs != nil && !f.IDs[a.ID] {
+		return false
+	}
+	year, season := animeSeason(a)
+	if skip != "year" && f.Years != nil && !f.Years[a.Year] && !f.Years[year] {
+		return false
+	}
+	if skip != "season" && f.Season != "" && season != f.Season {
+		return false
+	}
+	if skip != "tag" {
+		for _, t := range f.Tags {
+			if !containsString(a.Tags, t) {
+				return false
+			}
+		}
+	}
+	if f.MinScore > 0 && a.Score < f.MinScore {
+		return false
+	}
+	if f.MaxScore > 0 && a.Score > f.MaxScore {
+		return false
+	}
+	if skip != "has_resource" && f.HasResource != nil && a.HasResource != *f.HasResource {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type facetCount struct {
+	Value interface{} `json:"value"`
+	Count int         `json:"count"`
+}
+
+// 标签分面最多返回的数量
+const maxTagFacets = 50
+
+// animeFacets 统计标签、年份、季度和有无资源的数量
+func animeFacets(list []AnimeInfo, f animeFilter) map[string]interface{} {
+	tags := make(map[string]int)
+	years := make(map[int]int)
+	seasons := make(map[string]int)
+	available := map[bool]int{}
+	for _, a := range list {
+		year, season := animeSeason(a)
+		if f.match(a, "tag") {
+			for _, t := range a.Tags {
+				tags[t]++
+			}
+		}
+		if f.match(a, "year") {
+			years[year]++
+		}
+		if f.match(a, "season") && season != "" {
+			seasons[season]++
+		}
+		if f.match(a, "has_resource") {
+			available[a.HasResource]++
+		}
+	}
+
+	tagFacets := make([]facetCount, 0, len(tags))
+	for t, n := range tags {
+		tagFacets = append(tagFacets, facetCount{t, n})
+	}
+	sort.Slice(tagFacets, func(i, j int) bool {
+		if tagFacets[i].Count != tagFacets[j].Count {
+			return tagFacets[i].Count > tagFacets[j].Count
+		}
+		return tagFacets[i].Value.(string) < tagFacets[j].Value.(string)
+	})
+	if len(tagFacets) > maxTagFacets {
+		tagFacets = tagFacets[:maxTagFacets]
+	}
+
+	yearFacets := make([]facetCount, 0, len(years))
+	for y, n := range years {
+		yearFacets = append(yearFacets, facetCount{y, n})
+	}
+	sort.Slice(yearFacets, func(i, j int) bool { return yearFacets[i].Value.(int) > yearFacets[j].Value.(int) })
+
+	seasonFacets := make([]facetCount, 0, len(seasonNames))
+	for _, s := range seasonNames {
+		seasonFacets = append(seasonFacets, facetCount{s, seasons[s]})
+	}
+
+	return map[string]interface{}{
+		"tags":         tagFacets,
+		"years":        yearFacets,
+		"seasons":      seasonFacets,
+		"has_resource": map[string]int{"true": available[true], "false": available[false]},
+	}
+}
+
+// sortAnime 按 score/date/title 排序，order 为 asc 或 desc；
+// 未指定 order 时评分和日期降序、标题升序
+func sortAnime(list []AnimeInfo, by, order string) {
+	var less func(a, b AnimeInfo) bool
+	desc := order == "desc"
+	switch by {
+	case "score":
+		less = func(a, b AnimeInfo) bool { return a.Score < b.Score }
+		desc = order != "asc"
+	case "date":
+		less = func(a, b AnimeInfo) bool { return a.Date < b.Date }
+		desc = order != "asc"
+	case "title":
+		keys := make(map[int]string, len(list))
+		for _, a := range list {
+			keys[a.ID] = titleSortKey(a)
+		}
+		less = func(a, b AnimeInfo) bool { return keys[a.ID] < keys[b.ID] }
+	default:
+		return
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if desc {
+			return less(list[j], list[i])
+		}
+		return less(list[i], list[j])
+	})
+}
+
+// titleSortKey 中文标题按拼音排序
+func titleSortKey(a AnimeInfo) string {
+	title := a.NameCN
+	if title == "" {
+		title = a.Name
+	}
+	norm := normalizeText(title)
+	if full, _ := pinyinOf(norm); full != "" {
+		return full
+	}
+	return strings.ReplaceAll(norm, " ", "")
+}
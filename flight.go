@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup 合并同一个 key 的并发调用，只有第一个调用真正执行，其余等待结果
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return c.val, c.err
+}
+
+// DoContext 与 Do 相同，但 ctx 取消时不再等待直接返回；fn 继续执行，结果留给其他调用方，
+// 所以 fn 里不能直接用调用方的 ctx
+func (g *flightGroup) DoContext(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	type result struct {
+		val interface{}
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		v, err := g.Do(key, fn)
+		ch <- result{v, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.val, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// 字体附件：字幕组把 ASS 用到的字体作为 MKV 附件封进去，前端用 JASSUB 等渲染时需要。
+// 附件按内容 SHA-1 存到 data/fonts/，同一季各集相同的字体只存一份、地址相同，
+// 浏览器只下载一次。data/fonts.json 记录每个文件有哪些字体，文件不变就不再读取
+
+const (
+	fontIndexFile = "data/fonts.json"
+	fontDir       = "data/fonts"
+)
+
+const (
+	maxFontSize    = 64 << 20
+	fontTimeout    = 5 * time.Minute
+	fontSeasonJobs = 2 // 整季清单同时处理的集数
+)
+
+// 常见的字体附件 MIME 类型，扩展名对得上也算
+var (
+	fontMimeTypes = map[string]bool{
+		"application/x-truetype-font": true, "application/x-font-ttf": true, "application/x-font-otf": true,
+		"application/vnd.ms-opentype": true, "application/font-sfnt": true, "application/x-font": true,
+		"font/ttf": true, "font/otf": true, "font/sfnt": true, "font/collection": true,
+	}
+	fontExts = map[string]bool{".ttf": true, ".otf": true, ".ttc": true, ".otc": true}
+)
+
+// fontFile 一个字体附件
+type fontFile struct {
+	UID   uint64   `json:"uid,string"`
+	Name  string   `json:"name"` // 附件文件名
+	Hash  string   `json:"hash"`
+	Ext   string   `json:"ext"`
+	Size  int64    `json:"size"`
+	Names []string `json:"names"` // 字体里的家族名、全名和 PostScript 名
+}
+
+type fontIndexEntry struct {
+	Size    int64      `json:"size"`
+	ModTime time.Time  `json:"mod_time"`
+	Fonts   []fontFile `json:"fonts"`
+}
+
+type fontStore struct {
+	mu      sync.Mutex
+	path    string
+	data    map[string]*fontIndexEntry // 视频存储路径 -> 字体列表
+	pending bool
+	flight  flightGroup
+}
+
+var fonts *fontStore
+
+func initFonts() {
+	s := &fontStore{path: fontIndexFile, data: make(map[string]*fontIndexEntry)}
+	if data, err := os.ReadFile(s.path); err == nil {
+		if err := json.Unmarshal(data, &s.data); err != nil {
+			log.Fatalf("字体索引格式错误: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("无法读取字体索引: %v", err)
+	}
+	fonts = s
+}
+
+func isFontAttachment(a Attachment) bool {
+	return fontMimeTypes[strings.ToLower(a.MimeType)] || fontExts[strings.ToLower(path.Ext(a.Name))]
+}
+
+func fontURL(f fontFile) string {
+	return "/api/fonts/" + f.Hash + f.Ext
+}
+
+// scheduleSave 延迟写盘，调用方持有 s.mu
+func (s *fontStore) scheduleSave() {
+	if s.pending {
+		return
+	}
+	s.pending = true
+	time.AfterFunc(progressSaveDelay, func() {
+		s.mu.Lock()
+		s.pending = false
+		data, err := json.Marshal(s.data)
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+		tmp := s.path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			log.Printf("保存字体索引失败: %v", err)
+			return
+		}
+		os.Rename(tmp, s.path)
+	})
+}
+
+// Episode 返回一集的字体附件，没处理过的先读出来存到 data/fonts/
+func (s *fontStore) Episode(ctx context.Context, p string) ([]fontFile, error) {
+	if !isMatroska(p) {
+		return nil, nil
+	}
+	e, err := mediaInfos.Probe(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if e.Info == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	idx := s.data[p]
+	s.mu.Unlock()
+	if idx != nil && idx.Size == e.Size && idx.ModTime.Equal(e.ModTime) {
+		return idx.Fonts, nil
+	}
+
+	v, err := s.flight.Do(p, func() (interface{}, error) {
+		// 结果在并发请求间共享，不跟随单个请求取消
+		ctx, cancel := context.WithTimeout(context.Background(), fontTimeout)
+		defer cancel()
+		idx := &fontIndexEntry{Size: e.Size, ModTime: e.ModTime, Fonts: []fontFile{}}
+		for _, a := range e.Info.Attachments {
+			if !isFontAttachment(a) {
+				continue
+			}
+			if a.Size > maxFontSize {
+				log.Printf("字体附件过大，跳过 %s: %s", p, a.Name)
+				continue
+			}
+			f, err := saveFont(ctx, p, a)
+			if err != nil {
+				return nil, err
+			}
+			idx.Fonts = append(idx.Fonts, f)
+		}
+		s.mu.Lock()
+		s.data[p] = idx
+		s.scheduleSave()
+		s.mu.Unlock()
+		return idx.Fonts, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]fontFile), nil
+}
+
+// saveFont 读出一个附件，按内容哈希存盘并解析字体名
+func saveFont(ctx context.Context, p string, a Attachment) (fontFile, error) {
+	rc, err := storage.Open(ctx, p, a.Offset, a.Size)
+	if err != nil {
+		return fontFile{}, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, a.Size))
+	if err != nil {
+		return fontFile{}, err
+	}
+	if int64(len(data)) != a.Size {
+		return fontFile{}, fmt.Errorf("字体附件 %s 不完整", a.Name)
+	}
+	sum := sha1.Sum(data)
+	f := fontFile{UID: a.UID, Name: a.Name, Hash: hex.EncodeToString(sum[:]), Ext: fontExt(data), Size: a.Size, Names: fontNames(data)}
+
+	file := filepath.Join(fontDir, f.Hash+f.Ext)
+	if _, err := os.Stat(file); err == nil {
+		return f, nil
+	}
+	if err := os.MkdirAll(fontDir, 0755); err != nil {
+		return fontFile{}, err
+	}
+	// 不同文件里的同一个字体可能同时写入，临时文件各用各的
+	tmp, err := os.CreateTemp(fontDir, f.Hash+"-*.tmp")
+	if err != nil {
+		return fontFile{}, err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fontFile{}, err
+	}
+	return f, nil
+}
+
+// ---- 字体文件解析 ----
+
+// fontExt 按文件头判断字体格式，附件的扩展名和 MIME 类型经常不准
+func fontExt(data []byte) string {
+	switch {
+	case len(data) >= 4 && string(data[:4]) == "OTTO":
+		return ".otf"
+	case len(data) >= 4 && string(data[:4]) == "ttcf":
+		return ".ttc"
+	}
+	return ".ttf"
+}
+
+// 名称表里用到的名字：1 家族名、4 全名、6 PostScript 名、16 排版家族名
+var fontNameIDs = map[uint16]bool{1: true, 4: true, 6: true, 16: true}
+
+// fontNames 读取 sfnt 的 name 表，字体集合（TTC）读出所有字体的名字，结果为小写
+func fontNames(data []byte) []string {
+	offsets := []uint32{0}
+	if len(data) >= 12 && string(data[:4]) == "ttcf" {
+		n := binary.BigEndian.Uint32(data[8:])
+		offsets = offsets[:0]
+		for i := uint32(0); i < n && int(12+4*i+4) <= len(data); i++ {
+			offsets = append(offsets, binary.BigEndian.Uint32(data[12+4*i:]))
+		}
+	}
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, off := range offsets {
+		for _, name := range sfntNames(data, int(off)) {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func sfntNames(data []byte, off int) []string {
+	if off < 0 || off+12 > len(data) {
+		return nil
+	}
+	numTables := int(binary.BigEndian.Uint16(data[off+4:]))
+	var table []byte
+	for i := 0; i < numTables; i++ {
+		rec := off + 12 + 16*i
+		if rec+16 > len(data) {
+			return nil
+		}
+		if string(data[rec:rec+4]) != "name" {
+			continue
+		}
+		start := int(binary.BigEndian.Uint32(data[rec+8:]))
+		length := int(binary.BigEndian.Uint32(data[rec+12:]))
+		if start < 0 || length < 0 || start+length > len(data) {
+			return nil
+		}
+		table = data[start : start+length]
+	}
+	if len(table) < 6 {
+		return nil
+	}
+	count := int(binary.BigEndian.Uint16(table[2:]))
+	strOff := int(binary.BigEndian.Uint16(table[4:]))
+	var names []string
+	for i := 0; i < count; i++ {
+		rec := 6 + 12*i
+		if rec+12 > len(table) {
+			break
+		}
+		platform := binary.BigEndian.Uint16(table[rec:])
+		enc := binary.BigEndian.Uint16(table[rec+2:])
+		nameID := binary.BigEndian.Uint16(table[rec+6:])
+		length := int(binary.BigEndian.Uint16(table[rec+8:]))
+		start := strOff + int(binary.BigEndian.Uint16(table[rec+10:]))
+		if !fontNameIDs[nameID] || start+length > len(table) {
+			continue
+		}
+		if name := decodeFontName(platform, enc, table[start:start+length]); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// decodeFontName 按平台和编码解码名字：Unicode 平台和 Windows Unicode 为 UTF-16BE，
+// 老的中文字体用 Windows PRC（GBK）或 Big5，每个字符占两个字节，单字节字符前补 0
+func decodeFontName(platform, enc uint16, b []byte) string {
+	var legacy encoding.Encoding
+	switch {
+	case platform == 0, platform == 3 && (enc == 0 || enc == 1 || enc == 10):
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(u))
+	case platform == 3 && enc == 3:
+		legacy = simplifiedchinese.GBK
+	case platform == 3 && enc == 4:
+		legacy = traditionalchinese.Big5
+	case platform == 1 && enc == 0:
+		for _, c := range b {
+			if c >= 0x80 {
+				return "" // 非 ASCII 的 Mac Roman 名字一般在 Windows 记录里也有
+			}
+		}
+		return string(b)
+	default:
+		return ""
+	}
+	stripped := make([]byte, 0, len(b))
+	for _, c := range b {
+		if c != 0 {
+			stripped = append(stripped, c)
+		}
+	}
+	s, err := legacy.NewDecoder().Bytes(stripped)
+	if err != nil {
+		return ""
+	}
+	return string(s)
+}
+
+// ---- 接口 ----
+
+type fontManifestEntry struct {
+	Hash  string   `json:"hash"`
+	URL   string   `json:"url"`
+	Size  int64    `json:"size"`
+	Names []string `json:"names"`
+	Files []string `json:"files"` // 各集里的附件文件名
+}
+
+// fontManifest 给前端 ASS 渲染器用的字体清单：fonts 按哈希去重，
+// available_fonts 为 JASSUB 的 availableFonts（小写字体名 -> 地址），episodes 为每集用到的哈希
+type fontManifest struct {
+	Fonts          []*fontManifestEntry `json:"fonts"`
+	AvailableFonts map[string]string    `json:"available_fonts"`
+	Episodes       map[string][]string  `json:"episodes"`
+	Errors         map[string]string    `json:"errors,omitempty"`
+}
+
+func buildFontManifest(episodes map[string][]fontFile) *fontManifest {
+	m := &fontManifest{Fonts: []*fontManifestEntry{}, AvailableFonts: make(map[string]string), Episodes: make(map[string][]string)}
+	byHash := make(map[string]*fontManifestEntry)
+	paths := make([]string, 0, len(episodes))
+	for p := range episodes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		hashes := []string{}
+		for _, f := range episodes[p] {
+			if !containsString(hashes, f.Hash) {
+				hashes = append(hashes, f.Hash)
+			}
+			e := byHash[f.Hash]
+			if e == nil {
+				e = &fontManifestEntry{Hash: f.Hash, URL: fontURL(f), Size: f.Size, Names: f.Names}
+				byHash[f.Hash] = e
+				m.Fonts = append(m.Fonts, e)
+				for _, name := range f.Names {
+					if _, ok := m.AvailableFonts[name]; !ok {
+						m.AvailableFonts[name] = e.URL
+					}
+				}
+			}
+			if !containsString(e.Files, f.Name) {
+				e.Files = append(e.Files, f.Name)
+			}
+		}
+		m.Episodes[p] = hashes
+	}
+	return m
+}
+
+// GET /api/fonts?path=<mkv> 一集的字体清单
+// GET /api/fonts/<hash>.ttf 字体文件
+func handleFonts(w http.ResponseWriter, r *http.Request) {
+	if name := strings.TrimPrefix(r.URL.Path, "/api/fonts/"); name != r.URL.Path && name != "" {
+		serveFont(w, r, name)
+		return
+	}
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		http.Error(w, "path required", 400)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), fontTimeout)
+	defer cancel()
+	list, err := fonts.Episode(ctx, p)
+	if err != nil {
+		upstreamError(w, p, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildFontManifest(map[string][]fontFile{p: list}))
+}
+
+// GET /api/anime/{id}/fonts 整季的字体清单，各集相同的字体只列一次
+func handleAnimeFonts(w http.ResponseWriter, r *http.Request, id int) {
+	_, episodes, ok := animeEpisodes(currentCatalog(), id)
+	if !ok {
+		http.Error(w, "anime not found", 404)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), fontTimeout)
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		result = make(map[string][]fontFile)
+		errs   = make(map[string]string)
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, fontSeasonJobs)
+	)
+	for _, ep := range episodes {
+		if !isMatroska(ep.Path) {
+			continue
+		}
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			list, err := fonts.Episode(ctx, p)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[p] = err.Error()
+				return
+			}
+			result[p] = list
+		}(ep.Path)
+	}
+	wg.Wait()
+
+	m := buildFontManifest(result)
+	if len(errs) > 0 {
+		m.Errors = errs
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+var fontFileName = regexp.MustCompile(`^[0-9a-f]{40}\.(ttf|otf|ttc)$`)
+
+var fontContentTypes = map[string]string{".ttf": "font/ttf", ".otf": "font/otf", ".ttc": "font/collection"}
+
+func serveFont(w http.ResponseWriter, r *http.Request, name string) {
+	if !fontFileName.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(filepath.Join(fontDir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// 文件名就是内容哈希，可以永久缓存
+	w.Header().Set("Content-Type", fontContentTypes[path.Ext(name)])
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, name, st.ModTime(), f)
+}
@@ -1,3 +1,9 @@
 module anime-site
 
 go 1.21
+
+require github.com/mozillazg/go-pinyin v0.21.0
+
+require golang.org/x/crypto v0.21.0
+
+require golang.org/x/text v0.14.0
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 调用 OpenList 等 API 的共享客户端
+var apiClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: newTransport(30 * time.Second),
+}
+
+func newTransport(responseTimeout time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: responseTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+	}
+}
+
+// 直链过期前预留的余量，避免把快过期的链接交给播放器
+const linkExpiryMargin = time.Minute
+
+// linkCache 按路径缓存 OpenList 的 /api/fs/get 结果（直链、大小、修改时间），
+// 同一路径的并发查询合并为一次请求
+type linkCache struct {
+	mu        sync.Mutex
+	items     map[string]cachedLink
+	lastSweep time.Time
+	flights   flightGroup
+}
+
+type cachedLink struct {
+	file    *openListFile
+	expires time.Time
+}
+
+var links = &linkCache{items: make(map[string]cachedLink)}
+
+func linkTTL() time.Duration {
+	if config.LinkTTL > 0 {
+		return time.Duration(config.LinkTTL) * time.Second
+	}
+	return 10 * time.Minute
+}
+
+// Get 命中缓存直接返回，否则调用 fetch；fetch 不受调用方取消影响
+func (c *linkCache) Get(ctx context.Context, key string, fetch func(context.Context) (*openListFile, error)) (*openListFile, bool, error) {
+	c.mu.Lock()
+	item, ok := c.items[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(item.expires) {
+		return item.file, true, nil
+	}
+
+	v, err := c.flights.Do(key, func() (interface{}, error) {
+		f, err := fetch(context.WithoutCancel(ctx))
+		if err != nil {
+			return nil, err
+		}
+		c.set(key, f)
+		return f, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return v.(*openListFile), false, nil
+}
+
+func (c *linkCache) set(key string, f *openListFile) {
+	now := time.Now()
+	expires := now.Add(linkTTL())
+	if t, ok := signedURLExpiry(f.RawURL); ok && t.Add(-linkExpiryMargin).Before(expires) {
+		expires = t.Add(-linkExpiryMargin)
+	}
+	if !expires.After(now) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items[key] = cachedLink{file: f, expires: expires}
+	if now.Sub(c.lastSweep) > time.Minute {
+		for k, item := range c.items {
+			if now.After(item.expires) {
+				delete(c.items, k)
+			}
+		}
+		c.lastSweep = now
+	}
+}
+
+func (c *linkCache) Invalidate(key string) {
+	c.mu.Lock()
+	delete(c.items, key)
+	c.mu.Unlock()
+}
+
+// signedURLExpiry 从签名 URL 的查询参数推算过期时间，
+// 支持 Expires/e（Unix 时间戳）、X-Amz-Date + X-Amz-Expires、se（Azure SAS）
+func signedURLExpiry(raw string) (time.Time, bool) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return time.Time{}, false
+	}
+	q := u.Query()
+	for _, k := range []string{"Expires", "expires", "e", "expire", "x-expires"} {
+		if v := q.Get(k); v != "" {
+			if ts, err := strconv.ParseInt(v, 10, 64); err == nil && ts > 1e9 {
+				return time.Unix(ts, 0), true
+			}
+		}
+	}
+	if d, s := q.Get("X-Amz-Date"), q.Get("X-Amz-Expires"); d != "" && s != "" {
+		start, err1 := time.Parse("20060102T150405Z", d)
+		secs, err2 := strconv.Atoi(s)
+		if err1 == nil && err2 == nil {
+			return start.Add(time.Duration(secs) * time.Second), true
+		}
+	}
+	if se := q.Get("se"); se != "" {
+		if t, err := time.Parse(time.RFC3339, se); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -17,50 +16,103 @@ type Config struct {
 	OpenListURL    string `json:"openlist_url"`
 	RcloneURL      string `json:"rclone_url"`
 	RclonePikpakURL string `json:"rclone_pikpak_url"`
+	AdminToken     string `json:"admin_token"`     // 管理接口令牌，为空则禁用
+	ReloadInterval int    `json:"reload_interval"` // 数据文件轮询间隔（秒），0 为不轮询
+	Storage        StorageConfig `json:"storage"`  // 存储后端与路由，为空时按上面三个地址生成
+	StreamProxy    bool   `json:"stream_proxy"`    // 播放地址统一走 /api/stream 代理
+	CacheDir       string `json:"cache_dir"`       // 分块缓存目录，为空则不缓存
+	CacheSizeMB    int    `json:"cache_size_mb"`   // 缓存容量，默认 10240
+	CacheChunkMB   int    `json:"cache_chunk_mb"`  // 分块大小，默认 4
+	LinkTTL        int    `json:"link_ttl"`        // 直链缓存秒数，默认 600，签名链接更早过期时以链接为准
+	WatchedRatio   float64 `json:"watched_ratio"`  // 播放进度超过该比例记为看过，默认 0.9
+	DanmakuBlockWords []string `json:"danmaku_block_words"` // 弹幕屏蔽词，包含任一词的弹幕拒绝发送
+	PublicURL      string `json:"public_url"`      // 站点对外地址，用于播放列表等外部链接，留空按请求 Host 推断
+	DLNA           DLNAConfig `json:"dlna"`         // 局域网 DLNA 媒体服务器，默认关闭
 }
 
 type AnimeInfo struct {
-	ID          int      `json:"id"`
-	Name        string   `json:"name"`
-	NameCN      string   `json:"name_cn"`
-	Year        int      `json:"year"`
-	Date        string   `json:"date"`
-	Summary     string   `json:"summary"`
-	Cover       string   `json:"cover"`
-	Score       float64  `json:"score"`
-	Tags        []string `json:"tags"`
-	HasResource bool     `json:"has_resource"`
+	ID            int      `json:"id"`
+	Name          string   `json:"name"`
+	NameCN        string   `json:"name_cn"`
+	Year          int      `json:"year"`
+	Date          string   `json:"date"`
+	Summary       string   `json:"summary"`
+	Cover         string   `json:"cover"`
+	Score         float64  `json:"score"`
+	Tags          []string `json:"tags"`
+	Aliases       []string `json:"aliases,omitempty"`
+	HasResource   bool     `json:"has_resource"`
+	Franchise     int      `json:"franchise,omitempty"`      // 所属系列，值为系列中第一部的 ID
+	FranchiseSize int      `json:"franchise_size,omitempty"` // 系列作品数
+	Status        string   `json:"status,omitempty"`         // 当前用户的观看状态
 }
 
 type AnimeMapping struct {
+	AnimeID    int      `json:"anime_id"`
 	AnimeName  string   `json:"anime_name"`
 	FolderName string   `json:"folder_name"`
 	FolderPath string   `json:"folder_path"`
 	Episodes   []string `json:"episodes"`
+	Subtitles  []string `json:"subtitles,omitempty"` // 同目录下的外挂字幕
 }
 
 var config Config
-var animeDB []AnimeInfo
-var animeMapping map[string]bool            // 番剧名 -> 是否有资源
-var animeFolderPath map[string]string       // 番剧名 -> 文件夹路径
-var animeEpisodes map[string][]string       // 番剧名 -> 视频文件列表
 
 func main() {
 	loadConfig()
-	loadAnimeDB()
-	loadAnimeMapping()
+	loadT2S()
+	initUsers()
+	initProgress()
+	initCollections()
+	initDanmaku()
+	initMediaInfo()
+	initFonts()
+	initStorage()
+	initChunkCache()
+	c, err := loadCatalog()
+	if err != nil {
+		log.Printf("警告: %v", err)
+	}
+	catalog.Store(c)
+	watchReload()
 
 	http.HandleFunc("/", serveIndex)
 	http.HandleFunc("/api/anime", handleAnimeList)
 	http.HandleFunc("/api/anime/search", handleAnimeSearch)
 	http.HandleFunc("/api/anime/episodes", handleAnimeEpisodes)
+	http.HandleFunc("/api/anime/", handleAnimeSubresource)
+	http.HandleFunc("/api/calendar", handleCalendar)
 	http.HandleFunc("/api/list", handleList)
 	http.HandleFunc("/api/get", handleGet)
+	http.HandleFunc("/api/stream", handleStream)
+	http.HandleFunc("/api/admin/reload", handleAdminReload)
+	http.HandleFunc("/api/admin/invites", handleAdminInvites)
+	http.HandleFunc("/api/admin/users", handleAdminUsers)
+	http.HandleFunc("/api/auth/register", handleRegister)
+	http.HandleFunc("/api/auth/login", handleLogin)
+	http.HandleFunc("/api/auth/logout", handleLogout)
+	http.HandleFunc("/api/auth/me", handleMe)
+	http.HandleFunc("/api/progress", handleProgress)
+	http.HandleFunc("/api/continue", handleContinueWatching)
+	http.HandleFunc("/api/status", handleWatchStatus)
+	http.HandleFunc("/api/collections", handleCollections)
+	http.HandleFunc("/api/collections/", handleCollection)
+	http.HandleFunc("/api/admin/cache", handleCacheStats)
+	http.HandleFunc("/api/subtitle", handleSubtitle)
+	http.HandleFunc("/api/mediainfo", handleMediaInfo)
+	http.HandleFunc("/api/fonts", handleFonts)
+	http.HandleFunc("/api/fonts/", handleFonts)
+	http.HandleFunc("/api/remux/", handleRemux)
+	http.HandleFunc("/dav", handleWebDAV)
+	http.HandleFunc("/dav/", handleWebDAV)
+	http.HandleFunc("/api/danmaku/v3/", handleDanmaku)
+	http.HandleFunc("/api/admin/danmaku", handleAdminDanmaku)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	initDLNA()
 
 	addr := ":" + config.Port
 	log.Printf("动漫站启动在 http://localhost%s", addr)
-	log.Printf("已加载 %d 部番剧数据", len(animeDB))
+	log.Printf("已加载 %d 部番剧数据", len(c.AnimeDB))
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
 
@@ -75,32 +127,46 @@ func loadConfig() {
 	json.Unmarshal(data, &config)
 }
 
-func loadAnimeDB() {
-	data, err := os.ReadFile("data/anime_db.json")
+func loadAnimeDB(c *Catalog) error {
+	data, err := os.ReadFile(animeDBFile)
 	if err != nil {
-		log.Printf("警告: 无法加载番剧数据库: %v", err)
-		return
+		return fmt.Errorf("无法加载番剧数据库: %v", err)
 	}
-	json.Unmarshal(data, &animeDB)
+	if err := json.Unmarshal(data, &c.AnimeDB); err != nil {
+		return fmt.Errorf("番剧数据库格式错误: %v", err)
+	}
+	return nil
 }
 
-func loadAnimeMapping() {
-	animeMapping = make(map[string]bool)
-	animeFolderPath = make(map[string]string)
-	animeEpisodes = make(map[string][]string)
-	data, err := os.ReadFile("data/anime_mapping_onedrive.json")
+func loadAnimeMapping(c *Catalog) error {
+	c.Mapping = make(map[int]bool)
+	c.FolderPath = make(map[int]string)
+	c.Episodes = make(map[int][]string)
+	c.Subtitles = make(map[int][]string)
+	data, err := os.ReadFile(animeMappingFile)
 	if err != nil {
-		log.Printf("警告: 无法加载映射表: %v", err)
-		return
+		return fmt.Errorf("无法加载映射表: %v", err)
 	}
 	var mappings []AnimeMapping
-	json.Unmarshal(data, &mappings)
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return fmt.Errorf("映射表格式错误: %v", err)
+	}
+	missing := 0
 	for _, m := range mappings {
-		animeMapping[m.AnimeName] = true
-		animeFolderPath[m.AnimeName] = m.FolderPath
-		animeEpisodes[m.AnimeName] = m.Episodes
+		if m.AnimeID == 0 {
+			missing++
+			continue
+		}
+		c.Mapping[m.AnimeID] = true
+		c.FolderPath[m.AnimeID] = m.FolderPath
+		c.Episodes[m.AnimeID] = m.Episodes
+		c.Subtitles[m.AnimeID] = m.Subtitles
+	}
+	log.Printf("已加载 %d 条资源映射", len(c.Mapping))
+	if missing > 0 {
+		log.Printf("警告: %d 条映射缺少 anime_id，请运行 tools/migrate_mapping_id.go", missing)
 	}
-	log.Printf("已加载 %d 条资源映射", len(animeMapping))
+	return nil
 }
 
 func serveIndex(w http.ResponseWriter, r *http.Request) {
@@ -113,34 +179,66 @@ func serveIndex(w http.ResponseWriter, r *http.Request) {
 
 // 获取番剧列表（支持年份筛选和分页）
 func handleAnimeList(w http.ResponseWriter, r *http.Request) {
-	year, _ := strconv.Atoi(r.URL.Query().Get("year"))
-	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
-	pageSize := 24
+	c := currentCatalog()
+	q := r.URL.Query()
+	filter := parseAnimeFilter(q)
+	ids, err := animeIDFilter(r)
+	if err != nil {
+		writeCollectionError(w, err)
+		return
+	}
+	filter.IDs = ids
+	page, _ := strconv.Atoi(q.Get("page"))
+	pageSize, _ := strconv.Atoi(q.Get("page_size"))
 	if page < 1 { page = 1 }
+	if pageSize < 1 { pageSize = 24 }
+	if pageSize > 100 { pageSize = 100 }
 
-	var filtered []AnimeInfo
-	for _, a := range animeDB {
-		if year == 0 || a.Year == year {
-			// 检查是否有资源
-			key := fmt.Sprintf("%s (%d)", a.NameCN, a.Year)
-			if a.NameCN == "" {
-				key = fmt.Sprintf("%s (%d)", a.Name, a.Year)
-			}
-			a.HasResource = animeMapping[key]
+	// 有关键词时先按相关度取候选
+	var candidates []AnimeInfo
+	if filter.Query != "" {
+		for _, h := range c.Search.Search(c, filter.Query) {
+			candidates = append(candidates, c.AnimeDB[h.anime])
+		}
+	} else {
+		candidates = append(candidates, c.AnimeDB...)
+	}
+	var statuses map[int]string
+	if u, _ := currentUser(r); u != nil {
+		statuses = collections.Statuses(u.ID)
+	}
+	for i := range candidates {
+		candidates[i].HasResource = c.Mapping[candidates[i].ID]
+		candidates[i].Status = statuses[candidates[i].ID]
+		c.setFranchise(&candidates[i])
+	}
+
+	filtered := []AnimeInfo{}
+	for _, a := range candidates {
+		if filter.match(a, "") {
 			filtered = append(filtered, a)
 		}
 	}
+	sortAnime(filtered, q.Get("sort"), q.Get("order"))
+	// group=franchise 时同一系列只显示排在最前的一部
+	if q.Get("group") == "franchise" {
+		filtered = groupByFranchise(filtered)
+	}
 
 	total := len(filtered)
+	// 页码过大时乘法会溢出成负数，先限制在最后一页之后
+	if page > total/pageSize+1 { page = total/pageSize + 1 }
 	start := (page - 1) * pageSize
 	end := start + pageSize
 	if start > total { start = total }
 	if end > total { end = total }
 
 	result := map[string]interface{}{
-		"total": total,
-		"page":  page,
-		"data":  filtered[start:end],
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+		"data":      filtered[start:end],
+		"facets":    animeFacets(candidates, filter),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
@@ -148,24 +246,20 @@ func handleAnimeList(w http.ResponseWriter, r *http.Request) {
 
 // 搜索番剧
 func handleAnimeSearch(w http.ResponseWriter, r *http.Request) {
-	keyword := strings.ToLower(r.URL.Query().Get("q"))
-	if keyword == "" {
-		json.NewEncoder(w).Encode([]AnimeInfo{})
-		return
+	keyword := r.URL.Query().Get("q")
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
 	}
 
-	var results []AnimeInfo
-	for _, a := range animeDB {
-		if strings.Contains(strings.ToLower(a.Name), keyword) ||
-			strings.Contains(strings.ToLower(a.NameCN), keyword) {
-			key := fmt.Sprintf("%s (%d)", a.NameCN, a.Year)
-			if a.NameCN == "" {
-				key = fmt.Sprintf("%s (%d)", a.Name, a.Year)
-			}
-			a.HasResource = animeMapping[key]
-			results = append(results, a)
-			if len(results) >= 50 { break }
-		}
+	c := currentCatalog()
+	results := []AnimeInfo{}
+	for _, h := range c.Search.Search(c, keyword) {
+		a := c.AnimeDB[h.anime]
+		a.HasResource = c.Mapping[a.ID]
+		c.setFranchise(&a)
+		results = append(results, a)
+		if len(results) >= limit { break }
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -174,38 +268,26 @@ func handleAnimeSearch(w http.ResponseWriter, r *http.Request) {
 
 // 获取番剧的视频文件列表
 func handleAnimeEpisodes(w http.ResponseWriter, r *http.Request) {
-	name := r.URL.Query().Get("name")
-	year := r.URL.Query().Get("year")
-	if name == "" || year == "" {
-		http.Error(w, "name and year required", 400)
+	id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+	if id == 0 {
+		http.Error(w, "id required", 400)
 		return
 	}
 
-	key := fmt.Sprintf("%s (%s)", name, year)
-	folderPath, ok := animeFolderPath[key]
+	c := currentCatalog()
+	apiPath, episodes, ok := animeEpisodes(c, id)
 	if !ok {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{"episodes": []interface{}{}})
 		return
 	}
 
-	// 转换路径格式：onedrive:anime/xxx -> /onedrive/anime/xxx
-	var apiPath string
-	if strings.HasPrefix(folderPath, "onedrive:") {
-		apiPath = "/" + strings.Replace(folderPath, ":", "/", 1)
-	} else {
-		apiPath = "/pikpak/" + folderPath
-	}
-
-	// 从映射表读取 episodes
-	eps := animeEpisodes[key]
-	var episodes []map[string]string
-	for _, epName := range eps {
-		episodes = append(episodes, map[string]string{
-			"name": epName,
-			"path": apiPath + "/" + epName,
-		})
+	// 登录用户附带观看进度
+	if u, _ := currentUser(r); u != nil {
+		progress.annotate(u.ID, id, episodes)
 	}
+	// 已探测过的附带媒体信息，其余放到后台探测
+	mediaInfos.Enqueue(annotateMedia(episodes))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -214,6 +296,29 @@ func handleAnimeEpisodes(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// animeEpisodes 返回番剧的存储路径和按集数排序的剧集
+func animeEpisodes(c *Catalog, id int) (string, []EpisodeInfo, bool) {
+	folderPath, ok := c.FolderPath[id]
+	if !ok {
+		return "", nil, false
+	}
+
+	// 转换路径格式：onedrive:anime/xxx -> /onedrive/anime/xxx
+	apiPath := storagePath(folderPath)
+
+	// 从映射表读取 episodes，解析文件名后按集数排序
+	episodes := []EpisodeInfo{}
+	for _, epName := range c.Episodes[id] {
+		ep := parseEpisodeName(epName)
+		ep.Path = apiPath + "/" + epName
+		ep.Danmaku = danmakuID(id, ep)
+		episodes = append(episodes, ep)
+	}
+	sortEpisodes(episodes)
+	pairSubtitles(episodes, apiPath, c.Subtitles[id])
+	return apiPath, episodes, true
+}
+
 // OpenList 目录列表
 func handleList(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Query().Get("path")
@@ -229,7 +334,7 @@ func handleList(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
-// 获取文件直链（使用 OpenList）
+// 获取文件直链（按存储路由依次尝试各后端）
 func handleGet(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Query().Get("path")
 	if path == "" {
@@ -237,27 +342,31 @@ func handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 统一使用 OpenList 获取直链
-	body := map[string]interface{}{"path": path, "password": ""}
-	resp, err := callOpenList("/api/fs/get", body)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	var link, backend string
+	if config.StreamProxy {
+		link, backend = streamURL(path), "proxy"
+	} else {
+		var err error
+		link, backend, err = storage.Link(r.Context(), path)
+		if err != nil {
+			upstreamError(w, path, err)
+			return
+		}
+		// 本地目录等没有直链的后端走站内代理
+		if link == "" {
+			link, backend = streamURL(path), "proxy"
+		}
 	}
+	// 保持 OpenList /api/fs/get 的响应结构，前端只读取 data.raw_url
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(resp)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    200,
+		"message": "success",
+		"data":    map[string]string{"raw_url": link, "backend": backend},
+	})
 }
 
 func callOpenList(endpoint string, body map[string]interface{}) ([]byte, error) {
-	jsonBody, _ := json.Marshal(body)
 	baseURL := strings.TrimSuffix(config.OpenListURL, "/")
-	req, _ := http.NewRequest("POST", baseURL+endpoint, bytes.NewBuffer(jsonBody))
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := (&http.Client{}).Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("请求 OpenList 失败: %v", err)
-	}
-	defer resp.Body.Close()
-	return io.ReadAll(resp.Body)
+	return openListPost(context.Background(), apiClient, baseURL, endpoint, body)
 }
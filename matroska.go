@@ -0,0 +1,1150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Matroska/EBML 解析：读取头部的轨道、章节、附件等元数据。
+// 通过 io.ReadSeeker 按需跳转，配合 rangeReader 只会下载用到的几段，
+// Cluster 之后的元素（Cues、放在文件末尾的附件等）按 SeekHead 定位
+
+var (
+	errNotMatroska = errors.New("不是 Matroska 文件")
+	errBadMatroska = errors.New("Matroska 文件结构损坏")
+)
+
+// 读入内存解析的元素最大长度，超过的视为损坏
+const maxEBMLElementSize = 16 << 20
+
+// EBML 元素 ID
+const (
+	idEBML                = 0x1A45DFA3
+	idDocType             = 0x4282
+	idSegment             = 0x18538067
+	idSeekHead            = 0x114D9B74
+	idSeek                = 0x4DBB
+	idSeekID              = 0x53AB
+	idSeekPosition        = 0x53AC
+	idInfo                = 0x1549A966
+	idTimestampScale      = 0x2AD7B1
+	idDuration            = 0x4489
+	idTitle               = 0x7BA9
+	idTracks              = 0x1654AE6B
+	idTrackEntry          = 0xAE
+	idTrackNumber         = 0xD7
+	idTrackType           = 0x83
+	idFlagDefault         = 0x88
+	idFlagForced          = 0x55AA
+	idName                = 0x536E
+	idLanguage            = 0x22B59C
+	idLanguageBCP47       = 0x22B59D
+	idCodecID             = 0x86
+	idCodecPrivate        = 0x63A2
+	idDefaultDuration     = 0x23E383
+	idVideo               = 0xE0
+	idPixelWidth          = 0xB0
+	idPixelHeight         = 0xBA
+	idColour              = 0x55B0
+	idBitsPerChannel      = 0x55B2
+	idAudio               = 0xE1
+	idSamplingFrequency   = 0xB5
+	idChannels            = 0x9F
+	idAudioBitDepth       = 0x6264
+	idContentEncodings    = 0x6D80
+	idContentEncoding     = 0x6240
+	idContentCompression  = 0x5034
+	idContentCompAlgo     = 0x4254
+	idContentCompSettings = 0x4255
+	idChapters            = 0x1043A770
+	idEditionEntry        = 0x45B9
+	idEditionFlagDefault  = 0x45DB
+	idChapterAtom         = 0xB6
+	idChapterTimeStart    = 0x91
+	idChapterTimeEnd      = 0x92
+	idChapterFlagHidden   = 0x98
+	idChapterDisplay      = 0x80
+	idChapString          = 0x85
+	idAttachments         = 0x1941A469
+	idAttachedFile        = 0x61A7
+	idFileDescription     = 0x467E
+	idFileName            = 0x466E
+	idFileMimeType        = 0x4660
+	idFileData            = 0x465C
+	idFileUID             = 0x46AE
+	idTags                = 0x1254C367
+	idTag                 = 0x7373
+	idSimpleTag           = 0x67C8
+	idTagName             = 0x45A3
+	idTagString           = 0x4487
+	idCues                = 0x1C53BB6B
+	idCuePoint            = 0xBB
+	idCueTime             = 0xB3
+	idCueTrackPositions   = 0xB7
+	idCueTrack            = 0xF7
+	idCueClusterPosition  = 0xF1
+	idCueRelativePosition = 0xF0
+	idCluster             = 0x1F43B675
+	idVoid                = 0xEC
+	idTimestamp           = 0xE7
+	idSimpleBlock         = 0xA3
+	idBlockGroup          = 0xA0
+	idBlock               = 0xA1
+	idBlockDuration       = 0x9B
+)
+
+type MediaTrack struct {
+	Number     int     `json:"number"`
+	Type       string  `json:"type"`  // video/audio/subtitle
+	Codec      string  `json:"codec"` // HEVC/AVC/AAC/FLAC/ASS/PGS 等
+	CodecID    string  `json:"codec_id"`
+	Language   string  `json:"language,omitempty"`
+	Name       string  `json:"name,omitempty"`
+	Default    bool    `json:"default,omitempty"`
+	Forced     bool    `json:"forced,omitempty"`
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	BitDepth   int     `json:"bit_depth,omitempty"`
+	FrameRate  float64 `json:"frame_rate,omitempty"`
+	Channels   int     `json:"channels,omitempty"`
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	CodecPrivate []byte `json:"-"`
+	CompAlgo     int    `json:"-"` // ContentCompAlgo，-1 表示未压缩，0 zlib，3 去除公共头
+	CompSettings []byte `json:"-"`
+}
+
+type Chapter struct {
+	Start float64 `json:"start"` // 秒
+	End   float64 `json:"end"`
+	Title string  `json:"title"`
+}
+
+type Attachment struct {
+	UID         uint64 `json:"uid,string"`
+	Name        string `json:"name"`
+	MimeType    string `json:"mime_type"`
+	Description string `json:"description,omitempty"`
+	Size        int64  `json:"size"`
+	Offset      int64  `json:"offset"` // FileData 在文件中的位置
+}
+
+type MediaInfo struct {
+	Duration    float64      `json:"duration"` // 秒
+	Title       string       `json:"title,omitempty"`
+	Tracks      []MediaTrack `json:"tracks"`
+	Chapters    []Chapter    `json:"chapters,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// mkvLayout 记录文件结构中的位置，供后续按 Cluster/Cues 读取
+type mkvLayout struct {
+	SegmentOffset  int64  `json:"segment_offset"` // Segment 数据起始，SeekHead/Cues 中的位置都相对它
+	TimestampScale uint64 `json:"timestamp_scale"`
+	ClusterOffset  int64  `json:"cluster_offset"` // 第一个 Cluster
+	CuesOffset     int64  `json:"cues_offset,omitempty"`
+}
+
+type mkvFile struct {
+	Info   MediaInfo
+	Layout mkvLayout
+}
+
+// ---- EBML 读取 ----
+
+type ebmlReader struct {
+	r   io.ReadSeeker
+	pos int64
+	b   [1]byte
+}
+
+func (e *ebmlReader) readByte() (byte, error) {
+	if _, err := io.ReadFull(e.r, e.b[:]); err != nil {
+		return 0, err
+	}
+	e.pos++
+	return e.b[0], nil
+}
+
+// vint 读取变长整数，keepMarker 为 true 时保留长度标记位（元素 ID 的写法）
+func (e *ebmlReader) vint(keepMarker bool) (uint64, int, error) {
+	first, err := e.readByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	n := 1
+	for mask := byte(0x80); n <= 8 && first&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > 8 {
+		return 0, 0, fmt.Errorf("%w: EBML 变长整数无效", errBadMatroska)
+	}
+	v := uint64(first)
+	if !keepMarker {
+		v &= uint64(0xFF >> n)
+	}
+	for i := 1; i < n; i++ {
+		b, err := e.readByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, n, nil
+}
+
+// element 读取元素头，size 为 -1 表示长度未知
+func (e *ebmlReader) element() (id uint32, size int64, err error) {
+	v, _, err := e.vint(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	s, n, err := e.vint(false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if s == 1<<(7*n)-1 {
+		return uint32(v), -1, nil
+	}
+	return uint32(v), int64(s), nil
+}
+
+func (e *ebmlReader) read(n int64) ([]byte, error) {
+	if n < 0 || n > maxEBMLElementSize {
+		return nil, fmt.Errorf("%w: EBML 元素过大 %d", errBadMatroska, n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(e.r, buf); err != nil {
+		return nil, err
+	}
+	e.pos += n
+	return buf, nil
+}
+
+func (e *ebmlReader) seek(pos int64) error {
+	if _, err := e.r.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	e.pos = pos
+	return nil
+}
+
+// ---- 内存中的元素解析 ----
+
+type ebmlChild struct {
+	id   uint32
+	data []byte
+}
+
+// ebmlVint 从字节中读取变长整数
+func ebmlVint(data []byte, keepMarker bool) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	n := 1
+	for mask := byte(0x80); n <= 8 && data[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > 8 || n > len(data) {
+		return 0, 0
+	}
+	v := uint64(data[0])
+	if !keepMarker {
+		v &= uint64(0xFF >> n)
+	}
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(data[i])
+	}
+	return v, n
+}
+
+// ebmlChildren 拆出主元素的子元素，遇到损坏的数据时返回已解析的部分
+func ebmlChildren(data []byte) []ebmlChild {
+	var out []ebmlChild
+	for len(data) > 0 {
+		id, n1 := ebmlVint(data, true)
+		if n1 == 0 {
+			break
+		}
+		size, n2 := ebmlVint(data[n1:], false)
+		if n2 == 0 {
+			break
+		}
+		data = data[n1+n2:]
+		if size == 1<<(7*n2)-1 || size > uint64(len(data)) {
+			size = uint64(len(data))
+		}
+		out = append(out, ebmlChild{uint32(id), data[:size]})
+		data = data[size:]
+	}
+	return out
+}
+
+func ebmlUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+func ebmlString(data []byte) string {
+	return strings.TrimRight(string(data), "\x00")
+}
+
+// ---- Matroska ----
+
+// parseMatroska 解析 MKV/WebM 头部元数据，size 为文件大小
+func parseMatroska(r io.ReadSeeker, size int64) (*mkvFile, error) {
+	e := &ebmlReader{r: r}
+	id, n, err := e.element()
+	if err != nil || id != idEBML {
+		return nil, errNotMatroska
+	}
+	header, err := e.read(n)
+	if err != nil {
+		return nil, errNotMatroska
+	}
+	docType := "matroska"
+	for _, c := range ebmlChildren(header) {
+		if c.id == idDocType {
+			docType = ebmlString(c.data)
+		}
+	}
+	if docType != "matroska" && docType != "webm" {
+		return nil, errNotMatroska
+	}
+
+	id, n, err = e.element()
+	if err != nil || id != idSegment {
+		return nil, errNotMatroska
+	}
+	f := &mkvFile{Layout: mkvLayout{SegmentOffset: e.pos, TimestampScale: 1000000}}
+	segEnd := size
+	if n >= 0 && e.pos+n < size {
+		segEnd = e.pos + n
+	}
+
+	type seekEntry struct {
+		id  uint32
+		pos int64
+	}
+	var seeks []seekEntry
+	parsed := make(map[uint32]bool)
+	visited := make(map[int64]bool) // 已读过的位置，避免 SeekHead 互相引用时死循环
+	var tagsDuration float64
+
+	parseAt := func(start int64) error {
+		if err := e.seek(start); err != nil {
+			return err
+		}
+		id, n, err := e.element()
+		if err != nil {
+			return err
+		}
+		if id == idCluster {
+			if f.Layout.ClusterOffset == 0 {
+				f.Layout.ClusterOffset = start
+			}
+			return io.EOF
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: 元素长度未知", errBadMatroska)
+		}
+		visited[start] = true
+		switch id {
+		case idSeekHead:
+			data, err := e.read(n)
+			if err != nil {
+				return err
+			}
+			for _, s := range ebmlChildren(data) {
+				if s.id != idSeek {
+					continue
+				}
+				var entry seekEntry
+				for _, c := range ebmlChildren(s.data) {
+					switch c.id {
+					case idSeekID:
+						entry.id = uint32(ebmlUint(c.data))
+					case idSeekPosition:
+						entry.pos = f.Layout.SegmentOffset + int64(ebmlUint(c.data))
+					}
+				}
+				seeks = append(seeks, entry)
+			}
+		case idInfo, idTracks, idChapters, idTags:
+			if parsed[id] {
+				break
+			}
+			data, err := e.read(n)
+			if err != nil {
+				return err
+			}
+			parsed[id] = true
+			switch id {
+			case idInfo:
+				f.parseInfo(data)
+			case idTracks:
+				f.parseTracks(data)
+			case idChapters:
+				f.parseChapters(data)
+			case idTags:
+				tagsDuration = parseTagsDuration(data)
+			}
+		case idAttachments:
+			if !parsed[id] {
+				parsed[id] = true
+				return f.parseAttachments(e, e.pos+n)
+			}
+		case idCues:
+			f.Layout.CuesOffset = start
+		}
+		return nil
+	}
+
+	// 顺序读取到第一个 Cluster
+	for pos := e.pos; pos < segEnd; {
+		err := parseAt(pos)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if parsed[idTracks] {
+				break
+			}
+			return nil, err
+		}
+		// parseAt 可能没读完元素体，按头部记录的长度跳到下一个
+		if err := e.seek(pos); err != nil {
+			return nil, err
+		}
+		_, n, err := e.element()
+		if err != nil || n < 0 {
+			break
+		}
+		pos = e.pos + n
+	}
+
+	// Cluster 之后的元素按 SeekHead 定位
+	for i := 0; i < len(seeks); i++ {
+		s := seeks[i]
+		if s.pos <= 0 || s.pos >= segEnd || visited[s.pos] {
+			continue
+		}
+		switch s.id {
+		case idSeekHead, idInfo, idTracks, idChapters, idAttachments, idTags, idCues:
+			if s.id != idSeekHead && s.id != idCues && parsed[s.id] {
+				continue
+			}
+			if err := parseAt(s.pos); err != nil && err != io.EOF && !parsed[idTracks] {
+				return nil, err
+			}
+		}
+	}
+	if !parsed[idTracks] {
+		return nil, fmt.Errorf("%w: 没有找到轨道信息", errBadMatroska)
+	}
+	if f.Info.Duration == 0 {
+		f.Info.Duration = tagsDuration
+	}
+	f.finishChapters()
+	return f, nil
+}
+
+func (f *mkvFile) parseInfo(data []byte) {
+	var duration float64
+	for _, c := range ebmlChildren(data) {
+		switch c.id {
+		case idTimestampScale:
+			if v := ebmlUint(c.data); v > 0 {
+				f.Layout.TimestampScale = v
+			}
+		case idDuration:
+			duration = ebmlFloat(c.data)
+		case idTitle:
+			f.Info.Title = ebmlString(c.data)
+		}
+	}
+	f.Info.Duration = duration * float64(f.Layout.TimestampScale) / 1e9
+}
+
+var trackTypes = map[uint64]string{1: "video", 2: "audio", 17: "subtitle"}
+
+// CodecID 前缀 -> 常用名称，按顺序匹配
+var codecNames = []struct{ prefix, name string }{
+	{"V_MPEG4/ISO/AVC", "AVC"}, {"V_MPEGH/ISO/HEVC", "HEVC"}, {"V_AV1", "AV1"}, {"V_VP9", "VP9"}, {"V_VP8", "VP8"},
+	{"V_MPEG4/ISO/", "MPEG4"}, {"V_MPEG2", "MPEG2"}, {"V_MPEG1", "MPEG1"}, {"V_REAL/", "RV"}, {"V_MS/VFW/FOURCC", "VFW"},
+	{"A_AAC", "AAC"}, {"A_FLAC", "FLAC"}, {"A_OPUS", "OPUS"}, {"A_VORBIS", "VORBIS"}, {"A_EAC3", "EAC3"}, {"A_AC3", "AC3"},
+	{"A_DTS", "DTS"}, {"A_TRUEHD", "TRUEHD"}, {"A_MPEG/L3", "MP3"}, {"A_MPEG/L2", "MP2"}, {"A_PCM/", "PCM"}, {"A_ALAC", "ALAC"},
+	{"S_TEXT/ASS", "ASS"}, {"S_TEXT/SSA", "ASS"}, {"S_ASS", "ASS"}, {"S_SSA", "ASS"}, {"S_TEXT/UTF8", "SRT"}, {"S_TEXT/WEBVTT", "WEBVTT"},
+	{"S_HDMV/PGS", "PGS"}, {"S_VOBSUB", "VOBSUB"}, {"S_DVBSUB", "DVBSUB"},
+}
+
+func codecName(codecID string) string {
+	for _, c := range codecNames {
+		if strings.HasPrefix(codecID, c.prefix) {
+			return c.name
+		}
+	}
+	return codecID
+}
+
+func (f *mkvFile) parseTracks(data []byte) {
+	for _, te := range ebmlChildren(data) {
+		if te.id != idTrackEntry {
+			continue
+		}
+		t := MediaTrack{Language: "eng", Default: true, CompAlgo: -1}
+		var trackType uint64
+		var lang47 string
+		for _, c := range ebmlChildren(te.data) {
+			switch c.id {
+			case idTrackNumber:
+				t.Number = int(ebmlUint(c.data))
+			case idTrackType:
+				trackType = ebmlUint(c.data)
+			case idFlagDefault:
+				t.Default = ebmlUint(c.data) != 0
+			case idFlagForced:
+				t.Forced = ebmlUint(c.data) != 0
+			case idName:
+				t.Name = ebmlString(c.data)
+			case idLanguage:
+				t.Language = ebmlString(c.data)
+			case idLanguageBCP47:
+				lang47 = ebmlString(c.data)
+			case idCodecID:
+				t.CodecID = ebmlString(c.data)
+			case idCodecPrivate:
+				t.CodecPrivate = c.data
+			case idDefaultDuration:
+				if d := ebmlUint(c.data); d > 0 {
+					t.FrameRate = math.Round(1e9/float64(d)*1000) / 1000
+				}
+			case idVideo:
+				for _, v := range ebmlChildren(c.data) {
+					switch v.id {
+					case idPixelWidth:
+						t.Width = int(ebmlUint(v.data))
+					case idPixelHeight:
+						t.Height = int(ebmlUint(v.data))
+					case idColour:
+						for _, col := range ebmlChildren(v.data) {
+							if col.id == idBitsPerChannel {
+								t.BitDepth = int(ebmlUint(col.data))
+							}
+						}
+					}
+				}
+			case idAudio:
+				t.Channels = 1
+				for _, a := range ebmlChildren(c.data) {
+					switch a.id {
+					case idSamplingFrequency:
+						t.SampleRate = ebmlFloat(a.data)
+					case idChannels:
+						t.Channels = int(ebmlUint(a.data))
+					case idAudioBitDepth:
+						t.BitDepth = int(ebmlUint(a.data))
+					}
+				}
+			case idContentEncodings:
+				for _, enc := range ebmlChildren(c.data) {
+					for _, ec := range ebmlChildren(enc.data) {
+						if enc.id != idContentEncoding || ec.id != idContentCompression {
+							continue
+						}
+						t.CompAlgo = 0
+						for _, cc := range ebmlChildren(ec.data) {
+							switch cc.id {
+							case idContentCompAlgo:
+								t.CompAlgo = int(ebmlUint(cc.data))
+							case idContentCompSettings:
+								t.CompSettings = cc.data
+							}
+						}
+					}
+				}
+			}
+		}
+		t.Type = trackTypes[trackType]
+		if t.Type == "" {
+			continue
+		}
+		if lang47 != "" {
+			t.Language = lang47
+		}
+		t.Codec = codecName(t.CodecID)
+		if t.Type == "video" && t.BitDepth == 0 {
+			t.BitDepth = videoBitDepth(t.Codec, t.CodecPrivate)
+		}
+		f.Info.Tracks = append(f.Info.Tracks, t)
+	}
+}
+
+// videoBitDepth 从解码器配置（avcC/hvcC/av1C）推断位深
+func videoBitDepth(codec string, private []byte) int {
+	switch codec {
+	case "AVC":
+		if len(private) > 1 {
+			// High 10 / High 4:2:2 / High 4:4:4 一般为 10bit 以上
+			switch private[1] {
+			case 110, 122, 244:
+				return 10
+			}
+			return 8
+		}
+	case "HEVC":
+		if len(private) > 17 {
+			return int(private[17]&0x07) + 8
+		}
+	case "AV1":
+		if len(private) > 2 {
+			switch {
+			case private[2]&0x40 == 0:
+				return 8
+			case private[2]&0x20 != 0:
+				return 12
+			}
+			return 10
+		}
+	}
+	return 0
+}
+
+func (f *mkvFile) parseChapters(data []byte) {
+	var editions [][]byte
+	chosen := -1
+	for _, ed := range ebmlChildren(data) {
+		if ed.id != idEditionEntry {
+			continue
+		}
+		for _, c := range ebmlChildren(ed.data) {
+			if c.id == idEditionFlagDefault && ebmlUint(c.data) != 0 && chosen < 0 {
+				chosen = len(editions)
+			}
+		}
+		editions = append(editions, ed.data)
+	}
+	if len(editions) == 0 {
+		return
+	}
+	if chosen < 0 {
+		chosen = 0
+	}
+	var walk func(data []byte)
+	walk = func(data []byte) {
+		for _, atom := range ebmlChildren(data) {
+			if atom.id != idChapterAtom {
+				continue
+			}
+			ch := Chapter{End: -1}
+			hidden := false
+			for _, c := range ebmlChildren(atom.data) {
+				switch c.id {
+				case idChapterTimeStart:
+					ch.Start = float64(ebmlUint(c.data)) / 1e9
+				case idChapterTimeEnd:
+					ch.End = float64(ebmlUint(c.data)) / 1e9
+				case idChapterFlagHidden:
+					hidden = ebmlUint(c.data) != 0
+				case idChapterDisplay:
+					for _, d := range ebmlChildren(c.data) {
+						if d.id == idChapString && ch.Title == "" {
+							ch.Title = ebmlString(d.data)
+						}
+					}
+				}
+			}
+			if !hidden {
+				f.Info.Chapters = append(f.Info.Chapters, ch)
+			}
+			walk(atom.data) // 嵌套章节
+		}
+	}
+	walk(editions[chosen])
+}
+
+// finishChapters 排序并补齐缺少的结束时间
+func (f *mkvFile) finishChapters() {
+	chs := f.Info.Chapters
+	sort.SliceStable(chs, func(i, j int) bool { return chs[i].Start < chs[j].Start })
+	for i := range chs {
+		if chs[i].End >= 0 {
+			continue
+		}
+		if i+1 < len(chs) {
+			chs[i].End = chs[i+1].Start
+		} else {
+			chs[i].End = math.Max(f.Info.Duration, chs[i].Start)
+		}
+	}
+}
+
+// parseAttachments 逐个读取附件信息，FileData 只记位置不下载
+func (f *mkvFile) parseAttachments(e *ebmlReader, end int64) error {
+	for e.pos < end {
+		id, n, err := e.element()
+		if err != nil || n < 0 {
+			return err
+		}
+		next := e.pos + n
+		if id == idAttachedFile {
+			var a Attachment
+			for e.pos < next {
+				cid, cn, err := e.element()
+				if err != nil || cn < 0 {
+					return err
+				}
+				if cid == idFileData {
+					a.Offset, a.Size = e.pos, cn
+					if err := e.seek(e.pos + cn); err != nil {
+						return err
+					}
+					continue
+				}
+				data, err := e.read(cn)
+				if err != nil {
+					return err
+				}
+				switch cid {
+				case idFileName:
+					a.Name = ebmlString(data)
+				case idFileMimeType:
+					a.MimeType = ebmlString(data)
+				case idFileDescription:
+					a.Description = ebmlString(data)
+				case idFileUID:
+					a.UID = ebmlUint(data)
+				}
+			}
+			f.Info.Attachments = append(f.Info.Attachments, a)
+		}
+		if err := e.seek(next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTagsDuration 从 DURATION 标签（mkvmerge 写入，如 00:23:40.123000000）取最长的时长
+func parseTagsDuration(data []byte) float64 {
+	var longest float64
+	for _, tag := range ebmlChildren(data) {
+		if tag.id != idTag {
+			continue
+		}
+		for _, st := range ebmlChildren(tag.data) {
+			if st.id != idSimpleTag {
+				continue
+			}
+			var name, value string
+			for _, c := range ebmlChildren(st.data) {
+				switch c.id {
+				case idTagName:
+					name = ebmlString(c.data)
+				case idTagString:
+					value = ebmlString(c.data)
+				}
+			}
+			if strings.EqualFold(name, "DURATION") {
+				var h, m int
+				var s float64
+				if _, err := fmt.Sscanf(value, "%d:%d:%f", &h, &m, &s); err == nil {
+					longest = math.Max(longest, float64(h*3600+m*60)+s)
+				}
+			}
+		}
+	}
+	return longest
+}
+
+// ---- Cues 和 Cluster ----
+
+type cuePoint struct {
+	Time     int64 // TimestampScale 为单位
+	Track    int
+	Cluster  int64 // Cluster 在文件中的位置
+	Relative int64 // 块相对 Cluster 数据起始的位置，-1 表示没有
+}
+
+// readCues 读取索引，没有 Cues 时返回空
+func readCues(r io.ReadSeeker, layout mkvLayout) ([]cuePoint, error) {
+	if layout.CuesOffset == 0 {
+		return nil, nil
+	}
+	e := &ebmlReader{r: r}
+	if err := e.seek(layout.CuesOffset); err != nil {
+		return nil, err
+	}
+	id, n, err := e.element()
+	if err != nil {
+		return nil, err
+	}
+	if id != idCues || n < 0 {
+		return nil, fmt.Errorf("%w: Cues 位置无效", errBadMatroska)
+	}
+	data, err := e.read(n)
+	if err != nil {
+		return nil, err
+	}
+	var cues []cuePoint
+	for _, cp := range ebmlChildren(data) {
+		if cp.id != idCuePoint {
+			continue
+		}
+		var t int64
+		var positions [][]byte
+		for _, c := range ebmlChildren(cp.data) {
+			switch c.id {
+			case idCueTime:
+				t = int64(ebmlUint(c.data))
+			case idCueTrackPositions:
+				positions = append(positions, c.data)
+			}
+		}
+		for _, pos := range positions {
+			cue := cuePoint{Time: t, Relative: -1}
+			for _, c := range ebmlChildren(pos) {
+				switch c.id {
+				case idCueTrack:
+					cue.Track = int(ebmlUint(c.data))
+				case idCueClusterPosition:
+					cue.Cluster = layout.SegmentOffset + int64(ebmlUint(c.data))
+				case idCueRelativePosition:
+					cue.Relative = int64(ebmlUint(c.data))
+				}
+			}
+			cues = append(cues, cue)
+		}
+	}
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Time < cues[j].Time })
+	return cues, nil
+}
+
+type mkvBlock struct {
+	Track    int
+	Time     int64 // 绝对时间，TimestampScale 为单位
+	Duration int64 // -1 表示未知（SimpleBlock）
+	Keyframe bool
+	Frames   [][]byte
+}
+
+// parseBlock 解析 SimpleBlock/Block 的内容，包括三种 lacing
+func parseBlock(data []byte, clusterTime int64, simple bool) (mkvBlock, error) {
+	b := mkvBlock{Duration: -1}
+	track, n := ebmlVint(data, false)
+	if n == 0 || len(data) < n+3 {
+		return b, fmt.Errorf("%w: Block 太短", errBadMatroska)
+	}
+	b.Track = int(track)
+	b.Time = clusterTime + int64(int16(binary.BigEndian.Uint16(data[n:])))
+	flags := data[n+2]
+	b.Keyframe = simple && flags&0x80 != 0
+	data = data[n+3:]
+
+	lacing := flags & 0x06
+	if lacing == 0 {
+		b.Frames = [][]byte{data}
+		return b, nil
+	}
+	if len(data) == 0 {
+		return b, fmt.Errorf("%w: lacing 数据无效", errBadMatroska)
+	}
+	count := int(data[0]) + 1
+	data = data[1:]
+	sizes := make([]int, count)
+	switch lacing {
+	case 0x02: // Xiph
+		for i := 0; i < count-1; i++ {
+			for {
+				if len(data) == 0 {
+					return b, fmt.Errorf("%w: lacing 数据无效", errBadMatroska)
+				}
+				v := data[0]
+				data = data[1:]
+				sizes[i] += int(v)
+				if v != 0xFF {
+					break
+				}
+			}
+		}
+	case 0x06: // EBML，后续帧记录与前一帧的差值
+		first, n := ebmlVint(data, false)
+		if n == 0 {
+			return b, fmt.Errorf("%w: lacing 数据无效", errBadMatroska)
+		}
+		data = data[n:]
+		sizes[0] = int(first)
+		for i := 1; i < count-1; i++ {
+			v, n := ebmlVint(data, false)
+			if n == 0 {
+				return b, fmt.Errorf("%w: lacing 数据无效", errBadMatroska)
+			}
+			data = data[n:]
+			sizes[i] = sizes[i-1] + int(int64(v)-(int64(1)<<(7*n-1)-1))
+		}
+	case 0x04: // 固定长度
+		for i := range sizes[:count-1] {
+			sizes[i] = len(data) / count
+		}
+	}
+	used := 0
+	for _, sz := range sizes[:count-1] {
+		used += sz
+	}
+	sizes[count-1] = len(data) - used
+	for _, sz := range sizes {
+		if sz < 0 || sz > len(data) {
+			return b, fmt.Errorf("%w: lacing 数据无效", errBadMatroska)
+		}
+		b.Frames = append(b.Frames, data[:sz])
+		data = data[sz:]
+	}
+	return b, nil
+}
+
+// parseBlockGroup 取出 BlockGroup 里的 Block 和 BlockDuration
+func parseBlockGroup(data []byte, clusterTime int64) (mkvBlock, error) {
+	var block []byte
+	duration := int64(-1)
+	keyframe := true
+	for _, c := range ebmlChildren(data) {
+		switch c.id {
+		case idBlock:
+			block = c.data
+		case idBlockDuration:
+			duration = int64(ebmlUint(c.data))
+		case 0xFB: // ReferenceBlock，有参考帧就不是关键帧
+			keyframe = false
+		}
+	}
+	if block == nil {
+		return mkvBlock{}, fmt.Errorf("%w: BlockGroup 缺少 Block", errBadMatroska)
+	}
+	b, err := parseBlock(block, clusterTime, false)
+	b.Duration, b.Keyframe = duration, keyframe
+	return b, err
+}
+
+// blockHeaderSize 判断轨道号需要读的块头长度：BlockGroup 的子元素头加上轨道号
+const blockHeaderSize = 24
+
+// blockTrack 从块头解析轨道号，不用的块可以整个跳过
+func blockTrack(id uint32, head []byte) int {
+	if id == idBlockGroup {
+		// BlockGroup 里的第一个子元素一般就是 Block
+		cid, n := ebmlVint(head, true)
+		if n == 0 || cid != idBlock {
+			return 0
+		}
+		_, m := ebmlVint(head[n:], false)
+		if m == 0 {
+			return 0
+		}
+		head = head[n+m:]
+	}
+	v, n := ebmlVint(head, false)
+	if n == 0 {
+		return 0
+	}
+	return int(v)
+}
+
+// errNotCluster 表示 start 处不是 Cluster，顺序扫描时说明已经读完所有 Cluster
+var errNotCluster = errors.New("不是 Cluster")
+
+// readClusterBlocks 从 start 处的 Cluster 读出 want 需要的轨道的块；
+// r 只需支持向前 Seek，可以是顺序读取的流
+func readClusterBlocks(e *ebmlReader, start int64, want func(track int) bool, fn func(mkvBlock) error) (next int64, err error) {
+	if err := e.seek(start); err != nil {
+		return 0, err
+	}
+	id, n, err := e.element()
+	if err != nil {
+		return 0, err
+	}
+	if id != idCluster {
+		if n < 0 {
+			return 0, fmt.Errorf("%w: 元素长度未知", errBadMatroska)
+		}
+		if id == idVoid {
+			return e.pos + n, nil
+		}
+		return e.pos + n, errNotCluster // Cluster 之后的 Cues、Attachments 等
+	}
+	end := int64(-1)
+	if n >= 0 {
+		end = e.pos + n
+	}
+	var clusterTime int64
+	for end < 0 || e.pos < end {
+		childStart := e.pos
+		cid, cn, err := e.element()
+		if err != nil {
+			if end < 0 && err == io.EOF {
+				return childStart, io.EOF
+			}
+			return 0, err
+		}
+		if cid == idCluster || cn < 0 {
+			// 长度未知的 Cluster 遇到下一个 Cluster 才结束
+			return childStart, nil
+		}
+		dataStart := e.pos
+		switch cid {
+		case idTimestamp:
+			data, err := e.read(cn)
+			if err != nil {
+				return 0, err
+			}
+			clusterTime = int64(ebmlUint(data))
+		case idSimpleBlock, idBlockGroup:
+			// 先只读块头，需要的块再读剩下的部分，流式读取时不用往回 seek
+			head, err := e.read(min(cn, blockHeaderSize))
+			if err != nil {
+				return 0, err
+			}
+			if want(blockTrack(cid, head)) {
+				rest, err := e.read(cn - int64(len(head)))
+				if err != nil {
+					return 0, err
+				}
+				data := append(head, rest...)
+				var b mkvBlock
+				if cid == idSimpleBlock {
+					b, err = parseBlock(data, clusterTime, true)
+				} else {
+					b, err = parseBlockGroup(data, clusterTime)
+				}
+				if err != nil {
+					return 0, err
+				}
+				if err := fn(b); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if e.pos != dataStart+cn {
+			if err := e.seek(dataStart + cn); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return end, nil
+}
+
+// readBlockAt 读取 pos 处的单个块（按 Cues 的 CueRelativePosition 定位）
+func readBlockAt(e *ebmlReader, pos, clusterTime int64) (mkvBlock, error) {
+	if err := e.seek(pos); err != nil {
+		return mkvBlock{}, err
+	}
+	id, n, err := e.element()
+	if err != nil {
+		return mkvBlock{}, err
+	}
+	data, err := e.read(n)
+	if err != nil {
+		return mkvBlock{}, err
+	}
+	switch id {
+	case idSimpleBlock:
+		return parseBlock(data, clusterTime, true)
+	case idBlockGroup:
+		return parseBlockGroup(data, clusterTime)
+	}
+	return mkvBlock{}, fmt.Errorf("%w: 索引指向的不是块", errBadMatroska)
+}
+
+// clusterTimestamp 读取 Cluster 的时间戳，返回 Cluster 数据的起始位置
+func clusterTimestamp(e *ebmlReader, start int64) (t int64, dataStart int64, err error) {
+	if err := e.seek(start); err != nil {
+		return 0, 0, err
+	}
+	id, _, err := e.element()
+	if err != nil {
+		return 0, 0, err
+	}
+	if id != idCluster {
+		return 0, 0, fmt.Errorf("%w: 索引指向的不是 Cluster", errBadMatroska)
+	}
+	dataStart = e.pos
+	for i := 0; i < 4; i++ {
+		cid, cn, err := e.element()
+		if err != nil || cn < 0 {
+			return 0, 0, fmt.Errorf("%w: Cluster 缺少时间戳", errBadMatroska)
+		}
+		if cid == idTimestamp {
+			data, err := e.read(cn)
+			if err != nil {
+				return 0, 0, err
+			}
+			return int64(ebmlUint(data)), dataStart, nil
+		}
+		if err := e.seek(e.pos + cn); err != nil {
+			return 0, 0, err
+		}
+	}
+	return 0, 0, fmt.Errorf("%w: Cluster 缺少时间戳", errBadMatroska)
+}
+
+// decodeFrame 处理轨道的内容压缩（zlib 或去除公共头）
+func decodeFrame(t *MediaTrack, frame []byte) ([]byte, error) {
+	switch t.CompAlgo {
+	case 0:
+		zr, err := zlib.NewReader(bytes.NewReader(frame))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(io.LimitReader(zr, maxEBMLElementSize))
+	case 3:
+		return append(append([]byte{}, t.CompSettings...), frame...), nil
+	case -1:
+		return frame, nil
+	}
+	return nil, fmt.Errorf("不支持的压缩方式 %d", t.CompAlgo)
+}
+
+// forwardSeeker 把顺序读取的流包装成只能向前 Seek 的 io.ReadSeeker，向前跳过的部分直接丢弃
+type forwardSeeker struct {
+	r   *bufio.Reader
+	pos int64
+}
+
+func (f *forwardSeeker) Read(b []byte) (int, error) {
+	n, err := f.r.Read(b)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *forwardSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		offset += f.pos
+	}
+	if whence == io.SeekEnd || offset < f.pos {
+		return 0, errors.New("只能向前 seek")
+	}
+	n, err := f.r.Discard(int(offset - f.pos))
+	f.pos += int64(n)
+	return f.pos, err
+}
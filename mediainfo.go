@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 媒体信息：用 matroska.go 解析 MKV 头部得到时长、编码、分辨率、位深、
+// 音轨/字幕语言、章节和附件，按文件缓存在 data/mediainfo.json。
+// 剧集接口只返回已缓存的结果，没缓存的放进后台队列慢慢探测
+
+const mediaInfoFile = "data/mediainfo.json"
+
+const (
+	mediaProbeWorkers = 2
+	mediaProbeTimeout = time.Minute
+	mediaProbeWindow  = 256 << 10        // 每次区间请求的大小
+	mediaRetryDelay   = 10 * time.Minute // 探测失败（网络错误等）后多久再试
+)
+
+type mediaEntry struct {
+	Size    int64      `json:"size"`
+	ModTime time.Time  `json:"mod_time"`
+	Info    *MediaInfo `json:"info,omitempty"`
+	Layout  mkvLayout  `json:"layout"`
+	Error   string     `json:"error,omitempty"` // 不是 MKV 或文件结构损坏，不再重试
+
+	Private []trackPrivate `json:"private,omitempty"` // 接口里不返回的解码参数
+}
+
+// trackPrivate 轨道的 CodecPrivate 和压缩设置，提取字幕等需要，单独存放
+type trackPrivate struct {
+	Number       int    `json:"number"`
+	CodecPrivate []byte `json:"codec_private,omitempty"`
+	CompAlgo     int    `json:"comp_algo"`
+	CompSettings []byte `json:"comp_settings,omitempty"`
+}
+
+// savePrivate 从解析结果里取出解码参数
+func (e *mediaEntry) savePrivate() {
+	e.Private = nil
+	for _, t := range e.Info.Tracks {
+		e.Private = append(e.Private, trackPrivate{t.Number, t.CodecPrivate, t.CompAlgo, t.CompSettings})
+	}
+}
+
+// restorePrivate 从缓存读出后把解码参数放回轨道
+func (e *mediaEntry) restorePrivate() {
+	for _, p := range e.Private {
+		for i := range e.Info.Tracks {
+			if t := &e.Info.Tracks[i]; t.Number == p.Number {
+				t.CodecPrivate, t.CompAlgo, t.CompSettings = p.CodecPrivate, p.CompAlgo, p.CompSettings
+			}
+		}
+	}
+}
+
+type mediaStore struct {
+	mu      sync.Mutex
+	path    string
+	data    map[string]*mediaEntry // 存储路径 -> 探测结果
+	failed  map[string]time.Time
+	queued  map[string]bool
+	queue   chan string
+	pending bool
+	flight  flightGroup
+}
+
+var mediaInfos *mediaStore
+
+func initMediaInfo() {
+	s := &mediaStore{
+		path:   mediaInfoFile,
+		data:   make(map[string]*mediaEntry),
+		failed: make(map[string]time.Time),
+		queued: make(map[string]bool),
+		queue:  make(chan string, 4096),
+	}
+	if data, err := os.ReadFile(s.path); err == nil {
+		if err := json.Unmarshal(data, &s.data); err != nil {
+			log.Fatalf("媒体信息缓存格式错误: %v", err)
+		}
+		for p, e := range s.data {
+			if e.Info != nil && e.Private == nil {
+				delete(s.data, p) // 旧版本缓存没有解码参数，重新探测
+			} else if e.Info != nil {
+				e.restorePrivate()
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("无法读取媒体信息缓存: %v", err)
+	}
+	for i := 0; i < mediaProbeWorkers; i++ {
+		go s.worker()
+	}
+	mediaInfos = s
+}
+
+// isMatroska 按扩展名判断是否值得探测
+func isMatroska(p string) bool {
+	ext := strings.ToLower(path.Ext(p))
+	return ext == ".mkv" || ext == ".mka" || ext == ".webm"
+}
+
+// scheduleSave 延迟写盘，调用方持有 s.mu
+func (s *mediaStore) scheduleSave() {
+	if s.pending {
+		return
+	}
+	s.pending = true
+	time.AfterFunc(progressSaveDelay, func() {
+		s.mu.Lock()
+		s.pending = false
+		data, err := json.Marshal(s.data)
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+		tmp := s.path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			log.Printf("保存媒体信息缓存失败: %v", err)
+			return
+		}
+		os.Rename(tmp, s.path)
+	})
+}
+
+// Cached 返回已缓存的媒体信息，没有时返回 nil
+func (s *mediaStore) Cached(p string) *MediaInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.data[p]; e != nil {
+		return e.Info
+	}
+	return nil
+}
+
+// FileInfo 返回探测时记录的文件大小和修改时间
+func (s *mediaStore) FileInfo(p string) (FileInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.data[p]; e != nil {
+		return FileInfo{Size: e.Size, ModTime: e.ModTime}, true
+	}
+	return FileInfo{}, false
+}
+
+// Enqueue 把没缓存的文件放进后台探测队列，队列满时丢弃
+func (s *mediaStore) Enqueue(paths []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range paths {
+		if !isMatroska(p) || s.data[p] != nil || s.queued[p] || time.Since(s.failed[p]) < mediaRetryDelay {
+			continue
+		}
+		select {
+		case s.queue <- p:
+			s.queued[p] = true
+		default:
+			return
+		}
+	}
+}
+
+func (s *mediaStore) worker() {
+	for p := range s.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), mediaProbeTimeout)
+		if _, err := s.Probe(ctx, p); err != nil {
+			log.Printf("探测媒体信息失败 %s: %v", p, err)
+		}
+		cancel()
+		s.mu.Lock()
+		delete(s.queued, p)
+		s.mu.Unlock()
+	}
+}
+
+// Probe 返回文件的媒体信息，文件大小或修改时间变了才重新解析。
+// 解析结果在并发调用间共享，不跟随单个调用取消，ctx 只限制本次等待的时间
+func (s *mediaStore) Probe(ctx context.Context, p string) (*mediaEntry, error) {
+	v, err := s.flight.DoContext(ctx, p, s.probe(p))
+	if err != nil {
+		return nil, err
+	}
+	return v.(*mediaEntry), nil
+}
+
+// probe 实际读取并解析文件，使用独立的超时
+func (s *mediaStore) probe(p string) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), mediaProbeTimeout)
+		defer cancel()
+		info, err := storage.Stat(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		e := s.data[p]
+		s.mu.Unlock()
+		if e != nil && e.Size == info.Size && e.ModTime.Equal(info.ModTime) {
+			return e, nil
+		}
+
+		e = &mediaEntry{Size: info.Size, ModTime: info.ModTime}
+		f, err := parseMatroska(newRangeReader(ctx, p, info, mediaProbeWindow), info.Size)
+		if err != nil {
+			if ctx.Err() != nil || !errors.Is(err, errNotMatroska) && !errors.Is(err, errBadMatroska) {
+				s.mu.Lock()
+				s.failed[p] = time.Now()
+				s.mu.Unlock()
+				return nil, err
+			}
+			e.Error = err.Error()
+		} else {
+			e.Info, e.Layout = &f.Info, f.Layout
+			e.savePrivate()
+		}
+		s.mu.Lock()
+		s.data[p] = e
+		delete(s.failed, p)
+		s.scheduleSave()
+		s.mu.Unlock()
+		return e, nil
+	}
+}
+
+// 浏览器能直接解码的编码
+var (
+	browserVideoCodecs = map[string]bool{"AVC": true, "VP8": true, "VP9": true, "AV1": true}
+	browserAudioCodecs = map[string]bool{"AAC": true, "OPUS": true, "VORBIS": true, "FLAC": true, "MP3": true}
+)
+
+// playbackWarning 返回浏览器可能无法播放的原因，没有问题时为空
+func playbackWarning(m *MediaInfo) string {
+	var reasons []string
+	var hasAudio, audioOK bool
+	for _, t := range m.Tracks {
+		switch t.Type {
+		case "video":
+			if len(reasons) > 0 {
+				continue
+			}
+			switch {
+			case t.Codec == "HEVC" && t.BitDepth > 8:
+				reasons = append(reasons, fmt.Sprintf("HEVC %d-bit", t.BitDepth))
+			case t.Codec == "HEVC":
+				reasons = append(reasons, "HEVC")
+			case t.Codec == "AVC" && t.BitDepth > 8:
+				reasons = append(reasons, fmt.Sprintf("AVC %d-bit (Hi10P)", t.BitDepth))
+			case !browserVideoCodecs[t.Codec]:
+				reasons = append(reasons, t.Codec)
+			}
+		case "audio":
+			hasAudio = true
+			if browserAudioCodecs[t.Codec] {
+				audioOK = true
+			}
+		}
+	}
+	if hasAudio && !audioOK {
+		for _, t := range m.Tracks {
+			if t.Type == "audio" {
+				reasons = append(reasons, t.Codec+" 音频")
+				break
+			}
+		}
+	}
+	if len(reasons) == 0 {
+		return ""
+	}
+	return strings.Join(reasons, "、") + "，浏览器可能无法播放"
+}
+
+// episodeMedia 剧集接口里的媒体信息摘要
+type episodeMedia struct {
+	Duration          float64  `json:"duration"`
+	VideoCodec        string   `json:"video_codec,omitempty"`
+	Width             int      `json:"width,omitempty"`
+	Height            int      `json:"height,omitempty"`
+	BitDepth          int      `json:"bit_depth,omitempty"`
+	AudioCodecs       []string `json:"audio_codecs,omitempty"`
+	AudioLanguages    []string `json:"audio_languages,omitempty"`
+	SubtitleLanguages []string `json:"subtitle_languages,omitempty"`
+	Chapters          int      `json:"chapters,omitempty"`
+	Attachments       int      `json:"attachments,omitempty"`
+	Fonts             int      `json:"fonts,omitempty"` // 字体附件数，见 /api/anime/{id}/fonts
+	Warning           string   `json:"warning,omitempty"`
+	Remux             string   `json:"remux,omitempty"` // 可以转封装成 fMP4 时为 HLS 播放列表地址
+}
+
+func summarizeMedia(m *MediaInfo) *episodeMedia {
+	out := &episodeMedia{Duration: m.Duration, Chapters: len(m.Chapters), Attachments: len(m.Attachments), Warning: playbackWarning(m)}
+	for _, a := range m.Attachments {
+		if isFontAttachment(a) {
+			out.Fonts++
+		}
+	}
+	for _, t := range m.Tracks {
+		switch t.Type {
+		case "video":
+			if out.VideoCodec == "" {
+				out.VideoCodec, out.Width, out.Height, out.BitDepth = t.Codec, t.Width, t.Height, t.BitDepth
+			}
+		case "audio":
+			out.AudioCodecs = append(out.AudioCodecs, t.Codec)
+			out.AudioLanguages = append(out.AudioLanguages, t.Language)
+		case "subtitle":
+			out.SubtitleLanguages = append(out.SubtitleLanguages, t.Language)
+		}
+	}
+	return out
+}
+
+// annotateMedia 给剧集填上已缓存的媒体信息和内封字幕，返回还没探测过的路径
+func annotateMedia(episodes []EpisodeInfo) []string {
+	var missing []string
+	for i := range episodes {
+		if m := mediaInfos.Cached(episodes[i].Path); m != nil {
+			episodes[i].Media = summarizeMedia(m)
+			if remuxSupported(m) {
+				episodes[i].Media.Remux = remuxURL("index.m3u8", episodes[i].Path, 0)
+			}
+			if subs := embeddedSubtitles(episodes[i].Path, m); len(subs) > 0 {
+				episodes[i].Subtitles = append(episodes[i].Subtitles, subs...)
+				sort.SliceStable(episodes[i].Subtitles, func(a, b int) bool {
+					return subtitleLangRank(episodes[i].Subtitles[a].Lang) < subtitleLangRank(episodes[i].Subtitles[b].Lang)
+				})
+			}
+		} else {
+			missing = append(missing, episodes[i].Path)
+		}
+	}
+	return missing
+}
+
+// GET /api/mediainfo?path=... 立即探测单个文件，返回完整的轨道、章节和附件信息
+func handleMediaInfo(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		http.Error(w, "path required", 400)
+		return
+	}
+	if !isMatroska(p) {
+		http.Error(w, "只支持 MKV/WebM 文件", 415)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), mediaProbeTimeout)
+	defer cancel()
+	e, err := mediaInfos.Probe(ctx, p)
+	if err != nil {
+		upstreamError(w, p, err)
+		return
+	}
+	if e.Info == nil {
+		http.Error(w, e.Error, 422)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*MediaInfo
+		Warning string `json:"warning,omitempty"`
+	}{e.Info, playbackWarning(e.Info)})
+}
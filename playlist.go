@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 外部播放器：HEVC 10-bit、FLAC 之类浏览器放不了的资源，导出整季的 M3U8/XSPF 播放列表，
+// 并给出 mpv、VLC、PotPlayer、IINA 的唤起链接，一次打开整季。
+//   GET /api/anime/{id}/playlist.m3u8
+//   GET /api/anime/{id}/playlist.xspf
+//   GET /api/anime/{id}/players  播放列表地址和每集的唤起链接
+// 地址默认走 /api/stream 代理，长期有效；link=direct 时解析成网盘直链，签名链接会过期
+
+const playlistResolveJobs = 4
+
+// siteURL 站点对外的根地址，配置了 public_url 时以它为准；
+// X-Forwarded-Proto/Host 只在请求来自本机反向代理时采用，否则任何人都能改写播放列表里的地址
+func siteURL(r *http.Request) string {
+	if config.PublicURL != "" {
+		return strings.TrimSuffix(config.PublicURL, "/")
+	}
+	proxied := fromLocalProxy(r)
+	scheme := "http"
+	if r.TLS != nil || proxied && r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	host := r.Host
+	if h := r.Header.Get("X-Forwarded-Host"); proxied && h != "" {
+		host = h
+	}
+	return scheme + "://" + host
+}
+
+type playlistItem struct {
+	Title    string
+	URL      string
+	Duration float64 // 秒，未知为 0
+}
+
+// animeTitle 番剧显示名，优先中文名
+func animeTitle(a AnimeInfo) string {
+	if a.NameCN != "" {
+		return a.NameCN
+	}
+	return a.Name
+}
+
+// episodeTitle 播放列表里的标题，如“葬送的芙莉莲 第01集”
+func episodeTitle(anime string, ep EpisodeInfo) string {
+	label := ep.Label
+	if label == "" {
+		label = strings.TrimSuffix(ep.Name, path.Ext(ep.Name))
+	}
+	return anime + " " + label
+}
+
+// playlistItems 生成整季的播放列表项，direct 为 true 时并发解析直链，失败的回退到代理地址
+func playlistItems(ctx context.Context, base string, c *Catalog, id int, direct bool) (string, []playlistItem, bool) {
+	a, ok := c.animeByID[id]
+	if !ok {
+		return "", nil, false
+	}
+	_, episodes, ok := animeEpisodes(c, id)
+	if !ok {
+		return "", nil, false
+	}
+	title := animeTitle(a)
+	items := make([]playlistItem, len(episodes))
+	for i, ep := range episodes {
+		items[i] = playlistItem{Title: episodeTitle(title, ep), URL: base + streamURL(ep.Path)}
+		if m := mediaInfos.Cached(ep.Path); m != nil {
+			items[i].Duration = m.Duration
+		}
+	}
+	if direct && !config.StreamProxy {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, playlistResolveJobs)
+		for i, ep := range episodes {
+			wg.Add(1)
+			go func(i int, p string) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				if link, _, err := storage.Link(ctx, p); err == nil && link != "" {
+					items[i].URL = link
+				}
+			}(i, ep.Path)
+		}
+		wg.Wait()
+	}
+	return title, items, true
+}
+
+func writeM3U8(title string, items []playlistItem) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%s\n", title)
+	for _, it := range items {
+		dur := -1
+		if it.Duration > 0 {
+			dur = int(math.Round(it.Duration))
+		}
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", dur, it.Title, it.URL)
+	}
+	return b.String()
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+	TrackNum int    `xml:"trackNum"`
+	Duration int64  `xml:"duration,omitempty"` // 毫秒
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	NS      string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+func writeXSPF(title string, items []playlistItem) ([]byte, error) {
+	pl := xspfPlaylist{Version: "1", NS: "http://xspf.org/ns/0/", Title: title}
+	for i, it := range items {
+		pl.Tracks = append(pl.Tracks, xspfTrack{Location: it.URL, Title: it.Title, TrackNum: i + 1, Duration: int64(it.Duration * 1000)})
+	}
+	data, err := xml.MarshalIndent(pl, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// playerLinks 各播放器的唤起链接：IINA 为官方的 iina://weblink，PotPlayer 和 VLC 直接在地址前加协议，
+// mpv 没有官方协议，使用 mpv-handler 的 mpv://play/<base64url>
+func playerLinks(u string) map[string]string {
+	return map[string]string{
+		"mpv":       "mpv://play/" + base64.RawURLEncoding.EncodeToString([]byte(u)),
+		"vlc":       "vlc://" + u,
+		"potplayer": "potplayer://" + u,
+		"iina":      "iina://weblink?url=" + url.QueryEscape(u),
+	}
+}
+
+func handleAnimePlaylist(w http.ResponseWriter, r *http.Request, id int, format string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	direct := r.URL.Query().Get("link") == "direct"
+	title, items, ok := playlistItems(ctx, siteURL(r), currentCatalog(), id, direct)
+	if !ok {
+		http.Error(w, "anime not found", 404)
+		return
+	}
+	filename := url.PathEscape(title + "." + format)
+	w.Header().Set("Content-Disposition", "inline; filename*=UTF-8''"+filename)
+	w.Header().Set("Cache-Control", "no-store")
+	switch format {
+	case "m3u8":
+		w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+		w.Write([]byte(writeM3U8(title, items)))
+	case "xspf":
+		data, err := writeXSPF(title, items)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xspf+xml; charset=utf-8")
+		w.Write(data)
+	}
+}
+
+type playerEpisode struct {
+	Label string            `json:"label"`
+	Path  string            `json:"path"`
+	URL   string            `json:"url"`
+	Links map[string]string `json:"links"`
+}
+
+// GET /api/anime/{id}/players
+func handleAnimePlayers(w http.ResponseWriter, r *http.Request, id int) {
+	base := siteURL(r)
+	c := currentCatalog()
+	if _, ok := c.animeByID[id]; !ok {
+		http.Error(w, "anime not found", 404)
+		return
+	}
+	_, episodes, ok := animeEpisodes(c, id)
+	if !ok {
+		http.Error(w, "anime not found", 404)
+		return
+	}
+	m3u8 := fmt.Sprintf("%s/api/anime/%d/playlist.m3u8", base, id)
+	xspf := fmt.Sprintf("%s/api/anime/%d/playlist.xspf", base, id)
+	out := struct {
+		M3U8     string            `json:"m3u8"`
+		XSPF     string            `json:"xspf"`
+		Links    map[string]string `json:"links"` // 用播放列表打开整季
+		Episodes []playerEpisode   `json:"episodes"`
+	}{M3U8: m3u8, XSPF: xspf, Links: playerLinks(m3u8), Episodes: []playerEpisode{}}
+	for _, ep := range episodes {
+		u := base + streamURL(ep.Path)
+		out.Episodes = append(out.Episodes, playerEpisode{Label: ep.Label, Path: ep.Path, URL: u, Links: playerLinks(u)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
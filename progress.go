@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 观看进度：按用户、番剧、剧集文件记录播放位置，超过阈值记为看过
+// 播放器每隔几秒上报一次，写盘合并为每 5 秒一次
+
+const progressFile = "data/progress.json"
+
+const progressSaveDelay = 5 * time.Second
+
+type episodeProgress struct {
+	Position  float64   `json:"position"` // 秒
+	Duration  float64   `json:"duration"`
+	Watched   bool      `json:"watched"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type animeProgress struct {
+	LastEpisode string                      `json:"last_episode"` // 最近播放的剧集文件名
+	UpdatedAt   time.Time                   `json:"updated_at"`
+	Episodes    map[string]*episodeProgress `json:"episodes"` // 文件名 -> 进度
+}
+
+type progressStore struct {
+	mu      sync.Mutex
+	path    string
+	data    map[int]map[int]*animeProgress // 用户 ID -> 番剧 ID -> 进度
+	pending bool
+}
+
+var progress *progressStore
+
+func initProgress() {
+	s := &progressStore{path: progressFile, data: make(map[int]map[int]*animeProgress)}
+	if data, err := os.ReadFile(s.path); err == nil {
+		if err := json.Unmarshal(data, &s.data); err != nil {
+			log.Fatalf("观看进度格式错误: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("无法读取观看进度: %v", err)
+	}
+	progress = s
+}
+
+func watchedRatio() float64 {
+	if config.WatchedRatio > 0 && config.WatchedRatio <= 1 {
+		return config.WatchedRatio
+	}
+	return 0.9
+}
+
+// scheduleSave 延迟写盘，调用方持有 s.mu
+func (s *progressStore) scheduleSave() {
+	if s.pending {
+		return
+	}
+	s.pending = true
+	time.AfterFunc(progressSaveDelay, func() {
+		s.mu.Lock()
+		s.pending = false
+		data, err := json.Marshal(s.data)
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+		tmp := s.path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			log.Printf("保存观看进度失败: %v", err)
+			return
+		}
+		os.Rename(tmp, s.path)
+	})
+}
+
+// Update 记录播放位置，position 为负数时不修改；watched 不为 nil 时手动标记看过/未看
+func (s *progressStore) Update(userID, animeID int, episode string, position, duration float64, watched *bool) episodeProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byAnime := s.data[userID]
+	if byAnime == nil {
+		byAnime = make(map[int]*animeProgress)
+		s.data[userID] = byAnime
+	}
+	ap := byAnime[animeID]
+	if ap == nil {
+		ap = &animeProgress{Episodes: make(map[string]*episodeProgress)}
+		byAnime[animeID] = ap
+	}
+	ep := ap.Episodes[episode]
+	if ep == nil {
+		ep = &episodeProgress{}
+		ap.Episodes[episode] = ep
+	}
+
+	now := time.Now()
+	if position >= 0 {
+		ep.Position = position
+	}
+	if duration > 0 {
+		ep.Duration = duration
+	}
+	if watched != nil {
+		ep.Watched = *watched
+		if !*watched {
+			ep.Position = 0
+		}
+	} else if ep.Duration > 0 && ep.Position >= ep.Duration*watchedRatio() {
+		ep.Watched = true
+	}
+	ep.UpdatedAt = now
+	ap.LastEpisode, ap.UpdatedAt = episode, now
+	s.scheduleSave()
+	return *ep
+}
+
+func (s *progressStore) Anime(userID, animeID int) map[string]episodeProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]episodeProgress)
+	if ap := s.data[userID][animeID]; ap != nil {
+		for name, ep := range ap.Episodes {
+			out[name] = *ep
+		}
+	}
+	return out
+}
+
+// annotate 给剧集列表填上看过标记和上次播放位置
+func (s *progressStore) annotate(userID, animeID int, episodes []EpisodeInfo) {
+	eps := s.Anime(userID, animeID)
+	for i := range episodes {
+		if ep, ok := eps[episodes[i].Name]; ok {
+			episodes[i].Watched = ep.Watched
+			if !ep.Watched {
+				episodes[i].Position = ep.Position
+			}
+		}
+	}
+}
+
+type continueItem struct {
+	Anime       AnimeInfo   `json:"anime"`
+	Episode     EpisodeInfo `json:"episode"` // 下一集未看完的剧集，Position 为续播位置
+	LastEpisode string      `json:"last_episode"`
+	Watched     int         `json:"watched"`
+	Total       int         `json:"total"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// continueWatching 按最近观看排序，跳过已全部看完的番剧
+func (s *progressStore) continueWatching(c *Catalog, userID int) []continueItem {
+	s.mu.Lock()
+	type entry struct {
+		animeID int
+		last    string
+		at      time.Time
+	}
+	var entries []entry
+	for id, ap := range s.data[userID] {
+		entries = append(entries, entry{id, ap.LastEpisode, ap.UpdatedAt})
+	}
+	s.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].at.After(entries[j].at) })
+
+	items := []continueItem{}
+	for _, e := range entries {
+		a, ok := c.animeByID[e.animeID]
+		if !ok {
+			continue
+		}
+		_, episodes, ok := animeEpisodes(c, e.animeID)
+		if !ok || len(episodes) == 0 {
+			continue
+		}
+		s.annotate(userID, e.animeID, episodes)
+
+		// 上次看的那集没看完就继续它，否则找它之后第一集没看过的
+		next := -1
+		for i, ep := range episodes {
+			if ep.Name == e.last {
+				if !ep.Watched {
+					next = i
+				} else {
+					for j := i + 1; j < len(episodes); j++ {
+						if !episodes[j].Watched {
+							next = j
+							break
+						}
+					}
+				}
+				break
+			}
+		}
+		if next < 0 {
+			continue
+		}
+		watched := 0
+		for _, ep := range episodes {
+			if ep.Watched {
+				watched++
+			}
+		}
+		a.HasResource = true
+		items = append(items, continueItem{
+			Anime: a, Episode: episodes[next], LastEpisode: e.last,
+			Watched: watched, Total: len(episodes), UpdatedAt: e.at,
+		})
+	}
+	return items
+}
+
+// GET /api/progress?anime_id=1 查询进度；
+// POST {"anime_id": 1, "episode": "文件名", "position": 120, "duration": 1440, "watched": true} 上报进度
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		id, _ := strconv.Atoi(r.URL.Query().Get("anime_id"))
+		if id == 0 {
+			http.Error(w, "anime_id required", 400)
+			return
+		}
+		json.NewEncoder(w).Encode(progress.Anime(u.ID, id))
+	case http.MethodPost:
+		var req struct {
+			AnimeID  int      `json:"anime_id"`
+			Episode  string   `json:"episode"`
+			Position *float64 `json:"position"`
+			Duration float64  `json:"duration"`
+			Watched  *bool    `json:"watched"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "invalid request", 400)
+			return
+		}
+		c := currentCatalog()
+		if _, ok := c.animeByID[req.AnimeID]; !ok || !containsString(c.Episodes[req.AnimeID], req.Episode) {
+			http.Error(w, "unknown episode", 404)
+			return
+		}
+		position := -1.0
+		if req.Position != nil {
+			position = *req.Position
+		}
+		json.NewEncoder(w).Encode(progress.Update(u.ID, req.AnimeID, req.Episode, position, req.Duration, req.Watched))
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+// 继续观看列表
+func handleContinueWatching(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	items := progress.continueWatching(currentCatalog(), u.ID)
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// 相似番剧推荐：标签重合度（按稀有度加权）为主，评分、年份接近程度和 Bangumi 关联为辅
+
+// 各因素的权重
+const (
+	similarTagWeight      = 0.6
+	similarScoreWeight    = 0.15
+	similarYearWeight     = 0.1
+	similarRelationWeight = 0.25
+)
+
+type similarAnime struct {
+	AnimeInfo
+	Similarity float64  `json:"similarity"`
+	SharedTags []string `json:"shared_tags"`
+	Relation   string   `json:"relation,omitempty"`
+}
+
+// buildTagWeights 计算每个标签的 IDF，"TV"、"日本" 这类几乎人人都有的标签权重接近 0
+func buildTagWeights(c *Catalog) {
+	df := make(map[string]int)
+	for _, a := range c.AnimeDB {
+		for _, t := range a.Tags {
+			df[t]++
+		}
+	}
+	n := float64(len(c.AnimeDB))
+	c.tagWeight = make(map[string]float64, len(df))
+	for t, k := range df {
+		c.tagWeight[t] = math.Log(n / float64(k))
+	}
+}
+
+func (c *Catalog) tagNorm(a AnimeInfo) float64 {
+	sum := 0.0
+	for _, t := range a.Tags {
+		sum += c.tagWeight[t] * c.tagWeight[t]
+	}
+	return math.Sqrt(sum)
+}
+
+// similarTo 返回与 id 相似的番剧，同系列的作品不算推荐，每个系列只出现一次
+func (c *Catalog) similarTo(id int, onlyAvailable bool) []similarAnime {
+	src, ok := c.animeByID[id]
+	if !ok {
+		return nil
+	}
+	srcNorm := c.tagNorm(src)
+	related := make(map[int]string)
+	for _, r := range c.Relations[id] {
+		related[r.ID] = r.Relation
+	}
+	srcFranchise := c.franchiseKey(id)
+
+	var list []similarAnime
+	for _, a := range c.AnimeDB {
+		if a.ID == id || c.franchiseKey(a.ID) == srcFranchise {
+			continue
+		}
+		a.HasResource = c.Mapping[a.ID]
+		if onlyAvailable && !a.HasResource {
+			continue
+		}
+
+		var shared []string
+		dot := 0.0
+		for _, t := range a.Tags {
+			if containsString(src.Tags, t) {
+				shared = append(shared, t)
+				dot += c.tagWeight[t] * c.tagWeight[t]
+			}
+		}
+		rel := related[a.ID]
+		if dot == 0 && rel == "" {
+			continue
+		}
+
+		sim := 0.0
+		if norm := srcNorm * c.tagNorm(a); norm > 0 {
+			sim += similarTagWeight * dot / norm
+		}
+		sim += similarScoreWeight * a.Score / 10
+		sim += similarYearWeight * math.Exp(-math.Abs(float64(a.Year-src.Year))/5)
+		if rel != "" {
+			sim += similarRelationWeight
+		}
+
+		c.setFranchise(&a)
+		list = append(list, similarAnime{AnimeInfo: a, Similarity: math.Round(sim*1000) / 1000, SharedTags: shared, Relation: rel})
+	}
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Similarity > list[j].Similarity })
+	out := list[:0]
+	seen := make(map[int]bool)
+	for _, s := range list {
+		key := c.franchiseKey(s.ID)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, s)
+	}
+	return out
+}
+
+// /api/anime/{id}/similar?limit=12&all=1，默认只推荐有资源的番剧
+func handleAnimeSimilar(w http.ResponseWriter, r *http.Request, id int) {
+	c := currentCatalog()
+	if _, ok := c.animeByID[id]; !ok {
+		http.Error(w, "anime not found", 404)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 50 {
+		limit = 12
+	}
+	all := r.URL.Query().Get("all") == "1"
+
+	results := c.similarTo(id, !all)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	if results == nil {
+		results = []similarAnime{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "data": results})
+}
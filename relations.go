@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 系列作品：根据 tools/fetch_relations.go 抓取的 Bangumi 关联条目，
+// 把续集、剧场版、OVA 等归为同一系列，并给出观看顺序
+
+const animeRelationsFile = "data/anime_relations.json"
+
+type Relation struct {
+	ID       int    `json:"id"`
+	Relation string `json:"relation"`
+	Name     string `json:"name"`
+	NameCN   string `json:"name_cn"`
+	Cover    string `json:"cover,omitempty"`
+}
+
+// 以下关系视为同一系列；相同世界观、角色出演等只作为相关推荐
+var franchiseRelations = map[string]bool{
+	"前传": true, "续集": true, "番外篇": true, "总集篇": true, "主线故事": true, "全集": true,
+}
+
+// FranchiseEntry 是观看顺序中的一项，不在番剧库中的条目 InCatalog 为 false
+type FranchiseEntry struct {
+	ID          int     `json:"id"`
+	Name        string  `json:"name"`
+	NameCN      string  `json:"name_cn"`
+	Date        string  `json:"date,omitempty"`
+	Cover       string  `json:"cover,omitempty"`
+	Score       float64 `json:"score,omitempty"`
+	Relation    string  `json:"relation,omitempty"` // 相对于所查询条目的关系
+	InCatalog   bool    `json:"in_catalog"`
+	HasResource bool    `json:"has_resource"`
+}
+
+// 关系文件可选，缺失时不分组
+func loadAnimeRelations(c *Catalog) error {
+	c.Relations = make(map[int][]Relation)
+	c.Franchise = make(map[int][]int)
+	data, err := os.ReadFile(animeRelationsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("无法加载关联数据: %v", err)
+	}
+	if err := json.Unmarshal(data, &c.Relations); err != nil {
+		return fmt.Errorf("关联数据格式错误: %v", err)
+	}
+	buildFranchises(c)
+	return nil
+}
+
+// buildFranchises 用并查集把有系列关系的条目连起来，每个系列按观看顺序排列
+func buildFranchises(c *Catalog) {
+	parent := make(map[int]int)
+	var find func(int) int
+	find = func(x int) int {
+		if p, ok := parent[x]; ok && p != x {
+			parent[x] = find(p)
+			return parent[x]
+		}
+		parent[x] = x
+		return x
+	}
+	names := make(map[int]Relation)
+	for id, rels := range c.Relations {
+		find(id)
+		for _, r := range rels {
+			if !franchiseRelations[r.Relation] {
+				continue
+			}
+			names[r.ID] = r
+			parent[find(r.ID)] = find(id)
+		}
+	}
+
+	groups := make(map[int][]int)
+	for id := range parent {
+		root := find(id)
+		groups[root] = append(groups[root], id)
+	}
+	c.franchiseNames = names
+	for _, ids := range groups {
+		if len(ids) < 2 {
+			continue
+		}
+		order := watchOrder(c, ids)
+		for _, id := range order {
+			c.Franchise[id] = order
+		}
+	}
+}
+
+// watchOrder 按前传/续集关系拓扑排序，无先后约束时按首播日期
+func watchOrder(c *Catalog, ids []int) []int {
+	member := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		member[id] = true
+	}
+	after := make(map[int]map[int]bool) // a -> 必须在 a 之后看的条目
+	indeg := make(map[int]int)
+	edge := func(a, b int) {
+		if a == b || !member[a] || !member[b] {
+			return
+		}
+		if after[a] == nil {
+			after[a] = make(map[int]bool)
+		}
+		if !after[a][b] {
+			after[a][b] = true
+			indeg[b]++
+		}
+	}
+	for _, id := range ids {
+		for _, r := range c.Relations[id] {
+			switch r.Relation {
+			case "续集", "番外篇", "总集篇":
+				edge(id, r.ID)
+			case "前传", "主线故事":
+				edge(r.ID, id)
+			}
+		}
+	}
+
+	// 库外条目没有日期，取前一部的日期，排在它之后
+	dates := make(map[int]string, len(ids))
+	for _, id := range ids {
+		if a, ok := c.animeByID[id]; ok && a.Date != "" {
+			dates[id] = a.Date
+		}
+	}
+	inherited := make(map[int]string)
+	for a, next := range after {
+		for b := range next {
+			if _, ok := dates[b]; !ok && dates[a] != "" && dates[a]+"~" > inherited[b] {
+				inherited[b] = dates[a] + "~"
+			}
+		}
+	}
+	for id, d := range inherited {
+		dates[id] = d
+	}
+	date := func(id int) string {
+		if d, ok := dates[id]; ok {
+			return d
+		}
+		return "9999"
+	}
+	less := func(a, b int) bool {
+		if da, db := date(a), date(b); da != db {
+			return da < db
+		}
+		return a < b
+	}
+
+	var order, ready []int
+	for _, id := range ids {
+		if indeg[id] == 0 {
+			ready = append(ready, id)
+		}
+	}
+	done := make(map[int]bool)
+	for len(order) < len(ids) {
+		if len(ready) == 0 {
+			// 关系成环，剩下的按日期排
+			for _, id := range ids {
+				if !done[id] {
+					ready = append(ready, id)
+				}
+			}
+		}
+		sort.Slice(ready, func(i, j int) bool { return less(ready[i], ready[j]) })
+		id := ready[0]
+		ready = ready[1:]
+		if done[id] {
+			continue
+		}
+		done[id] = true
+		order = append(order, id)
+		for next := range after[id] {
+			indeg[next]--
+			if indeg[next] == 0 && !done[next] {
+				ready = append(ready, next)
+			}
+		}
+	}
+	return order
+}
+
+// franchiseKey 返回系列中第一部在库条目的 ID，不属于任何系列时返回自身
+func (c *Catalog) franchiseKey(id int) int {
+	for _, fid := range c.Franchise[id] {
+		if _, ok := c.animeByID[fid]; ok {
+			return fid
+		}
+	}
+	return id
+}
+
+func (c *Catalog) setFranchise(a *AnimeInfo) {
+	if order := c.Franchise[a.ID]; len(order) > 0 {
+		a.Franchise = c.franchiseKey(a.ID)
+		a.FranchiseSize = len(order)
+	}
+}
+
+// groupByFranchise 保持原有顺序，每个系列只保留第一次出现的条目
+func groupByFranchise(list []AnimeInfo) []AnimeInfo {
+	seen := make(map[int]bool)
+	out := list[:0]
+	for _, a := range list {
+		if a.Franchise != 0 {
+			if seen[a.Franchise] {
+				continue
+			}
+			seen[a.Franchise] = true
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+func (c *Catalog) franchiseEntry(id int) FranchiseEntry {
+	if a, ok := c.animeByID[id]; ok {
+		return FranchiseEntry{
+			ID: a.ID, Name: a.Name, NameCN: a.NameCN, Date: a.Date, Cover: a.Cover,
+			Score: a.Score, InCatalog: true, HasResource: c.Mapping[a.ID],
+		}
+	}
+	r := c.franchiseNames[id]
+	return FranchiseEntry{ID: id, Name: r.Name, NameCN: r.NameCN, Cover: r.Cover, HasResource: c.Mapping[id]}
+}
+
+// /api/anime/{id} 单部番剧详情，/api/anime/{id}/related 系列观看顺序和其他相关条目，
+// /api/anime/{id}/similar 相似推荐，其余子资源见 fonts.go、playlist.go
+func handleAnimeSubresource(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/anime/")
+	idStr, sub, _ := strings.Cut(rest, "/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	switch sub {
+	case "":
+		c := currentCatalog()
+		a, ok := c.animeByID[id]
+		if !ok {
+			http.Error(w, "anime not found", 404)
+			return
+		}
+		a.HasResource = c.Mapping[a.ID]
+		c.setFranchise(&a)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+	case "related":
+		handleAnimeRelated(w, r, id)
+	case "similar":
+		handleAnimeSimilar(w, r, id)
+	case "fonts":
+		handleAnimeFonts(w, r, id)
+	case "playlist.m3u8":
+		handleAnimePlaylist(w, r, id, "m3u8")
+	case "playlist.xspf":
+		handleAnimePlaylist(w, r, id, "xspf")
+	case "players":
+		handleAnimePlayers(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func handleAnimeRelated(w http.ResponseWriter, r *http.Request, id int) {
+	c := currentCatalog()
+	if _, ok := c.animeByID[id]; !ok {
+		http.Error(w, "anime not found", 404)
+		return
+	}
+
+	direct := make(map[int]string)
+	for _, rel := range c.Relations[id] {
+		direct[rel.ID] = rel.Relation
+	}
+
+	franchise := []FranchiseEntry{}
+	inFranchise := make(map[int]bool)
+	for _, fid := range c.Franchise[id] {
+		e := c.franchiseEntry(fid)
+		e.Relation = direct[fid]
+		if fid == id {
+			e.Relation = "本作"
+		}
+		franchise = append(franchise, e)
+		inFranchise[fid] = true
+	}
+
+	// 同一世界观、衍生作品等不算系列，单独列出
+	others := []FranchiseEntry{}
+	for _, rel := range c.Relations[id] {
+		if inFranchise[rel.ID] {
+			continue
+		}
+		e := FranchiseEntry{ID: rel.ID, Name: rel.Name, NameCN: rel.NameCN, Cover: rel.Cover, Relation: rel.Relation, HasResource: c.Mapping[rel.ID]}
+		if a, ok := c.animeByID[rel.ID]; ok {
+			e.Date, e.Score, e.InCatalog = a.Date, a.Score, true
+		}
+		others = append(others, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":        id,
+		"franchise": franchise,
+		"related":   others,
+	})
+}
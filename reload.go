@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	animeDBFile      = "data/anime_db.json"
+	animeMappingFile = "data/anime_mapping_onedrive.json"
+)
+
+// 番剧数据快照，重新加载时整体替换，处理中的请求始终看到同一份数据
+type Catalog struct {
+	AnimeDB    []AnimeInfo
+	Mapping    map[int]bool       // Bangumi ID -> 是否有资源
+	FolderPath map[int]string     // Bangumi ID -> 文件夹路径
+	Episodes   map[int][]string   // Bangumi ID -> 视频文件列表
+	Subtitles  map[int][]string   // Bangumi ID -> 外挂字幕文件列表
+	Relations  map[int][]Relation // Bangumi ID -> 关联条目
+	Franchise  map[int][]int      // Bangumi ID -> 所在系列的观看顺序
+	Search     *searchIndex
+	LoadedAt   time.Time
+
+	animeByID      map[int]AnimeInfo
+	franchiseNames map[int]Relation // 系列中不在番剧库里的条目
+	tagWeight      map[string]float64
+}
+
+var catalog atomic.Pointer[Catalog]
+var reloadMu sync.Mutex
+
+func currentCatalog() *Catalog {
+	return catalog.Load()
+}
+
+// loadCatalog 读取全部数据文件，出错时仍返回已加载的部分
+func loadCatalog() (*Catalog, error) {
+	c := &Catalog{LoadedAt: time.Now()}
+	var errs []string
+	if err := loadAnimeDB(c); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := loadAnimeMapping(c); err != nil {
+		errs = append(errs, err.Error())
+	}
+	c.animeByID = make(map[int]AnimeInfo, len(c.AnimeDB))
+	for _, a := range c.AnimeDB {
+		c.animeByID[a.ID] = a
+	}
+	if err := loadAnimeRelations(c); err != nil {
+		errs = append(errs, err.Error())
+	}
+	buildTagWeights(c)
+	c.Search = buildSearchIndex(c)
+	if len(errs) > 0 {
+		return c, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return c, nil
+}
+
+// reloadCatalog 重新加载数据文件，任一文件有问题则保留旧数据
+func reloadCatalog(reason string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	c, err := loadCatalog()
+	if err != nil {
+		log.Printf("重新加载失败 (%s)，继续使用旧数据: %v", reason, err)
+		return err
+	}
+	catalog.Store(c)
+	log.Printf("已重新加载数据 (%s): %d 部番剧，%d 条资源映射", reason, len(c.AnimeDB), len(c.Mapping))
+	return nil
+}
+
+// watchReload 监听 SIGHUP，并按配置轮询数据文件修改时间
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadCatalog("SIGHUP")
+		}
+	}()
+
+	if config.ReloadInterval <= 0 {
+		return
+	}
+	go func() {
+		last := dataFilesStamp()
+		for range time.Tick(time.Duration(config.ReloadInterval) * time.Second) {
+			stamp := dataFilesStamp()
+			if stamp == last {
+				continue
+			}
+			// 失败时也记下时间戳，避免对同一个坏文件反复报错
+			last = stamp
+			reloadCatalog("文件变更")
+		}
+	}()
+}
+
+// 数据文件的修改时间和大小
+func dataFilesStamp() string {
+	var parts []string
+	for _, f := range []string{animeDBFile, animeMappingFile, animeRelationsFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			parts = append(parts, f+":missing")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", f, info.ModTime().UnixNano(), info.Size()))
+	}
+	return strings.Join(parts, "|")
+}
+
+// 管理接口令牌校验：Authorization: Bearer <token> 或 X-Admin-Token
+func checkAdminToken(r *http.Request) bool {
+	if config.AdminToken == "" {
+		return false
+	}
+	token := r.Header.Get("X-Admin-Token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// 手动触发重新加载
+func handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if err := reloadCatalog("管理接口"); err != nil {
+		http.Error(w, err.Error(), 422)
+		return
+	}
+	c := currentCatalog()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"anime":     len(c.AnimeDB),
+		"mappings":  len(c.Mapping),
+		"loaded_at": c.LoadedAt,
+	})
+}
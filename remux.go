@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 转封装：把 H.264/AAC 的 MKV 按 Cues 里的视频关键帧切成 fMP4 分段，以 HLS 播放列表的形式提供，
+// 不转码也不依赖 ffmpeg。分段按需生成，只读取该段涉及的 Cluster，拖动进度时播放器直接请求对应的分段。
+//   GET /api/remux/index.m3u8?path=...  播放列表
+//   GET /api/remux/init.mp4?path=...    初始化分段（ftyp + moov）
+//   GET /api/remux/segment.m4s?path=...&n=3
+// 都可以带 audio=<轨道编号> 选择音轨，默认取第一条 AAC 音轨
+
+const (
+	remuxSegmentTarget = 6 * time.Second // 分段最短时长，实际在下一个关键帧处切分
+	remuxTimeout       = 2 * time.Minute
+	remuxReadWindow    = 1 << 20
+	remuxVideoScale    = 90000
+	remuxIndexTTL      = time.Hour
+	remuxIndexSize     = 50
+)
+
+var (
+	errRemuxUnsupported = errors.New("不支持转封装")
+	errRemuxNoIndex     = errors.New("文件没有关键帧索引（Cues），无法分段")
+)
+
+// remuxSegment 一个分段，时间为 TimestampScale 单位
+type remuxSegment struct {
+	Start   int64
+	End     int64
+	Cluster int64 // 起始关键帧所在 Cluster 的位置
+}
+
+type remuxIndex struct {
+	info     FileInfo
+	layout   mkvLayout
+	video    *MediaTrack
+	audio    *MediaTrack
+	audioASC []byte
+	segments []remuxSegment
+	at       time.Time
+}
+
+var (
+	remuxIndexMu sync.Mutex
+	remuxIndexes = make(map[string]*remuxIndex)
+	remuxFlight  flightGroup
+)
+
+// remuxTracks 选出可以转封装的视频和音轨，浏览器无法解码时返回原因
+func remuxTracks(m *MediaInfo, audioTrack int) (video, audio *MediaTrack, err error) {
+	var audios []*MediaTrack
+	for i := range m.Tracks {
+		t := &m.Tracks[i]
+		switch t.Type {
+		case "video":
+			if video == nil {
+				video = t
+			}
+		case "audio":
+			audios = append(audios, t)
+		}
+	}
+	if video == nil {
+		return nil, nil, fmt.Errorf("%w: 没有视频轨", errRemuxUnsupported)
+	}
+	if video.Codec != "AVC" {
+		return nil, nil, fmt.Errorf("%w: 视频编码为 %s，浏览器只能解码 H.264", errRemuxUnsupported, video.Codec)
+	}
+	if video.BitDepth > 8 {
+		return nil, nil, fmt.Errorf("%w: H.264 %d-bit (Hi10P) 浏览器无法解码", errRemuxUnsupported, video.BitDepth)
+	}
+	if len(video.CodecPrivate) == 0 {
+		return nil, nil, fmt.Errorf("%w: 视频轨缺少 avcC", errRemuxUnsupported)
+	}
+	for _, t := range audios {
+		if audioTrack > 0 && t.Number != audioTrack {
+			continue
+		}
+		if t.Codec == "AAC" {
+			return video, t, nil
+		}
+		if audioTrack > 0 {
+			return nil, nil, fmt.Errorf("%w: 音轨 %d 为 %s，只支持 AAC", errRemuxUnsupported, t.Number, t.Codec)
+		}
+	}
+	if audioTrack > 0 {
+		return nil, nil, fmt.Errorf("没有音轨 %d", audioTrack)
+	}
+	if len(audios) > 0 {
+		return nil, nil, fmt.Errorf("%w: 音频编码为 %s，只支持 AAC", errRemuxUnsupported, audios[0].Codec)
+	}
+	return video, nil, nil
+}
+
+// remuxSupported 剧集接口用来判断是否提供转封装地址
+func remuxSupported(m *MediaInfo) bool {
+	_, _, err := remuxTracks(m, 0)
+	return err == nil
+}
+
+func remuxURL(name, p string, audio int) string {
+	q := url.Values{"path": {p}}
+	if audio > 0 {
+		q.Set("audio", strconv.Itoa(audio))
+	}
+	return "/api/remux/" + name + "?" + q.Encode()
+}
+
+// aacConfig 返回 AudioSpecificConfig，老式 A_AAC/MPEG4/LC 之类的轨道没有 CodecPrivate，按编码 ID 生成
+func aacConfig(t *MediaTrack) []byte {
+	if len(t.CodecPrivate) >= 2 {
+		return t.CodecPrivate
+	}
+	profile := 2 // LC
+	if strings.Contains(t.CodecID, "/MAIN") {
+		profile = 1
+	}
+	freqs := []float64{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+	idx := 4
+	for i, f := range freqs {
+		if f == t.SampleRate {
+			idx = i
+		}
+	}
+	channels := t.Channels
+	if channels == 0 {
+		channels = 2
+	}
+	return []byte{byte(profile<<3 | idx>>1), byte(idx&1<<7 | channels<<3)}
+}
+
+// aacSampleRate 从 AudioSpecificConfig 读出采样率，作为音轨的时间单位
+func aacSampleRate(asc []byte, fallback float64) uint32 {
+	freqs := []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+	if len(asc) >= 2 {
+		if idx := int(asc[0]&0x07)<<1 | int(asc[1]>>7); idx < len(freqs) {
+			return freqs[idx]
+		}
+	}
+	if fallback > 0 {
+		return uint32(fallback)
+	}
+	return 48000
+}
+
+// loadRemuxIndex 读取 Cues，按视频关键帧切分成分段，结果在内存里缓存一小时。
+// 同一文件的并发请求共享一次读取，不跟随单个请求取消，ctx 只限制本次等待的时间
+func loadRemuxIndex(ctx context.Context, p string, audioTrack int) (*remuxIndex, error) {
+	key := strconv.Itoa(audioTrack) + "\x00" + p
+	remuxIndexMu.Lock()
+	if idx := remuxIndexes[key]; idx != nil && time.Since(idx.at) < remuxIndexTTL {
+		remuxIndexMu.Unlock()
+		return idx, nil
+	}
+	remuxIndexMu.Unlock()
+
+	v, err := remuxFlight.DoContext(ctx, key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), remuxTimeout)
+		defer cancel()
+		e, err := mediaInfos.Probe(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		if e.Info == nil {
+			return nil, fmt.Errorf("%w: %s", errRemuxUnsupported, e.Error)
+		}
+		video, audio, err := remuxTracks(e.Info, audioTrack)
+		if err != nil {
+			return nil, err
+		}
+		idx := &remuxIndex{info: FileInfo{Size: e.Size, ModTime: e.ModTime}, layout: e.Layout, video: video, audio: audio, at: time.Now()}
+		if audio != nil {
+			idx.audioASC = aacConfig(audio)
+		}
+
+		cues, err := readCues(&rangeReader{ctx: ctx, path: p, info: idx.info, window: mediaProbeWindow, direct: true}, e.Layout)
+		if err != nil {
+			return nil, err
+		}
+		scale := float64(e.Layout.TimestampScale)
+		target := int64(float64(remuxSegmentTarget) / scale)
+		end := int64(e.Info.Duration * 1e9 / scale)
+		for _, c := range cues {
+			if c.Track != video.Number {
+				continue
+			}
+			n := len(idx.segments)
+			if n > 0 && c.Time-idx.segments[n-1].Start < target {
+				continue
+			}
+			if n > 0 {
+				idx.segments[n-1].End = c.Time
+			}
+			idx.segments = append(idx.segments, remuxSegment{Start: c.Time, Cluster: c.Cluster})
+		}
+		if len(idx.segments) == 0 {
+			return nil, errRemuxNoIndex
+		}
+		last := &idx.segments[len(idx.segments)-1]
+		last.End = max(end, last.Start+1)
+
+		remuxIndexMu.Lock()
+		if len(remuxIndexes) >= remuxIndexSize {
+			var oldest string
+			for k, v := range remuxIndexes {
+				if oldest == "" || v.at.Before(remuxIndexes[oldest].at) {
+					oldest = k
+				}
+			}
+			delete(remuxIndexes, oldest)
+		}
+		remuxIndexes[key] = idx
+		remuxIndexMu.Unlock()
+		return idx, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*remuxIndex), nil
+}
+
+func (idx *remuxIndex) seconds(t int64) float64 {
+	return float64(t) * float64(idx.layout.TimestampScale) / 1e9
+}
+
+func (idx *remuxIndex) playlist(p string, audio int) string {
+	var b strings.Builder
+	maxDur := 0.0
+	for _, s := range idx.segments {
+		maxDur = math.Max(maxDur, idx.seconds(s.End-s.Start))
+	}
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:%d\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-INDEPENDENT-SEGMENTS\n", int(math.Ceil(maxDur)))
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\"\n", remuxURL("init.mp4", p, audio))
+	for i, s := range idx.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s&n=%d\n", idx.seconds(s.End-s.Start), remuxURL("segment.m4s", p, audio), i)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+// ---- 分段 ----
+
+type remuxSample struct {
+	dts, cto int64
+	duration uint32
+	key      bool
+	data     []byte
+}
+
+// segment 生成第 n 个分段：视频取从起始关键帧开始、到下一段关键帧之前的帧（解码顺序），
+// 音频取时间落在分段内的帧
+func (idx *remuxIndex) segment(ctx context.Context, p string, n int) ([]byte, error) {
+	seg := idx.segments[n]
+	e := &ebmlReader{r: newRangeReader(ctx, p, idx.info, remuxReadWindow)}
+	want := func(t int) bool {
+		return t == idx.video.Number || idx.audio != nil && t == idx.audio.Number
+	}
+
+	type frame struct {
+		time int64
+		key  bool
+		data []byte
+	}
+	var videoFrames, audioFrames []frame
+	started, done := false, false
+	collect := func(b mkvBlock) error {
+		t := idx.video
+		if b.Track != t.Number {
+			t = idx.audio
+		}
+		for i, f := range b.Frames {
+			data, err := decodeFrame(t, f)
+			if err != nil {
+				return err
+			}
+			if t == idx.video {
+				switch {
+				case done:
+				case !started && b.Keyframe && b.Time >= seg.Start:
+					started = true
+					videoFrames = append(videoFrames, frame{b.Time, true, data})
+				case started && b.Keyframe && b.Time >= seg.End:
+					done = true
+				case started:
+					videoFrames = append(videoFrames, frame{b.Time, false, data})
+				}
+			} else if b.Time >= seg.Start && b.Time < seg.End {
+				audioFrames = append(audioFrames, frame{b.Time, i == 0, data})
+			}
+		}
+		return nil
+	}
+
+	// 分段之后的 Cluster 时间戳都不小于分段结束时间，读到这里为止
+	for pos := seg.Cluster; pos < idx.info.Size; {
+		t, _, err := clusterTimestamp(e, pos)
+		if errors.Is(err, errBadMatroska) || err == io.EOF || err == nil && t >= seg.End {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		next, err := readClusterBlocks(e, pos, want, collect)
+		if errors.Is(err, errNotCluster) || err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pos = next
+	}
+	if len(videoFrames) == 0 {
+		return nil, fmt.Errorf("分段 %d 没有找到关键帧", n)
+	}
+
+	scale := float64(idx.layout.TimestampScale)
+	toVideo := func(t int64) int64 { return int64(math.Round(float64(t) * scale * remuxVideoScale / 1e9)) }
+
+	// MKV 只有显示时间，解码时间取排好序的显示时间，差值作为（可以为负的）合成时间偏移
+	pts := make([]int64, len(videoFrames))
+	for i, f := range videoFrames {
+		pts[i] = toVideo(f.time)
+	}
+	sorted := append([]int64(nil), pts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	video := make([]remuxSample, len(videoFrames))
+	for i, f := range videoFrames {
+		video[i] = remuxSample{dts: sorted[i], cto: pts[i] - sorted[i], key: f.key, data: f.data}
+	}
+	defaultDur := int64(remuxVideoScale / 24)
+	if idx.video.FrameRate > 0 {
+		defaultDur = int64(math.Round(remuxVideoScale / idx.video.FrameRate))
+	}
+	for i := range video {
+		d := defaultDur
+		if i+1 < len(video) {
+			d = video[i+1].dts - video[i].dts
+		} else if end := toVideo(seg.End); end > video[i].dts && n+1 < len(idx.segments) {
+			d = end - video[i].dts
+		}
+		video[i].duration = uint32(max(d, 0))
+	}
+
+	var audio []remuxSample
+	var audioBase int64
+	if idx.audio != nil && len(audioFrames) > 0 {
+		rate := float64(aacSampleRate(idx.audioASC, idx.audio.SampleRate))
+		audioBase = int64(math.Round(float64(audioFrames[0].time) * scale * rate / 1e9))
+		for _, f := range audioFrames {
+			audio = append(audio, remuxSample{duration: 1024, key: true, data: f.data})
+		}
+	}
+	return buildFragment(uint32(n+1), idx, video, audio, audioBase), nil
+}
+
+// ---- MP4 盒子 ----
+
+func mp4Box(typ string, parts ...[]byte) []byte {
+	size := 8
+	for _, p := range parts {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, parts ...[]byte) []byte {
+	head := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{head}, parts...)...)
+}
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func be64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+var mp4Matrix = func() []byte {
+	var b []byte
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}()
+
+// esDescriptor 写 MPEG-4 描述符，长度固定用 4 字节编码
+func esDescriptor(tag byte, parts ...[]byte) []byte {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	b := []byte{tag, 0x80 | byte(size>>21&0x7F), 0x80 | byte(size>>14&0x7F), 0x80 | byte(size>>7&0x7F), byte(size & 0x7F)}
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func mp4Track(id uint32, handler string, timescale uint32, width, height int, entry []byte) []byte {
+	volume, header := uint16(0), mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	if handler == "soun" {
+		volume, header = 0x0100, mp4FullBox("smhd", 0, 0, make([]byte, 4))
+	}
+	name := "VideoHandler\x00"
+	if handler == "soun" {
+		name = "SoundHandler\x00"
+	}
+	tkhd := mp4FullBox("tkhd", 0, 3, be32(0), be32(0), be32(id), be32(0), be32(0), make([]byte, 8),
+		be16(0), be16(0), be16(volume), be16(0), mp4Matrix, be32(uint32(width)<<16), be32(uint32(height)<<16))
+	mdhd := mp4FullBox("mdhd", 0, 0, be32(0), be32(0), be32(timescale), be32(0), be16(0x55C4), be16(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, be32(0), []byte(handler), make([]byte, 12), []byte(name))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, be32(1), entry),
+		mp4FullBox("stts", 0, 0, be32(0)),
+		mp4FullBox("stsc", 0, 0, be32(0)),
+		mp4FullBox("stsz", 0, 0, be32(0), be32(0)),
+		mp4FullBox("stco", 0, 0, be32(0)))
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", header, dinf, stbl)))
+}
+
+// initSegment 生成 ftyp + moov，轨道 1 为视频，2 为音频
+func (idx *remuxIndex) initSegment() []byte {
+	v := idx.video
+	avc1 := mp4Box("avc1", make([]byte, 6), be16(1), make([]byte, 16), be16(uint16(v.Width)), be16(uint16(v.Height)),
+		be32(0x00480000), be32(0x00480000), be32(0), be16(1), make([]byte, 32), be16(0x18), be16(0xFFFF),
+		mp4Box("avcC", v.CodecPrivate))
+	traks := [][]byte{mp4Track(1, "vide", remuxVideoScale, v.Width, v.Height, avc1)}
+	trex := [][]byte{mp4FullBox("trex", 0, 0, be32(1), be32(1), be32(0), be32(0), be32(0))}
+
+	if a := idx.audio; a != nil {
+		rate := aacSampleRate(idx.audioASC, a.SampleRate)
+		channels := a.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		esds := mp4FullBox("esds", 0, 0, esDescriptor(0x03, be16(0), []byte{0},
+			esDescriptor(0x04, []byte{0x40, 0x15, 0, 0, 0}, be32(0), be32(0), esDescriptor(0x05, idx.audioASC)),
+			esDescriptor(0x06, []byte{0x02})))
+		sampleRate := rate << 16
+		if rate > 0xFFFF {
+			sampleRate = 0
+		}
+		mp4a := mp4Box("mp4a", make([]byte, 6), be16(1), make([]byte, 8), be16(uint16(channels)), be16(16),
+			be16(0), be16(0), be32(sampleRate), esds)
+		traks = append(traks, mp4Track(2, "soun", rate, 0, 0, mp4a))
+		trex = append(trex, mp4FullBox("trex", 0, 0, be32(2), be32(1), be32(0), be32(0), be32(0)))
+	}
+
+	ftyp := mp4Box("ftyp", []byte("isom"), be32(0x200), []byte("isomiso6avc1mp41"))
+	mvhd := mp4FullBox("mvhd", 0, 0, be32(0), be32(0), be32(1000), be32(0), be32(0x00010000), be16(0x0100),
+		make([]byte, 10), mp4Matrix, make([]byte, 24), be32(uint32(len(traks)+1)))
+	moov := append([][]byte{mvhd}, traks...)
+	moov = append(moov, mp4Box("mvex", trex...))
+	return append(ftyp, mp4Box("moov", moov...)...)
+}
+
+func mp4Traf(track uint32, base int64, samples []remuxSample, dataOffset uint32) []byte {
+	var entries []byte
+	for _, s := range samples {
+		flags := uint32(0x01010000) // 非关键帧
+		if s.key {
+			flags = 0x02000000
+		}
+		entries = binary.BigEndian.AppendUint32(entries, s.duration)
+		entries = binary.BigEndian.AppendUint32(entries, uint32(len(s.data)))
+		entries = binary.BigEndian.AppendUint32(entries, flags)
+		entries = binary.BigEndian.AppendUint32(entries, uint32(int32(s.cto)))
+	}
+	return mp4Box("traf",
+		mp4FullBox("tfhd", 0, 0x020000, be32(track)), // default-base-is-moof
+		mp4FullBox("tfdt", 1, 0, be64(uint64(max(base, 0)))),
+		mp4FullBox("trun", 1, 0x000F01, be32(uint32(len(samples))), be32(dataOffset), entries))
+}
+
+// buildFragment 生成 moof + mdat，mdat 里先放视频再放音频
+func buildFragment(seq uint32, idx *remuxIndex, video, audio []remuxSample, audioBase int64) []byte {
+	build := func(videoOffset, audioOffset uint32) []byte {
+		trafs := [][]byte{mp4FullBox("mfhd", 0, 0, be32(seq)), mp4Traf(1, video[0].dts, video, videoOffset)}
+		if len(audio) > 0 {
+			trafs = append(trafs, mp4Traf(2, audioBase, audio, audioOffset))
+		}
+		return mp4Box("moof", trafs...)
+	}
+	videoSize := 0
+	var payload [][]byte
+	for _, s := range video {
+		videoSize += len(s.data)
+		payload = append(payload, s.data)
+	}
+	for _, s := range audio {
+		payload = append(payload, s.data)
+	}
+	// 先按占位偏移算出 moof 的长度，再填入真实的数据偏移
+	moofSize := uint32(len(build(0, 0)))
+	moof := build(moofSize+8, moofSize+8+uint32(videoSize))
+	return append(moof, mp4Box("mdat", payload...)...)
+}
+
+// ---- 接口 ----
+
+func handleRemux(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := q.Get("path")
+	if p == "" {
+		http.Error(w, "path required", 400)
+		return
+	}
+	if !isMatroska(p) {
+		http.Error(w, "只支持 MKV 文件", 415)
+		return
+	}
+	audio, _ := strconv.Atoi(q.Get("audio"))
+	ctx, cancel := context.WithTimeout(r.Context(), remuxTimeout)
+	defer cancel()
+	idx, err := loadRemuxIndex(ctx, p, audio)
+	if err != nil {
+		switch {
+		case errors.Is(err, errRemuxUnsupported):
+			http.Error(w, err.Error(), 415)
+		case errors.Is(err, errBadMatroska) || errors.Is(err, errRemuxNoIndex):
+			http.Error(w, err.Error(), 422)
+		default:
+			upstreamError(w, p, err)
+		}
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/api/remux/") {
+	case "index.m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		w.Write([]byte(idx.playlist(p, audio)))
+	case "init.mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		w.Write(idx.initSegment())
+	case "segment.m4s":
+		n, err := strconv.Atoi(q.Get("n"))
+		if err != nil || n < 0 || n >= len(idx.segments) {
+			http.Error(w, "分段编号无效", 400)
+			return
+		}
+		data, err := idx.segment(ctx, p, n)
+		if err != nil {
+			upstreamError(w, p, err)
+			return
+		}
+		w.Header().Set("Content-Type", "video/iso.segment")
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
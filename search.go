@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/mozillazg/go-pinyin"
+)
+
+// 搜索索引：标题、别名、资源文件夹名、标签、简介的倒排索引，
+// 另外为每个标题保存全拼、首字母和罗马字，支持 "jjdjr"、"shingeki" 这类输入
+
+const t2sFile = "data/t2s.txt"
+
+// 各字段的权重
+const (
+	weightTitle   = 10
+	weightAlias   = 6
+	weightTag     = 4
+	weightSummary = 1
+)
+
+var t2s map[rune]rune // 繁体/日文新字体 -> 简体
+
+// loadT2S 读取 tools/gen_t2s.go 生成的对照表，缺失时只是不做繁简折叠
+func loadT2S() {
+	t2s = make(map[rune]rune)
+	f, err := os.Open(t2sFile)
+	if err != nil {
+		log.Printf("警告: 无法加载繁简对照表: %v", err)
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		from, to, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok || strings.HasPrefix(from, "#") {
+			continue
+		}
+		fr, tr := []rune(from), []rune(to)
+		if len(fr) == 1 && len(tr) == 1 {
+			t2s[fr[0]] = tr[0]
+		}
+	}
+}
+
+type searchIndex struct {
+	docs     []searchDoc
+	postings map[string][]posting
+	vocab    []string // 拉丁字母词，用于前缀和容错匹配
+}
+
+type searchDoc struct {
+	anime    int      // Catalog.AnimeDB 下标
+	titles   []string // 归一化后的标题，去掉空格
+	pinyin   []string // 标题全拼
+	initials []string // 标题拼音首字母
+}
+
+type posting struct {
+	doc    int
+	weight float64
+}
+
+type searchHit struct {
+	anime int
+	score float64
+}
+
+func buildSearchIndex(c *Catalog) *searchIndex {
+	ix := &searchIndex{postings: make(map[string][]posting)}
+	for i, a := range c.AnimeDB {
+		doc := searchDoc{anime: i}
+		weights := make(map[string]float64)
+		add := func(text string, w float64) {
+			for _, t := range searchTerms(normalizeText(text)) {
+				weights[t] = math.Max(weights[t], w)
+			}
+		}
+
+		titles := []string{a.NameCN, a.Name}
+		aliases := append([]string{}, a.Aliases...)
+		if folder := c.FolderPath[a.ID]; folder != "" {
+			aliases = append(aliases, releaseTitle(path.Base(folder)))
+		}
+		for _, t := range titles {
+			add(t, weightTitle)
+		}
+		for _, t := range aliases {
+			add(t, weightAlias)
+		}
+		for _, t := range append(titles, aliases...) {
+			norm := normalizeText(t)
+			if norm == "" {
+				continue
+			}
+			doc.titles = append(doc.titles, strings.ReplaceAll(norm, " ", ""))
+			if full, initials := pinyinOf(norm); full != "" {
+				doc.pinyin = append(doc.pinyin, full)
+				doc.initials = append(doc.initials, initials)
+			}
+			if r := romaji(norm); r != norm {
+				doc.titles = append(doc.titles, strings.ReplaceAll(r, " ", ""))
+			}
+		}
+		for _, t := range a.Tags {
+			add(t, weightTag)
+		}
+		add(a.Summary, weightSummary)
+
+		for t, w := range weights {
+			ix.postings[t] = append(ix.postings[t], posting{doc: len(ix.docs), weight: w})
+		}
+		ix.docs = append(ix.docs, doc)
+	}
+	for t := range ix.postings {
+		if isLatinWord(t) {
+			ix.vocab = append(ix.vocab, t)
+		}
+	}
+	sort.Strings(ix.vocab)
+	return ix
+}
+
+// releaseTitle 从资源文件夹名中去掉字幕组和技术参数标签，留下作品名
+func releaseTitle(folder string) string {
+	var parts []string
+	title := reBracket.ReplaceAllStringFunc(folder, func(m string) string {
+		tag := strings.TrimSpace(bracketContent(m))
+		if !isMetaTag(tag) && !reEpRange.MatchString(tag) && !reEpPrefix.MatchString(tag) {
+			parts = append(parts, tag)
+		}
+		return " "
+	})
+	// 第一个标签通常是字幕组，标题在括号外时去掉它
+	if strings.HasPrefix(folder, "[") && len(parts) > 0 && strings.TrimSpace(title) != "" {
+		parts = parts[1:]
+	}
+	return strings.TrimSpace(title + " " + strings.Join(parts, " "))
+}
+
+// Search 返回按相关度排序的结果
+func (ix *searchIndex) Search(c *Catalog, q string) []searchHit {
+	nq := normalizeText(q)
+	if nq == "" {
+		return nil
+	}
+	terms := queryTerms(nq)
+	scores := make(map[int]float64)
+	matched := make(map[int]int)
+
+	for _, term := range terms {
+		best := make(map[int]float64)
+		collect := func(t string, factor float64) {
+			for _, p := range ix.postings[t] {
+				// 前缀和容错匹配不看简介，避免噪音
+				if factor < 1 && p.weight <= weightSummary {
+					continue
+				}
+				best[p.doc] = math.Max(best[p.doc], p.weight*factor)
+			}
+		}
+		collect(term, 1)
+		if isLatinWord(term) {
+			for _, v := range ix.vocab {
+				if v == term {
+					continue
+				}
+				if len(term) >= 2 && strings.HasPrefix(v, term) {
+					collect(v, 0.7)
+				} else if d := maxTypos(term); d > 0 && abs(len(v)-len(term)) <= d && editDistance(term, v, d) <= d {
+					collect(v, 0.5)
+				}
+			}
+		}
+		for doc, s := range best {
+			scores[doc] += s
+			matched[doc]++
+		}
+	}
+
+	// 至少要命中大部分查询词
+	need := len(terms)
+	if need > 2 {
+		need = int(math.Ceil(float64(need) * 0.6))
+	}
+	for doc := range scores {
+		if matched[doc] < need {
+			delete(scores, doc)
+		}
+	}
+
+	// 整体匹配：标题包含、拼音全拼/首字母、罗马字
+	compact := strings.ReplaceAll(nq, " ", "")
+	latin := isLatinWord(compact)
+	forms := []string{compact}
+	if r := strings.ReplaceAll(romaji(nq), " ", ""); r != compact {
+		// 假名输入也按罗马字匹配文件夹名等拉丁标题
+		forms = append(forms, r)
+	}
+	for i, doc := range ix.docs {
+		bonus := 0.0
+		for _, t := range doc.titles {
+			for _, f := range forms {
+				switch {
+				case t == f:
+					bonus = math.Max(bonus, 50)
+				case strings.HasPrefix(t, f):
+					bonus = math.Max(bonus, 35)
+				case strings.Contains(t, f):
+					bonus = math.Max(bonus, 25)
+				}
+			}
+		}
+		if latin && len(compact) >= 2 {
+			for j, full := range doc.pinyin {
+				switch {
+				case doc.initials[j] == compact:
+					bonus = math.Max(bonus, 40)
+				case full == compact:
+					bonus = math.Max(bonus, 45)
+				case strings.HasPrefix(full, compact) && len(compact) >= 3:
+					bonus = math.Max(bonus, 30)
+				case strings.HasPrefix(doc.initials[j], compact):
+					bonus = math.Max(bonus, 20)
+				case strings.Contains(full, compact) && len(compact) >= 4:
+					bonus = math.Max(bonus, 15)
+				}
+			}
+		}
+		if bonus > 0 {
+			scores[i] += bonus
+		}
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for doc, s := range scores {
+		a := c.AnimeDB[ix.docs[doc].anime]
+		// 评分作为次要因素，相关度接近时高分作品排前面
+		hits = append(hits, searchHit{anime: ix.docs[doc].anime, score: s + a.Score*0.5})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].anime < hits[j].anime
+	})
+	return hits
+}
+
+// normalizeText 全角转半角、小写、繁简折叠、片假名转平假名，标点换成空格
+func normalizeText(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		switch {
+		case r >= 0xFF01 && r <= 0xFF5E:
+			r -= 0xFEE0
+		case r == 0x3000:
+			r = ' '
+		case r >= 0x30A1 && r <= 0x30F6:
+			r -= 0x60
+		}
+		r = unicode.ToLower(r)
+		if s, ok := t2s[r]; ok {
+			r = s
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == 'ー' {
+			b.WriteRune(r)
+			space = false
+		} else if !space && b.Len() > 0 {
+			b.WriteByte(' ')
+			space = true
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// searchTerms 拉丁字母按单词切分，汉字和假名按单字和双字切分，假名另外转成罗马字
+func searchTerms(s string) []string {
+	var terms []string
+	for _, word := range strings.Fields(s) {
+		var run []rune
+		flush := func() {
+			if len(run) == 0 {
+				return
+			}
+			if isCJK(run[0]) {
+				for i := range run {
+					terms = append(terms, string(run[i]))
+					if i+1 < len(run) {
+						terms = append(terms, string(run[i:i+2]))
+					}
+				}
+				if isKana(run[0]) {
+					terms = append(terms, strings.Fields(romaji(string(run)))...)
+				}
+			} else {
+				terms = append(terms, string(run))
+			}
+			run = run[:0]
+		}
+		for _, r := range word {
+			if len(run) > 0 && isCJK(r) != isCJK(run[0]) {
+				flush()
+			}
+			run = append(run, r)
+		}
+		flush()
+	}
+	return terms
+}
+
+// queryTerms 与 searchTerms 相同，但连续的汉字/假名只取双字，单字太容易误中
+func queryTerms(s string) []string {
+	var terms []string
+	for _, word := range strings.Fields(s) {
+		rs := []rune(word)
+		single := true
+		for i := 0; i+1 < len(rs); i++ {
+			if isCJK(rs[i]) && isCJK(rs[i+1]) {
+				single = false
+				break
+			}
+		}
+		for _, t := range searchTerms(word) {
+			if !single && len([]rune(t)) == 1 && isCJK([]rune(t)[0]) {
+				continue
+			}
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || isKana(r)
+}
+
+func isKana(r rune) bool {
+	return unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || r == 'ー'
+}
+
+func isLatinWord(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+var pinyinArgs = pinyin.NewArgs()
+
+// pinyinOf 返回全拼和首字母，非汉字的字母数字原样保留；没有汉字时返回空
+func pinyinOf(s string) (full, initials string) {
+	var f, in strings.Builder
+	hasHan := false
+	for _, r := range s {
+		if unicode.Is(unicode.Han, r) {
+			if py := pinyin.SinglePinyin(r, pinyinArgs); len(py) > 0 && py[0] != "" {
+				f.WriteString(py[0])
+				in.WriteByte(py[0][0])
+				hasHan = true
+			}
+			continue
+		}
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			f.WriteRune(r)
+			in.WriteRune(r)
+		}
+	}
+	if !hasHan {
+		return "", ""
+	}
+	return f.String(), in.String()
+}
+
+// 平假名 -> 罗马字（平文式）
+var kanaRomaji = map[string]string{
+	"あ": "a", "い": "i", "う": "u", "え": "e", "お": "o",
+	"か": "ka", "き": "ki", "く": "ku", "け": "ke", "こ": "ko",
+	"さ": "sa", "し": "shi", "す": "su", "せ": "se", "そ": "so",
+	"た": "ta", "ち": "chi", "つ": "tsu", "て": "te", "と": "to",
+	"な": "na", "に": "ni", "ぬ": "nu", "ね": "ne", "の": "no",
+	"は": "ha", "ひ": "hi", "ふ": "fu", "へ": "he", "ほ": "ho",
+	"ま": "ma", "み": "mi", "む": "mu", "め": "me", "も": "mo",
+	"や": "ya", "ゆ": "yu", "よ": "yo",
+	"ら": "ra", "り": "ri", "る": "ru", "れ": "re", "ろ": "ro",
+	"わ": "wa", "ゐ": "i", "ゑ": "e", "を": "o", "ん": "n",
+	"が": "ga", "ぎ": "gi", "ぐ": "gu", "げ": "ge", "ご": "go",
+	"ざ": "za", "じ": "ji", "ず": "zu", "ぜ": "ze", "ぞ": "zo",
+	"だ": "da", "ぢ": "ji", "づ": "zu", "で": "de", "ど": "do",
+	"ば": "ba", "び": "bi", "ぶ": "bu", "べ": "be", "ぼ": "bo",
+	"ぱ": "pa", "ぴ": "pi", "ぷ": "pu", "ぺ": "pe", "ぽ": "po",
+	"ゔ": "vu", "ぁ": "a", "ぃ": "i", "ぅ": "u", "ぇ": "e", "ぉ": "o",
+	"ゃ": "ya", "ゅ": "yu", "ょ": "yo", "ゎ": "wa",
+	"きゃ": "kya", "きゅ": "kyu", "きょ": "kyo", "しゃ": "sha", "しゅ": "shu", "しょ": "sho",
+	"ちゃ": "cha", "ちゅ": "chu", "ちょ": "cho", "にゃ": "nya", "にゅ": "nyu", "にょ": "nyo",
+	"ひゃ": "hya", "ひゅ": "hyu", "ひょ": "hyo", "みゃ": "mya", "みゅ": "myu", "みょ": "myo",
+	"りゃ": "rya", "りゅ": "ryu", "りょ": "ryo", "ぎゃ": "gya", "ぎゅ": "gyu", "ぎょ": "gyo",
+	"じゃ": "ja", "じゅ": "ju", "じょ": "jo", "びゃ": "bya", "びゅ": "byu", "びょ": "byo",
+	"ぴゃ": "pya", "ぴゅ": "pyu", "ぴょ": "pyo", "ふぁ": "fa", "ふぃ": "fi", "ふぇ": "fe", "ふぉ": "fo",
+	"てぃ": "ti", "でぃ": "di", "うぃ": "wi", "うぇ": "we", "うぉ": "wo", "しぇ": "she", "じぇ": "je", "ちぇ": "che",
+	"ゔぁ": "va", "ゔぃ": "vi", "ゔぇ": "ve", "ゔぉ": "vo",
+}
+
+// romaji 把字符串中的平假名转成罗马字，其他字符保持不变；
+// 输入应已经过 normalizeText（片假名已转为平假名）
+func romaji(s string) string {
+	rs := []rune(s)
+	var b strings.Builder
+	prevKana := false
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		if !isKana(r) {
+			if prevKana && r != ' ' {
+				b.WriteByte(' ')
+			}
+			b.WriteRune(r)
+			prevKana = false
+			continue
+		}
+		if !prevKana && b.Len() > 0 && !strings.HasSuffix(b.String(), " ") {
+			b.WriteByte(' ')
+		}
+		prevKana = true
+		switch r {
+		case 'っ':
+			// 促音：重复下一个音节的首字母
+			if i+1 < len(rs) {
+				if next := kanaSyllable(rs, i+1); next != "" {
+					b.WriteByte(next[0])
+				}
+			}
+			continue
+		case 'ー':
+			// 长音：重复前一个元音
+			if out := b.String(); out != "" {
+				b.WriteByte(out[len(out)-1])
+			}
+			continue
+		}
+		if i+1 < len(rs) {
+			if ro, ok := kanaRomaji[string(rs[i:i+2])]; ok {
+				b.WriteString(ro)
+				i++
+				continue
+			}
+		}
+		if ro, ok := kanaRomaji[string(r)]; ok {
+			b.WriteString(ro)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func kanaSyllable(rs []rune, i int) string {
+	if i+1 < len(rs) {
+		if ro, ok := kanaRomaji[string(rs[i:i+2])]; ok {
+			return ro
+		}
+	}
+	return kanaRomaji[string(rs[i])]
+}
+
+// 允许的拼写错误数
+func maxTypos(term string) int {
+	switch {
+	case len(term) >= 8:
+		return 2
+	case len(term) >= 4:
+		return 1
+	}
+	return 0
+}
+
+// editDistance 计算编辑距离（含相邻字符交换），超过 limit 时提前返回
+func editDistance(a, b string, limit int) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
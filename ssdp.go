@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// SSDP：在局域网组播里宣告 DLNA 媒体服务器，并应答电视等客户端的 M-SEARCH
+
+const (
+	ssdpGroup      = "239.255.255.250:1900"
+	ssdpMaxAge     = 1800
+	ssdpNotifyTick = 10 * time.Minute
+)
+
+var ssdpServer = fmt.Sprintf("%s/1.0 UPnP/1.0 anime-site/1.0", runtime.GOOS)
+
+type ssdpAnnouncer struct {
+	uuid  string
+	port  string
+	iface *net.Interface // 为空时使用系统默认网卡
+}
+
+// targets 需要宣告的 NT/ST 和对应的 USN
+func (s *ssdpAnnouncer) targets() [][2]string {
+	udn := "uuid:" + s.uuid
+	out := [][2]string{
+		{"upnp:rootdevice", udn + "::upnp:rootdevice"},
+		{udn, udn},
+	}
+	for _, t := range []string{dlnaDeviceType, dlnaContentDirectory, dlnaConnectionManager} {
+		out = append(out, [2]string{t, udn + "::" + t})
+	}
+	return out
+}
+
+func (s *ssdpAnnouncer) location(ip net.IP) string {
+	return "http://" + net.JoinHostPort(ip.String(), s.port) + "/dlna/device.xml"
+}
+
+func (s *ssdpAnnouncer) start() error {
+	group, err := net.ResolveUDPAddr("udp4", ssdpGroup)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", s.iface, group)
+	if err != nil {
+		return err
+	}
+	go s.serve(conn)
+	go func() {
+		for {
+			s.notify(group)
+			time.Sleep(ssdpNotifyTick)
+		}
+	}()
+	return nil
+}
+
+// serve 应答 M-SEARCH，回复直接发回请求方
+func (s *ssdpAnnouncer) serve(conn *net.UDPConn) {
+	buf := make([]byte, 8192)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("SSDP 读取失败: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+		st := req.Header.Get("St")
+		var matched [][2]string
+		for _, t := range s.targets() {
+			if st == "ssdp:all" || st == t[0] {
+				matched = append(matched, t)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		ip := localIPFor(src)
+		if ip == nil {
+			continue
+		}
+		// 按 MX 随机延迟，避免所有设备同时回复
+		mx, _ := strconv.Atoi(req.Header.Get("Mx"))
+		delay := time.Duration(0)
+		if mx > 0 {
+			delay = time.Duration(rand.Int63n(int64(min(mx, 2)) * int64(time.Second) / 2))
+		}
+		go func(src *net.UDPAddr, matched [][2]string) {
+			time.Sleep(delay)
+			for _, t := range matched {
+				msg := "HTTP/1.1 200 OK\r\n" +
+					"CACHE-CONTROL: max-age=" + strconv.Itoa(ssdpMaxAge) + "\r\n" +
+					"DATE: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+					"EXT:\r\n" +
+					"LOCATION: " + s.location(ip) + "\r\n" +
+					"SERVER: " + ssdpServer + "\r\n" +
+					"ST: " + t[0] + "\r\n" +
+					"USN: " + t[1] + "\r\n" +
+					"Content-Length: 0\r\n\r\n"
+				conn.WriteToUDP([]byte(msg), src)
+			}
+		}(src, matched)
+	}
+}
+
+// notify 在每个网卡上发送 ssdp:alive
+func (s *ssdpAnnouncer) notify(group *net.UDPAddr) {
+	for _, ip := range s.addrs() {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+		if err != nil {
+			log.Printf("SSDP 宣告失败 %s: %v", ip, err)
+			continue
+		}
+		for _, t := range s.targets() {
+			msg := "NOTIFY * HTTP/1.1\r\n" +
+				"HOST: " + ssdpGroup + "\r\n" +
+				"CACHE-CONTROL: max-age=" + strconv.Itoa(ssdpMaxAge) + "\r\n" +
+				"LOCATION: " + s.location(ip) + "\r\n" +
+				"NT: " + t[0] + "\r\n" +
+				"NTS: ssdp:alive\r\n" +
+				"SERVER: " + ssdpServer + "\r\n" +
+				"USN: " + t[1] + "\r\n\r\n"
+			conn.WriteToUDP([]byte(msg), group)
+		}
+		conn.Close()
+	}
+}
+
+// addrs 用于宣告的 IPv4 地址，指定网卡时只用该网卡
+func (s *ssdpAnnouncer) addrs() []net.IP {
+	var ifaces []net.Interface
+	if s.iface != nil {
+		ifaces = []net.Interface{*s.iface}
+	} else if all, err := net.Interfaces(); err == nil {
+		ifaces = all
+	}
+	var ips []net.IP
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+				ips = append(ips, n.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+// localIPFor 本机访问 dst 时使用的地址，作为回复里 LOCATION 的主机
+func localIPFor(dst *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp4", nil, dst)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
@@ -1,16 +1,79 @@
 let currentYear = 0;
 let currentPage = 1;
 let dp = null;
+let currentUser = null;
 
 document.addEventListener('DOMContentLoaded', () => {
+    loadUser();
+    loadFeaturedCollections();
     initYearFilter();
     loadAnimeList();
     initSearch();
 });
 
+// 带 CSRF 令牌的请求，修改数据的接口都用它
+function api(url, options = {}) {
+    const m = document.cookie.match(/(?:^|; )csrf_token=([^;]*)/);
+    options.headers = Object.assign({ 'Content-Type': 'application/json' }, options.headers);
+    if (m) options.headers['X-CSRF-Token'] = m[1];
+    return fetch(url, options);
+}
+
+async function loadUser() {
+    const resp = await fetch('/api/auth/me');
+    currentUser = (await resp.json()).user;
+    renderUserBox();
+    loadContinueWatching();
+}
+
+function renderUserBox() {
+    const box = document.getElementById('userBox');
+    if (currentUser) {
+        box.innerHTML = `<span>👤 ${currentUser.username}${currentUser.role === 'admin' ? '（管理员）' : ''}</span>
+            <button class="year-btn" onclick="logout()">退出</button>`;
+    } else {
+        box.innerHTML = `<button class="year-btn" onclick="login()">登录</button>
+            <button class="year-btn" onclick="register()">注册</button>`;
+    }
+}
+
+async function submitAuth(url, body) {
+    const resp = await api(url, { method: 'POST', body: JSON.stringify(body) });
+    if (!resp.ok) { alert(await resp.text()); return; }
+    currentUser = (await resp.json()).user;
+    renderUserBox();
+    loadContinueWatching();
+}
+
+function login() {
+    const username = prompt('用户名');
+    if (!username) return;
+    const password = prompt('密码');
+    if (!password) return;
+    submitAuth('/api/auth/login', { username, password });
+}
+
+function register() {
+    const invite = prompt('邀请码');
+    if (!invite) return;
+    const username = prompt('用户名');
+    if (!username) return;
+    const password = prompt('密码（至少 8 位）');
+    if (!password) return;
+    submitAuth('/api/auth/register', { username, password, invite });
+}
+
+async function logout() {
+    await api('/api/auth/logout', { method: 'POST' });
+    currentUser = null;
+    renderUserBox();
+    loadContinueWatching();
+}
+
 function initYearFilter() {
     const container = document.getElementById('yearFilter');
-    let html = '<button class="year-btn active" onclick="filterYear(0)">全部</button>';
+    let html = '<button class="year-btn" onclick="showCalendar()">新番表</button>';
+    html += '<button class="year-btn active" onclick="filterYear(0)">全部</button>';
     for (let y = 2024; y >= 2000; y--) {
         html += `<button class="year-btn" onclick="filterYear(${y})">${y}</button>`;
     }
@@ -25,6 +88,42 @@ function filterYear(year) {
     loadAnimeList();
 }
 
+// 按季度和星期显示新番表
+async function showCalendar(year, season) {
+    document.querySelectorAll('.year-btn').forEach(btn => btn.classList.remove('active'));
+    if (window.event && event.target.classList.contains('year-btn')) event.target.classList.add('active');
+    const grid = document.getElementById('animeGrid');
+    grid.innerHTML = '<div class="loading">加载中...</div>';
+    document.getElementById('pagination').innerHTML = '';
+
+    const params = year ? `?year=${year}&season=${season}` : '';
+    const resp = await fetch(`/api/calendar${params}`);
+    const cal = await resp.json();
+    const seasonNames = { winter: '1月', spring: '4月', summer: '7月', autumn: '10月' };
+
+    let html = '<div class="calendar-nav">';
+    html += cal.seasons.map(s => `<button class="year-btn ${s.year === cal.year && s.season === cal.season ? 'active' : ''}" onclick="showCalendar(${s.year}, '${s.season}')">${s.year}年${seasonNames[s.season]}</button>`).join('');
+    html += '</div>';
+    if (cal.total === 0) {
+        html += `<div class="loading">${cal.year}年${seasonNames[cal.season]}暂无番剧</div>`;
+    }
+    html += cal.weekdays.filter(d => d.items.length > 0).map(d => `
+        <div class="calendar-day">
+            <h3>${d.name} <span class="meta">${d.available}/${d.items.length} 可播放</span></h3>
+            <div class="anime-grid">${d.items.map(anime => `
+                <div class="anime-card ${anime.has_resource ? 'has-resource' : 'no-resource'}" onclick="showAnimeDetail(${JSON.stringify(anime).replace(/"/g, '&quot;')})">
+                    <img src="${anime.cover || '/static/no-cover.png'}" alt="${anime.name_cn || anime.name}" loading="lazy">
+                    <div class="info">
+                        <div class="title">${anime.name_cn || anime.name}</div>
+                        <div class="meta">${anime.date} · <span class="score">${anime.score || '-'}</span></div>
+                    </div>
+                </div>`).join('')}
+            </div>
+        </div>
+    `).join('');
+    grid.innerHTML = `<div class="calendar">${html}</div>`;
+}
+
 async function loadAnimeList() {
     const grid = document.getElementById('animeGrid');
     grid.innerHTML = '<div class="loading">加载中...</div>';
@@ -109,26 +208,68 @@ function showAnimeDetail(anime) {
             <p>${anime.name}</p>
             <p>📅 ${anime.date || anime.year} · ⭐ ${anime.score || '-'}</p>
             <div class="tags">${(anime.tags||[]).map(t => `<span class="tag">${t}</span>`).join('')}</div>
+            ${currentUser ? `<select class="status-select" onchange="setStatus(${anime.id}, this.value)">
+                ${[['', '未收藏'], ['want', '想看'], ['watching', '在看'], ['completed', '看过'], ['dropped', '抛弃']]
+                    .map(([v, t]) => `<option value="${v}" ${(anime.status || '') === v ? 'selected' : ''}>${t}</option>`).join('')}
+            </select>` : ''}
             <p class="summary">${anime.summary || '暂无简介'}</p>
+            <div class="franchise" id="franchiseList"></div>
+            <div class="franchise" id="similarList"></div>
         </div>
     `;
+    if (anime.franchise_size) loadFranchise(anime.id);
+    loadSimilar(anime.id);
 
     const fileList = document.getElementById('fileList');
     
     if (anime.has_resource) {
         fileList.innerHTML = '<h3>🎬 选集</h3><div class="loading">加载中...</div>';
         modal.classList.add('show');
-        loadEpisodes(anime.name_cn || anime.name, anime.year);
+        loadEpisodes(anime.id);
     } else {
         fileList.innerHTML = '<h3>🎬 选集</h3><p style="color:#888">暂无资源</p>';
         modal.classList.add('show');
     }
 }
 
-async function loadEpisodes(name, year) {
+// 系列作品观看顺序
+async function loadFranchise(id) {
+    const resp = await fetch(`/api/anime/${id}/related`);
+    const data = await resp.json();
+    const container = document.getElementById('franchiseList');
+    if (!container || !data.franchise || data.franchise.length === 0) return;
+    container.innerHTML = '<h3>📚 系列作品</h3>' + data.franchise.map((e, i) => `
+        <div class="franchise-item ${e.id === id ? 'current' : ''} ${e.has_resource ? 'has-resource' : 'no-resource'}"
+             ${e.in_catalog && e.id !== id ? `onclick="openAnime(${e.id})"` : ''}>
+            ${i + 1}. ${e.name_cn || e.name} ${e.date ? `<span class="meta">${e.date}</span>` : ''}
+            ${e.has_resource ? '▶' : ''}
+        </div>
+    `).join('');
+}
+
+// 相似推荐
+async function loadSimilar(id) {
+    const resp = await fetch(`/api/anime/${id}/similar?limit=6`);
+    if (!resp.ok) return;
+    const data = await resp.json();
+    const container = document.getElementById('similarList');
+    if (!container || data.data.length === 0) return;
+    container.innerHTML = '<h3>✨ 相似推荐</h3>' + data.data.map(a => `
+        <div class="franchise-item" onclick="openAnime(${a.id})">
+            ${a.name_cn || a.name} <span class="meta">${a.shared_tags.join(' / ')}</span>
+        </div>
+    `).join('');
+}
+
+async function openAnime(id) {
+    const resp = await fetch(`/api/anime/${id}`);
+    if (resp.ok) showAnimeDetail(await resp.json());
+}
+
+async function loadEpisodes(id) {
     const fileList = document.getElementById('fileList');
     try {
-        const resp = await fetch(`/api/anime/episodes?name=${encodeURIComponent(name)}&year=${year}`);
+        const resp = await fetch(`/api/anime/episodes?id=${id}`);
         const data = await resp.json();
         
         if (!data.episodes || data.episodes.length === 0) {
@@ -138,16 +279,36 @@ async function loadEpisodes(name, year) {
 
         let html = `<h3>🎬 选集 (${data.episodes.length}集)</h3><div class="episode-grid">`;
         data.episodes.forEach((ep, idx) => {
-            const num = idx + 1;
-            html += `<div class="episode-btn" onclick="playVideo('${ep.path.replace(/'/g, "\\'")}')" title="${ep.name}">${num}</div>`;
+            episodeByPath[ep.path] = ep;
+            const label = ep.label || `${idx + 1}`;
+            const state = ep.watched ? 'watched' : (ep.position ? 'in-progress' : '');
+            const warning = playbackWarning(ep);
+            const title = warning ? `${ep.name}\n⚠ ${warning}` : ep.name;
+            html += `<div class="episode-btn ${state} ${warning ? 'warn' : ''}" onclick="playVideo('${ep.path.replace(/'/g, "\\'")}', ${id}, ${ep.position || 0})" title="${title}">${label}</div>`;
         });
         html += '</div>';
         fileList.innerHTML = html;
+        loadExternalPlayers(id);
     } catch (e) {
         fileList.innerHTML = '<h3>🎬 选集</h3><p style="color:#f66">加载失败</p>';
     }
 }
 
+// 外部播放器：整季播放列表下载和 mpv/VLC/PotPlayer/IINA 唤起链接
+const externalPlayers = [['mpv', 'mpv'], ['vlc', 'VLC'], ['potplayer', 'PotPlayer'], ['iina', 'IINA']];
+
+async function loadExternalPlayers(id) {
+    try {
+        const resp = await fetch(`/api/anime/${id}/players`);
+        if (!resp.ok) return;
+        const data = await resp.json();
+        let html = '<div class="external-players">外部播放器：';
+        html += externalPlayers.map(([key, name]) => `<a href="${data.links[key]}">${name}</a>`).join('');
+        html += `<a href="${data.m3u8}" download>M3U8</a><a href="${data.xspf}" download>XSPF</a></div>`;
+        document.getElementById('fileList').insertAdjacentHTML('beforeend', html);
+    } catch (e) {}
+}
+
 async function browseStorage(path) {
     const fileList = document.getElementById('fileList');
     fileList.innerHTML = '<h3>📂 文件列表</h3><div class="loading">加载中...</div>';
@@ -181,31 +342,141 @@ function closeModal() {
     document.getElementById('animeModal').classList.remove('show');
 }
 
-async function playVideo(path) {
+// 浏览器可能无法解码时的提示：优先用服务端解析 MKV 的结果，没有时按文件名里的编码判断
+function playbackWarning(ep) {
+    if (ep.media) return ep.media.warning || '';
+    if (ep.codec === 'HEVC') return `HEVC${ep.bit_depth > 8 ? ` ${ep.bit_depth}-bit` : ''}，浏览器可能无法播放`;
+    if (ep.codec === 'AVC' && ep.bit_depth > 8) return `AVC ${ep.bit_depth}-bit (Hi10P)，浏览器可能无法播放`;
+    return '';
+}
+
+let playing = null; // 当前播放的 { animeId, episode }，用于上报进度
+const episodeByPath = {}; // 剧集路径 -> 剧集信息（弹幕 id、字幕）
+
+async function playVideo(path, animeId, position) {
     const container = document.getElementById('playerContainer');
     container.classList.add('show');
     closeModal();
 
-    const resp = await fetch(`/api/get?path=${encodeURIComponent(path)}`);
-    const result = await resp.json();
+    const ep = episodeByPath[path] || {};
+    let video;
+    if (ep.media?.remux) {
+        // H.264/AAC 的 MKV 由服务端转封装成 fMP4 分段，用 HLS 播放
+        video = { url: ep.media.remux, type: 'hls' };
+    } else {
+        const resp = await fetch(`/api/get?path=${encodeURIComponent(path)}`);
+        const result = await resp.json();
 
-    if (result.code !== 200 || !result.data?.raw_url) {
-        alert('获取播放地址失败');
-        closePlayer();
-        return;
+        if (result.code !== 200 || !result.data?.raw_url) {
+            alert('获取播放地址失败');
+            closePlayer();
+            return;
+        }
+        video = { url: result.data.raw_url, type: 'auto' };
     }
 
+    const warning = playbackWarning(ep);
+    const warningBox = document.getElementById('playerWarning');
+    warningBox.textContent = warning ? `⚠ ${warning}` : '';
+    warningBox.classList.toggle('show', !!warning);
+    const subtitles = (ep.subtitles || []).map(s => ({ url: s.url, lang: s.lang, name: s.label }));
+
     if (dp) dp.destroy();
     dp = new DPlayer({
         container: document.getElementById('dplayer'),
-        video: { url: result.data.raw_url, type: 'auto' },
+        video,
+        subtitle: subtitles.length ? { url: subtitles, type: 'webvtt', defaultSubtitle: 0 } : undefined,
+        danmaku: {
+            id: ep.danmaku || path,
+            api: '/api/danmaku/',
+            user: currentUser ? currentUser.username : '匿名'
+        },
         autoplay: true
     });
+
+    playing = animeId && currentUser ? { animeId, episode: path.split('/').pop() } : null;
+    if (!playing) return;
+    if (position > 0) dp.on('loadedmetadata', () => dp.seek(position));
+    let lastReport = 0;
+    dp.on('timeupdate', () => {
+        if (Date.now() - lastReport < 10000) return;
+        lastReport = Date.now();
+        reportProgress();
+    });
+    dp.on('pause', reportProgress);
+    dp.on('ended', reportProgress);
+}
+
+function reportProgress() {
+    if (!playing || !dp || !dp.video.duration) return;
+    api('/api/progress', {
+        method: 'POST',
+        body: JSON.stringify({
+            anime_id: playing.animeId,
+            episode: playing.episode,
+            position: dp.video.currentTime,
+            duration: dp.video.duration
+        })
+    });
 }
 
 function closePlayer() {
+    reportProgress();
+    playing = null;
     document.getElementById('playerContainer').classList.remove('show');
     if (dp) { dp.destroy(); dp = null; }
+    loadContinueWatching();
+}
+
+async function setStatus(animeId, status) {
+    const resp = await api('/api/status', { method: 'POST', body: JSON.stringify({ anime_id: animeId, status }) });
+    if (!resp.ok) alert(await resp.text());
+}
+
+// 首页的推荐片单
+async function loadFeaturedCollections() {
+    const resp = await fetch('/api/collections?featured=1');
+    const list = await resp.json();
+    const container = document.getElementById('featuredCollections');
+    container.innerHTML = list.map(c => `
+        <button class="year-btn" onclick="showCollection(${c.id})" title="${c.description}">📋 ${c.name} (${c.items.length})</button>
+    `).join('');
+}
+
+async function showCollection(id) {
+    const resp = await fetch(`/api/collections/${id}`);
+    if (!resp.ok) return;
+    const data = await resp.json();
+    const grid = document.getElementById('animeGrid');
+    document.getElementById('pagination').innerHTML = '';
+    grid.innerHTML = `<div class="calendar"><h3>${data.collection.name}</h3><p class="meta">${data.collection.description}</p></div>` +
+        data.anime.map(anime => `
+        <div class="anime-card ${anime.has_resource ? 'has-resource' : 'no-resource'}" onclick="showAnimeDetail(${JSON.stringify(anime).replace(/"/g, '&quot;')})">
+            <img src="${anime.cover || '/static/no-cover.png'}" alt="${anime.name_cn || anime.name}" loading="lazy">
+            <div class="info">
+                <div class="title">${anime.name_cn || anime.name}</div>
+                <div class="meta">${anime.year} · <span class="score">${anime.score || '-'}</span></div>
+            </div>
+        </div>
+    `).join('');
+}
+
+// 首页的继续观看
+async function loadContinueWatching() {
+    const container = document.getElementById('continueWatching');
+    if (!currentUser) { container.innerHTML = ''; return; }
+    const resp = await fetch('/api/continue?limit=8');
+    if (!resp.ok) return;
+    const items = await resp.json();
+    if (items.length === 0) { container.innerHTML = ''; return; }
+    items.forEach(it => { episodeByPath[it.episode.path] = it.episode; });
+    container.innerHTML = '<h3>⏯ 继续观看</h3><div class="continue-list">' + items.map(it => `
+        <div class="continue-item" onclick="playVideo('${it.episode.path.replace(/'/g, "\\'")}', ${it.anime.id}, ${it.episode.position || 0})">
+            <img src="${it.anime.cover || '/static/no-cover.png'}" alt="">
+            <div>${it.anime.name_cn || it.anime.name}</div>
+            <div class="meta">${it.episode.label} · ${it.watched}/${it.total}</div>
+        </div>
+    `).join('') + '</div>';
 }
 
 document.addEventListener('keydown', e => { if (e.key === 'Escape') { closePlayer(); closeModal(); } });
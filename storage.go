@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 存储后端：把 OpenList 风格的路径（/onedrive/anime/xxx/01.mkv）解析为可访问的文件
+type Backend interface {
+	Name() string
+	// Link 返回播放器可直接访问的地址，文件存在但没有直链时返回空字符串
+	Link(ctx context.Context, path string) (string, error)
+	Stat(ctx context.Context, path string) (FileInfo, error)
+	// Open 从 offset 开始读取 length 字节，length < 0 表示读到文件末尾
+	Open(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error)
+}
+
+type FileInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+type BackendConfig struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`    // openlist / rclone / local
+	URL     string `json:"url"`     // openlist、rclone serve http 地址
+	Dir     string `json:"dir"`     // local 根目录
+	Strip   string `json:"strip"`   // 访问后端前去掉的路径前缀
+	Timeout int    `json:"timeout"` // 秒
+}
+
+type StorageConfig struct {
+	Backends []BackendConfig     `json:"backends"`
+	Routes   map[string][]string `json:"routes"` // 路径前缀 -> 按顺序尝试的后端
+}
+
+var errNoDirectLink = errors.New("该后端没有直链")
+
+// 失败后在这段时间内把后端排到最后
+const backendCooldown = 30 * time.Second
+
+type storageRouter struct {
+	backends map[string]Backend
+	routes   map[string][]string
+	prefixes []string // 按长度降序，最长前缀优先
+
+	mu     sync.Mutex
+	failed map[string]time.Time
+}
+
+var storage *storageRouter
+
+func initStorage() {
+	cfg := config.Storage
+	if len(cfg.Backends) == 0 {
+		cfg = defaultStorageConfig()
+	}
+	storage = &storageRouter{
+		backends: make(map[string]Backend),
+		routes:   make(map[string][]string),
+		failed:   make(map[string]time.Time),
+	}
+	for _, bc := range cfg.Backends {
+		b, err := newBackend(bc)
+		if err != nil {
+			log.Printf("警告: 存储后端 %s 配置错误: %v", bc.Name, err)
+			continue
+		}
+		storage.backends[bc.Name] = b
+	}
+	for prefix, names := range cfg.Routes {
+		prefix = normalizeRoutePrefix(prefix)
+		storage.routes[prefix] = names
+		storage.prefixes = append(storage.prefixes, prefix)
+	}
+	sort.Slice(storage.prefixes, func(i, j int) bool {
+		return len(storage.prefixes[i]) > len(storage.prefixes[j])
+	})
+	for _, p := range storage.prefixes {
+		log.Printf("存储路由 %s -> %s", p, strings.Join(storage.routes[p], ", "))
+	}
+}
+
+// 未配置 storage 时沿用 openlist_url / rclone_url / rclone_pikpak_url
+func defaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Backends: []BackendConfig{
+			{Name: "openlist", Type: "openlist", URL: config.OpenListURL, Timeout: 15},
+			{Name: "rclone-onedrive", Type: "rclone", URL: config.RcloneURL, Strip: "/onedrive", Timeout: 10},
+			{Name: "rclone-pikpak", Type: "rclone", URL: config.RclonePikpakURL, Strip: "/pikpak/wukazi", Timeout: 10},
+		},
+		Routes: map[string][]string{
+			"/":         {"openlist"},
+			"/onedrive": {"openlist", "rclone-onedrive"},
+			"/pikpak":   {"openlist", "rclone-pikpak"},
+		},
+	}
+}
+
+func newBackend(bc BackendConfig) (Backend, error) {
+	timeout := time.Duration(bc.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	switch bc.Type {
+	case "openlist":
+		if bc.URL == "" {
+			return nil, fmt.Errorf("缺少 url")
+		}
+		return &openListBackend{name: bc.Name, baseURL: strings.TrimSuffix(bc.URL, "/"), timeout: timeout, client: newBackendClient(timeout)}, nil
+	case "rclone":
+		if bc.URL == "" {
+			return nil, fmt.Errorf("缺少 url")
+		}
+		return &rcloneBackend{name: bc.Name, baseURL: strings.TrimSuffix(bc.URL, "/"), strip: bc.Strip, timeout: timeout, client: newBackendClient(timeout)}, nil
+	case "local":
+		if bc.Dir == "" {
+			return nil, fmt.Errorf("缺少 dir")
+		}
+		return &localBackend{name: bc.Name, dir: bc.Dir, strip: bc.Strip}, nil
+	}
+	return nil, fmt.Errorf("未知类型 %q", bc.Type)
+}
+
+// 每个后端独立的连接池；超时只限制到响应头为止，视频流本身不设总超时
+func newBackendClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: newTransport(timeout)}
+}
+
+// onedrive:anime -> /onedrive/anime
+func normalizeRoutePrefix(prefix string) string {
+	if i := strings.Index(prefix, ":"); i > 0 && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix[:i] + "/" + prefix[i+1:]
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	if len(prefix) > 1 {
+		prefix = strings.TrimSuffix(prefix, "/")
+	}
+	return prefix
+}
+
+// storagePath 把映射表里的文件夹路径转换为 OpenList 路径：
+// onedrive:anime/xxx -> /onedrive/anime/xxx，wukazi/xxx -> /pikpak/wukazi/xxx
+func storagePath(folderPath string) string {
+	if strings.HasPrefix(folderPath, "onedrive:") {
+		return "/" + strings.Replace(folderPath, ":", "/", 1)
+	}
+	return "/pikpak/" + folderPath
+}
+
+// 按路由顺序列出后端，最近失败过的排到最后
+func (s *storageRouter) candidates(path string) []Backend {
+	var names []string
+	for _, p := range s.prefixes {
+		if p == "/" || path == p || strings.HasPrefix(path, p+"/") {
+			names = s.routes[p]
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var healthy, cooling []Backend
+	for _, n := range names {
+		b, ok := s.backends[n]
+		if !ok {
+			continue
+		}
+		if t, bad := s.failed[n]; bad && time.Since(t) < backendCooldown {
+			cooling = append(cooling, b)
+		} else {
+			healthy = append(healthy, b)
+		}
+	}
+	return append(healthy, cooling...)
+}
+
+func (s *storageRouter) markFailed(b Backend, err error) {
+	// 本地文件不存在、没有直链之类不算后端故障
+	if errors.Is(err, errNoDirectLink) || errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	log.Printf("存储后端 %s 失败: %v", b.Name(), err)
+	s.mu.Lock()
+	s.failed[b.Name()] = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *storageRouter) markOK(b Backend) {
+	s.mu.Lock()
+	delete(s.failed, b.Name())
+	s.mu.Unlock()
+}
+
+// try 依次调用各后端，直到有一个成功；调用方取消或超时时直接返回，不算后端故障
+func (s *storageRouter) try(ctx context.Context, path string, fn func(Backend) error) (Backend, error) {
+	backends := s.candidates(path)
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("没有可用的存储后端: %s", path)
+	}
+	var errs []string
+	for _, b := range backends {
+		err := fn(b)
+		if err == nil {
+			s.markOK(b)
+			return b, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		s.markFailed(b, err)
+		errs = append(errs, b.Name()+": "+err.Error())
+	}
+	return nil, fmt.Errorf("所有存储后端均失败: %s", strings.Join(errs, "; "))
+}
+
+func (s *storageRouter) Link(ctx context.Context, path string) (link string, backend string, err error) {
+	b, err := s.try(ctx, path, func(b Backend) error {
+		var e error
+		link, e = b.Link(ctx, path)
+		return e
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return link, b.Name(), nil
+}
+
+func (s *storageRouter) Stat(ctx context.Context, path string) (info FileInfo, err error) {
+	_, err = s.try(ctx, path, func(b Backend) error {
+		var e error
+		info, e = b.Stat(ctx, path)
+		return e
+	})
+	return info, err
+}
+
+func (s *storageRouter) Open(ctx context.Context, path string, offset, length int64) (rc io.ReadCloser, err error) {
+	_, err = s.try(ctx, path, func(b Backend) error {
+		var e error
+		rc, e = b.Open(ctx, path, offset, length)
+		return e
+	})
+	return rc, err
+}
+
+// ---- OpenList ----
+
+type openListBackend struct {
+	name    string
+	baseURL string
+	timeout time.Duration
+	client  *http.Client
+}
+
+type openListFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	RawURL   string    `json:"raw_url"`
+}
+
+func (b *openListBackend) Name() string { return b.name }
+
+// get 查询文件信息和直链，结果按直链有效期缓存
+func (b *openListBackend) get(ctx context.Context, path string) (*openListFile, error) {
+	f, _, err := links.Get(ctx, b.name+"|"+path, func(ctx context.Context) (*openListFile, error) {
+		return b.fetch(ctx, path)
+	})
+	return f, err
+}
+
+func (b *openListBackend) fetch(ctx context.Context, path string) (*openListFile, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	data, err := openListPost(ctx, b.client, b.baseURL, "/api/fs/get", map[string]interface{}{"path": path, "password": ""})
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Code    int          `json:"code"`
+		Message string       `json:"message"`
+		Data    openListFile `json:"data"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("OpenList 响应格式错误: %v", err)
+	}
+	if resp.Code != 200 {
+		return nil, fmt.Errorf("OpenList 返回 %d: %s", resp.Code, resp.Message)
+	}
+	return &resp.Data, nil
+}
+
+func (b *openListBackend) Link(ctx context.Context, path string) (string, error) {
+	f, err := b.get(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if f.RawURL == "" {
+		return "", errNoDirectLink
+	}
+	return f.RawURL, nil
+}
+
+func (b *openListBackend) Stat(ctx context.Context, path string) (FileInfo, error) {
+	f, err := b.get(ctx, path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Size: f.Size, ModTime: f.Modified}, nil
+}
+
+func (b *openListBackend) Open(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	key := b.name + "|" + path
+	f, cached, err := links.Get(ctx, key, func(ctx context.Context) (*openListFile, error) {
+		return b.fetch(ctx, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.RawURL == "" {
+		return nil, errNoDirectLink
+	}
+	rc, err := openRange(ctx, b.client, f.RawURL, offset, length)
+	if err != nil && cached && ctx.Err() == nil {
+		// 缓存的直链可能已提前失效，重新获取一次
+		links.Invalidate(key)
+		f, _, err = links.Get(ctx, key, func(ctx context.Context) (*openListFile, error) {
+			return b.fetch(ctx, path)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return openRange(ctx, b.client, f.RawURL, offset, length)
+	}
+	return rc, err
+}
+
+// ---- rclone serve http ----
+
+type rcloneBackend struct {
+	name    string
+	baseURL string
+	strip   string
+	timeout time.Duration
+	client  *http.Client
+}
+
+func (b *rcloneBackend) Name() string { return b.name }
+
+func (b *rcloneBackend) url(path string) string {
+	rel := strings.TrimPrefix(path, b.strip)
+	return b.baseURL + (&url.URL{Path: "/" + strings.TrimPrefix(rel, "/")}).EscapedPath()
+}
+
+// Link rclone serve 只监听本机，地址不能给浏览器，确认文件存在后返回空，由调用方走 /api/stream 代理
+func (b *rcloneBackend) Link(ctx context.Context, path string) (string, error) {
+	if _, err := b.Stat(ctx, path); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+func (b *rcloneBackend) Stat(ctx context.Context, path string) (FileInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "HEAD", b.url(path), nil)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return FileInfo{}, fmt.Errorf("rclone 返回 %s", resp.Status)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (b *rcloneBackend) Open(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	return openRange(ctx, b.client, b.url(path), offset, length)
+}
+
+// ---- 本地目录 ----
+
+type localBackend struct {
+	name  string
+	dir   string
+	strip string
+}
+
+func (b *localBackend) Name() string { return b.name }
+
+func (b *localBackend) file(path string) string {
+	rel := strings.TrimPrefix(path, b.strip)
+	return filepath.Join(b.dir, filepath.FromSlash(filepath.Clean("/"+rel)))
+}
+
+func (b *localBackend) Link(ctx context.Context, path string) (string, error) {
+	if _, err := os.Stat(b.file(path)); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+func (b *localBackend) Stat(ctx context.Context, path string) (FileInfo, error) {
+	info, err := os.Stat(b.file(path))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (b *localBackend) Open(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(b.file(path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// ---- HTTP 工具 ----
+
+// openRange 发起带 Range 的 GET 请求
+func openRange(ctx context.Context, client *http.Client, link string, offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	if length >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && offset == 0:
+		if length >= 0 {
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(resp.Body, length), resp.Body}, nil
+		}
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("上游返回 %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func openListPost(ctx context.Context, client *http.Client, baseURL, endpoint string, body map[string]interface{}) ([]byte, error) {
+	jsonBody, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+endpoint, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("请求 OpenList 失败: %v", err)
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// 常见视频格式的 MIME，系统 mime 表里经常缺 mkv
+var videoTypes = map[string]string{
+	".mkv":  "video/x-matroska",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".avi":  "video/x-msvideo",
+	".flv":  "video/x-flv",
+	".mov":  "video/quicktime",
+	".ts":   "video/mp2t",
+}
+
+func contentTypeOf(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := videoTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// streamURL 站内代理播放地址
+func streamURL(p string) string {
+	return "/api/stream?path=" + url.QueryEscape(p)
+}
+
+// 通过站点代理视频流，支持 Range 请求，客户端看不到上游地址
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		http.Error(w, "path required", 400)
+		return
+	}
+	serveStream(w, r, p)
+}
+
+// redirectOrStream 按 /api/get 的规则重定向到直链，开启 stream_proxy 或没有直链时代理输出
+func redirectOrStream(w http.ResponseWriter, r *http.Request, p string) {
+	if !config.StreamProxy {
+		if link, _, err := storage.Link(r.Context(), p); err == nil && link != "" {
+			http.Redirect(w, r, link, http.StatusFound)
+			return
+		}
+	}
+	serveStream(w, r, p)
+}
+
+// upstreamError 存储后端的错误里带着上游地址，细节只记日志，客户端只看到笼统的提示
+func upstreamError(w http.ResponseWriter, p string, err error) {
+	if errors.Is(err, context.Canceled) {
+		// 客户端已经断开，不用记录也不用回复
+		return
+	}
+	log.Printf("读取 %s 失败: %v", p, err)
+	http.Error(w, "上游读取失败", 502)
+}
+
+// serveStream 代理输出存储里的文件，WebDAV 等需要代理时也用它
+func serveStream(w http.ResponseWriter, r *http.Request, p string) {
+	info, err := storage.Stat(r.Context(), p)
+	if err != nil {
+		upstreamError(w, p, err)
+		return
+	}
+
+	f := newRemoteFile(r.Context(), p, info)
+	defer f.Close()
+	// 单区间请求只向上游要这一段，响应体读完后连接可以复用
+	if _, end, ok := parseSingleRange(r.Header.Get("Range"), info.Size); ok {
+		f.end = end
+	}
+
+	w.Header().Set("Content-Type", contentTypeOf(p))
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	// ServeContent 负责 Range/If-Range/Content-Length/Accept-Ranges
+	http.ServeContent(w, r, path.Base(p), info.ModTime, f)
+}
+
+// remoteFile 把存储后端的区间读取包装成 io.ReadSeeker，
+// 只在真正读取时才向上游发起请求，连续读取复用同一个响应体；
+// 启用分块缓存时改为按块读取
+type remoteFile struct {
+	ctx  context.Context
+	path string
+	info FileInfo
+	size int64
+
+	chunk    []byte // 当前缓存块
+	chunkIdx int64
+
+	off     int64 // 当前读取位置
+	end     int64 // 预计读取的结束位置（不含），0 表示读到文件末尾
+	body    io.ReadCloser
+	bodyOff int64 // body 下一次读取对应的位置
+}
+
+func newRemoteFile(ctx context.Context, p string, info FileInfo) *remoteFile {
+	return &remoteFile{ctx: ctx, path: p, info: info, size: info.Size, chunkIdx: -1}
+}
+
+func (f *remoteFile) Read(b []byte) (int, error) {
+	if f.off >= f.size {
+		return 0, io.EOF
+	}
+	if cache != nil {
+		return f.readChunk(b)
+	}
+	if f.body != nil && f.bodyOff != f.off {
+		f.body.Close()
+		f.body = nil
+	}
+	if f.body == nil {
+		length := int64(-1)
+		if f.end > f.off {
+			length = f.end - f.off
+		}
+		body, err := storage.Open(f.ctx, f.path, f.off, length)
+		if err != nil {
+			return 0, err
+		}
+		f.body, f.bodyOff = body, f.off
+	}
+	n, err := f.body.Read(b)
+	f.off += int64(n)
+	f.bodyOff += int64(n)
+	if err == io.EOF {
+		f.body.Close()
+		f.body = nil
+		if f.off < f.size {
+			// 预计区间读完了，后续读取重新发起请求
+			err = nil
+			if f.end == 0 || f.off < f.end {
+				err = io.ErrUnexpectedEOF
+			}
+			f.end = 0
+		}
+	}
+	return n, err
+}
+
+func (f *remoteFile) readChunk(b []byte) (int, error) {
+	idx := f.off / cache.chunkSize
+	if f.chunkIdx != idx {
+		data, err := cache.Chunk(f.ctx, f.path, f.info, idx)
+		if err != nil {
+			return 0, err
+		}
+		f.chunk, f.chunkIdx = data, idx
+	}
+	n := copy(b, f.chunk[f.off-idx*cache.chunkSize:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek 位置无效")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// parseSingleRange 解析 "bytes=a-b" 形式的单区间，返回 [start, end)
+func parseSingleRange(h string, size int64) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(h, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	a, b, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+	if a == "" {
+		n, err := strconv.ParseInt(b, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size, true
+	}
+	start, err := strconv.ParseInt(a, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end = size
+	if b != "" {
+		n, err := strconv.ParseInt(b, 10, 64)
+		if err != nil || n < start {
+			return 0, 0, false
+		}
+		end = min(n+1, size)
+	}
+	return start, end, true
+}
+
+func (f *remoteFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// rangeReader 按固定窗口向存储后端发起区间请求，适合只读文件少数几处的场景
+// （解析 MKV 头部、按索引跳转），跳过的部分不会被下载；启用分块缓存时直接读缓存块
+type rangeReader struct {
+	ctx    context.Context
+	path   string
+	info   FileInfo
+	window int64
+	direct bool // 绕过块缓存，适合零散的小范围读取
+
+	buf    []byte
+	bufOff int64
+	off    int64
+}
+
+func newRangeReader(ctx context.Context, p string, info FileInfo, window int64) *rangeReader {
+	return &rangeReader{ctx: ctx, path: p, info: info, window: window}
+}
+
+func (r *rangeReader) Read(b []byte) (int, error) {
+	if r.off >= r.info.Size {
+		return 0, io.EOF
+	}
+	if r.off < r.bufOff || r.off >= r.bufOff+int64(len(r.buf)) {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.buf[r.off-r.bufOff:])
+	r.off += int64(n)
+	return n, nil
+}
+
+func (r *rangeReader) fill() error {
+	if cache != nil && !r.direct {
+		idx := r.off / cache.chunkSize
+		data, err := cache.Chunk(r.ctx, r.path, r.info, idx)
+		if err != nil {
+			return err
+		}
+		r.buf, r.bufOff = data, idx*cache.chunkSize
+		return nil
+	}
+	length := min(r.window, r.info.Size-r.off)
+	rc, err := storage.Open(r.ctx, r.path, r.off, length)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	buf := make([]byte, length)
+	n, err := io.ReadFull(rc, buf)
+	if n == 0 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	r.buf, r.bufOff = buf[:n], r.off
+	return nil
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.info.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek 位置无效")
+	}
+	r.off = offset
+	return offset, nil
+}
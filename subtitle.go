@@ -0,0 +1,711 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// 外挂字幕：扫描工具把 .ass/.srt 记在映射表的 subtitles 里，
+// 这里按文件名和语言标记配到剧集上，播放时转成 WebVTT 给 DPlayer，
+// 也提供转成 UTF-8 的原始 ASS 给能渲染特效的播放器
+
+var subtitleFormats = map[string]string{".ass": "ass", ".ssa": "ass", ".srt": "srt", ".vtt": "vtt"}
+
+// 字幕文件最大 20MB，带大量特效的 ASS 也远小于这个数
+const maxSubtitleSize = 20 << 20
+
+type SubtitleInfo struct {
+	Name   string `json:"name"`
+	Lang   string `json:"lang,omitempty"` // chs/cht/jpn/eng，双语为 chs_jpn/cht_jpn
+	Label  string `json:"label"`
+	Format string `json:"format"`  // ass/srt/vtt
+	URL    string `json:"url"`     // 转换后的 WebVTT
+	RawURL string `json:"raw_url"` // 原格式（UTF-8）
+}
+
+// 文件名里的语言标记，如 xxx.sc.ass、xxx.zh-Hant.srt、xxx.简日.ass
+var subtitleLangTags = map[string]string{
+	"sc": "chs", "chs": "chs", "gb": "chs", "zh-hans": "chs", "zh-cn": "chs", "zh": "chs", "简": "chs", "简体": "chs", "简中": "chs",
+	"tc": "cht", "cht": "cht", "big5": "cht", "zh-hant": "cht", "zh-tw": "cht", "zh-hk": "cht", "繁": "cht", "繁体": "cht", "繁體": "cht", "繁中": "cht",
+	"jpsc": "chs_jpn", "scjp": "chs_jpn", "chs_jp": "chs_jpn", "chs&jpn": "chs_jpn", "chs_jpn": "chs_jpn", "简日": "chs_jpn",
+	"jptc": "cht_jpn", "tcjp": "cht_jpn", "cht_jp": "cht_jpn", "cht&jpn": "cht_jpn", "cht_jpn": "cht_jpn", "繁日": "cht_jpn",
+	"ja": "jpn", "jp": "jpn", "jpn": "jpn", "日": "jpn", "日文": "jpn",
+	"en": "eng", "eng": "eng", "英": "eng", "英文": "eng",
+}
+
+// 排在前面的作为默认字幕
+var subtitleLangOrder = []string{"chs", "chs_jpn", "cht", "cht_jpn", "", "jpn", "eng"}
+
+var subtitleLangLabels = map[string]string{
+	"chs": "简体中文", "cht": "繁体中文", "chs_jpn": "简日双语", "cht_jpn": "繁日双语", "jpn": "日文", "eng": "英文",
+}
+
+func subtitleFormat(name string) string {
+	return subtitleFormats[strings.ToLower(path.Ext(name))]
+}
+
+// splitSubtitleName 去掉扩展名和末尾的语言标记，返回用来和视频配对的文件名和语言
+func splitSubtitleName(name string) (base, lang string) {
+	base = strings.TrimSuffix(name, path.Ext(name))
+	var langs []string
+	for i := 0; i < 2; i++ {
+		ext := path.Ext(base)
+		l, ok := subtitleLangTags[strings.ToLower(strings.TrimPrefix(ext, "."))]
+		if ext == "" || !ok {
+			break
+		}
+		langs = append([]string{l}, langs...)
+		base = strings.TrimSuffix(base, ext)
+	}
+	switch {
+	case len(langs) == 2 && langs[1] == "jpn":
+		lang = langs[0] + "_jpn"
+	case len(langs) > 0:
+		lang = langs[0]
+	default:
+		// 没有后缀标记时看文件名里的 [简体]、[CHS] 等
+		ls := parseEpisodeName(name).Languages
+		if containsString(ls, "jpn") && len(ls) == 2 {
+			lang = ls[0] + "_jpn"
+		} else if len(ls) == 1 {
+			lang = ls[0]
+		}
+	}
+	return base, lang
+}
+
+func subtitleLangRank(lang string) int {
+	for i, l := range subtitleLangOrder {
+		if l == lang {
+			return i
+		}
+	}
+	return len(subtitleLangOrder)
+}
+
+func subtitleURL(p, format string) string {
+	return "/api/subtitle?path=" + url.QueryEscape(p) + "&format=" + format
+}
+
+// pairSubtitles 把目录下的字幕配到剧集上：先按去掉语言标记后的文件名，
+// 配不上的（如单独的字幕包）按集数，只有一个视频时全部归它
+func pairSubtitles(episodes []EpisodeInfo, dir string, subs []string) {
+	if len(subs) == 0 || len(episodes) == 0 {
+		return
+	}
+	byBase := make(map[string][]int)
+	for i, ep := range episodes {
+		base := strings.TrimSuffix(ep.Name, path.Ext(ep.Name))
+		byBase[base] = append(byBase[base], i)
+	}
+	for _, name := range subs {
+		base, lang := splitSubtitleName(name)
+		format := subtitleFormat(name)
+		if format == "" {
+			continue
+		}
+		p := dir + "/" + name
+		label := subtitleLangLabels[lang]
+		if label == "" {
+			label = "字幕"
+		}
+		info := SubtitleInfo{Name: name, Lang: lang, Label: label, Format: format,
+			URL: subtitleURL(p, "vtt"), RawURL: subtitleURL(p, "raw")}
+
+		targets := byBase[base]
+		if len(targets) == 0 {
+			if len(episodes) == 1 {
+				targets = []int{0}
+			} else if s := parseEpisodeName(name); s.Episode > 0 {
+				for i, ep := range episodes {
+					if ep.Episode == s.Episode && ep.Season == s.Season && ep.Special == s.Special {
+						targets = append(targets, i)
+					}
+				}
+			}
+		}
+		for _, i := range targets {
+			episodes[i].Subtitles = append(episodes[i].Subtitles, info)
+		}
+	}
+	for i := range episodes {
+		sort.SliceStable(episodes[i].Subtitles, func(a, b int) bool {
+			return subtitleLangRank(episodes[i].Subtitles[a].Lang) < subtitleLangRank(episodes[i].Subtitles[b].Lang)
+		})
+	}
+}
+
+// ---- 编码 ----
+
+// decodeSubtitle 转成 UTF-8：识别 BOM，非 UTF-8 时按 GB18030 或 Big5 解码，
+// 繁体字幕优先试 Big5，选解码错误少的那个
+func decodeSubtitle(data []byte, lang string) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:])
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return decodeWith(unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), data)
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return decodeWith(unicode.UTF16(unicode.BigEndian, unicode.UseBOM), data)
+	case utf8.Valid(data):
+		return string(data)
+	}
+	candidates := []encoding.Encoding{simplifiedchinese.GB18030, traditionalchinese.Big5}
+	if strings.HasPrefix(lang, "cht") {
+		candidates[0], candidates[1] = candidates[1], candidates[0]
+	}
+	best, bestBad := "", -1
+	for _, enc := range candidates {
+		s := decodeWith(enc, data)
+		bad := strings.Count(s, "\uFFFD")
+		if bestBad < 0 || bad < bestBad {
+			best, bestBad = s, bad
+		}
+	}
+	return best
+}
+
+func decodeWith(enc encoding.Encoding, data []byte) string {
+	out, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return strings.ToValidUTF8(string(data), "\uFFFD")
+	}
+	return strings.TrimPrefix(string(out), "\uFEFF")
+}
+
+// ---- WebVTT ----
+
+type vttCue struct {
+	start, end float64
+	settings   string
+	text       string
+}
+
+func vttTime(t float64) string {
+	ms := int64(math.Round(t * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// writeVTT 排序、去掉特效字幕叠出来的重复行，并把逐帧拆开的同一句合并
+func writeVTT(cues []vttCue, style string) string {
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].start < cues[j].start })
+	var merged []vttCue
+	last := make(map[string]int)
+	for _, c := range cues {
+		if c.text == "" || c.end <= c.start {
+			continue
+		}
+		key := c.settings + "\x00" + c.text
+		if i, ok := last[key]; ok && c.start <= merged[i].end+0.05 {
+			merged[i].end = math.Max(merged[i].end, c.end)
+			continue
+		}
+		last[key] = len(merged)
+		merged = append(merged, c)
+	}
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	if style != "" {
+		b.WriteString("STYLE\n" + style + "\n")
+	}
+	for _, c := range merged {
+		b.WriteString(vttTime(c.start) + " --> " + vttTime(c.end))
+		if c.settings != "" {
+			b.WriteString(" " + c.settings)
+		}
+		b.WriteString("\n" + c.text + "\n\n")
+	}
+	return b.String()
+}
+
+// alignSettings 把 ASS 的小键盘对齐方式（1-9）转成 WebVTT 的位置设置
+func alignSettings(an int) string {
+	if an < 1 || an > 9 {
+		return ""
+	}
+	var s []string
+	switch {
+	case an >= 7:
+		s = append(s, "line:5%")
+	case an >= 4:
+		s = append(s, "line:50%")
+	}
+	switch an % 3 {
+	case 1:
+		s = append(s, "align:left")
+	case 0:
+		s = append(s, "align:right")
+	}
+	return strings.Join(s, " ")
+}
+
+// cleanCueText 去掉空行（空行会截断 cue）
+func cleanCueText(s string) string {
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// ---- ASS ----
+
+type assStyle struct {
+	class                   string
+	color                   string
+	bold, italic, underline bool
+	align                   int
+}
+
+var defaultStyleFormat = strings.Split("Name,Fontname,Fontsize,PrimaryColour,SecondaryColour,OutlineColour,BackColour,Bold,Italic,Underline,StrikeOut,ScaleX,ScaleY,Spacing,Angle,BorderStyle,Outline,Shadow,Alignment,MarginL,MarginR,MarginV,Encoding", ",")
+var defaultEventFormat = strings.Split("Layer,Start,End,Style,Name,MarginL,MarginR,MarginV,Effect,Text", ",")
+
+// assFields 按 Format 行的字段名切分，最后一段（Text）可以包含逗号
+func assFields(format []string, value string) map[string]string {
+	parts := strings.SplitN(value, ",", len(format))
+	m := make(map[string]string, len(parts))
+	for i, p := range parts {
+		k := strings.ToLower(strings.TrimSpace(format[i]))
+		if k == "text" {
+			m[k] = p
+		} else {
+			m[k] = strings.TrimSpace(p)
+		}
+	}
+	return m
+}
+
+func assFormat(value string) []string {
+	var f []string
+	for _, s := range strings.Split(value, ",") {
+		f = append(f, strings.TrimSpace(s))
+	}
+	return f
+}
+
+// assColor 把 &HAABBGGRR 转成 #rrggbb
+func assColor(s string) string {
+	s = strings.Trim(strings.TrimSpace(s), "&")
+	var v uint64
+	var err error
+	if strings.HasPrefix(strings.ToUpper(s), "H") {
+		v, err = strconv.ParseUint(s[1:], 16, 32)
+	} else {
+		v, err = strconv.ParseUint(s, 10, 32)
+	}
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", v&0xFF, v>>8&0xFF, v>>16&0xFF)
+}
+
+func assBool(s string) bool {
+	n, _ := strconv.Atoi(s)
+	return n != 0
+}
+
+// assTime 解析 H:MM:SS.cc
+func assTime(s string) (float64, bool) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	sec, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, false
+	}
+	return float64(h*3600+m*60) + sec, true
+}
+
+var reASSPos = regexp.MustCompile(`^(?:pos|move)\(\s*([-\d.]+)\s*,\s*([-\d.]+)`)
+
+// assLine 转换一行对白：去掉特效标签，保留粗体/斜体/下划线，
+// 返回 \an 对齐和 \pos 坐标；矢量绘图（\p1）整段丢弃
+func assLine(text string, st *assStyle) (out string, an int, pos []float64) {
+	bold, italic, underline := st.bold, st.italic, st.underline
+	drawing := false
+	var b strings.Builder
+	emit := func(s string) {
+		if s == "" || drawing {
+			return
+		}
+		s = vttEscaper.Replace(s)
+		if underline {
+			s = "<u>" + s + "</u>"
+		}
+		if italic {
+			s = "<i>" + s + "</i>"
+		}
+		if bold {
+			s = "<b>" + s + "</b>"
+		}
+		b.WriteString(s)
+	}
+	for len(text) > 0 {
+		open := strings.IndexByte(text, '{')
+		if open < 0 {
+			emit(assPlain(text))
+			break
+		}
+		emit(assPlain(text[:open]))
+		end := strings.IndexByte(text[open:], '}')
+		if end < 0 {
+			break
+		}
+		for _, tag := range strings.Split(text[open+1:open+end], `\`) {
+			tag = strings.TrimSpace(tag)
+			switch {
+			case strings.HasPrefix(tag, "an") && len(tag) == 3:
+				an, _ = strconv.Atoi(tag[2:])
+			case strings.HasPrefix(tag, "pos(") || strings.HasPrefix(tag, "move("):
+				if m := reASSPos.FindStringSubmatch(tag); m != nil {
+					x, _ := strconv.ParseFloat(m[1], 64)
+					y, _ := strconv.ParseFloat(m[2], 64)
+					pos = []float64{x, y}
+				}
+			case tag == "i" || tag == "i0" || tag == "i1":
+				italic = tag == "i1" || (tag == "i" && st.italic)
+			case tag == "u" || tag == "u0" || tag == "u1":
+				underline = tag == "u1" || (tag == "u" && st.underline)
+			case len(tag) >= 1 && tag[0] == 'b' && (len(tag) == 1 || tag[1] >= '0' && tag[1] <= '9'):
+				n, _ := strconv.Atoi(tag[1:])
+				bold = n == 1 || n >= 600 || (len(tag) == 1 && st.bold)
+			case strings.HasPrefix(tag, "r"): // \r 或 \r样式名
+				bold, italic, underline = st.bold, st.italic, st.underline
+			case len(tag) >= 2 && tag[0] == 'p' && tag[1] >= '0' && tag[1] <= '9':
+				n, _ := strconv.Atoi(tag[1:])
+				drawing = n > 0
+			}
+		}
+		text = text[open+end+1:]
+	}
+	return cleanCueText(b.String()), an, pos
+}
+
+// assPlain 处理正文里的换行和硬空格
+func assPlain(s string) string {
+	return strings.NewReplacer(`\N`, "\n", `\n`, " ", `\h`, " ").Replace(s)
+}
+
+func assToVTT(src string) string {
+	var (
+		section     string
+		legacy      bool // [V4 Styles] 的对齐方式是旧编号
+		styleFormat = defaultStyleFormat
+		eventFormat = defaultEventFormat
+		styles      = make(map[string]*assStyle)
+		styleList   []*assStyle
+		resX, resY  float64
+		cues        []vttCue
+	)
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line)
+			legacy = section == "[v4 styles]"
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.HasPrefix(line, ";") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case section == "[script info]":
+			switch strings.ToLower(key) {
+			case "playresx":
+				resX, _ = strconv.ParseFloat(value, 64)
+			case "playresy":
+				resY, _ = strconv.ParseFloat(value, 64)
+			}
+		case strings.HasSuffix(section, "styles]"):
+			switch key {
+			case "Format":
+				styleFormat = assFormat(value)
+			case "Style":
+				f := assFields(styleFormat, value)
+				st := &assStyle{
+					class: fmt.Sprintf("s%d", len(styleList)),
+					color: assColor(f["primarycolour"]),
+					bold:  assBool(f["bold"]), italic: assBool(f["italic"]), underline: assBool(f["underline"]),
+				}
+				st.align, _ = strconv.Atoi(f["alignment"])
+				if legacy && st.align > 0 {
+					// 旧编号：1-3 底部，+4 顶部，+8 中间
+					switch {
+					case st.align >= 9:
+						st.align -= 5
+					case st.align >= 5:
+						st.align += 2
+					}
+				}
+				styles[f["name"]] = st
+				styleList = append(styleList, st)
+			}
+		case section == "[events]":
+			switch key {
+			case "Format":
+				eventFormat = assFormat(value)
+			case "Dialogue":
+				f := assFields(eventFormat, value)
+				start, ok1 := assTime(f["start"])
+				end, ok2 := assTime(f["end"])
+				if !ok1 || !ok2 {
+					continue
+				}
+				st := styles[strings.TrimPrefix(f["style"], "*")]
+				if st == nil {
+					st = &assStyle{}
+				}
+				text, an, pos := assLine(f["text"], st)
+				if text == "" {
+					continue
+				}
+				if an == 0 {
+					an = st.align
+				}
+				settings := alignSettings(an)
+				if pos != nil && resX > 0 && resY > 0 {
+					settings = fmt.Sprintf("position:%.0f%% line:%.0f%%",
+						math.Min(math.Max(pos[0]/resX*100, 0), 100), math.Min(math.Max(pos[1]/resY*100, 0), 100))
+				}
+				if st.class != "" {
+					text = "<c." + st.class + ">" + text + "</c>"
+				}
+				cues = append(cues, vttCue{start, end, settings, text})
+			}
+		}
+	}
+
+	// 样式颜色写进 STYLE 块，浏览器原生渲染时生效
+	var style strings.Builder
+	for _, st := range styleList {
+		if st.color != "" && st.color != "#ffffff" {
+			fmt.Fprintf(&style, "::cue(.%s) { color: %s; }\n", st.class, st.color)
+		}
+	}
+	return writeVTT(cues, style.String())
+}
+
+// ---- SRT ----
+
+var (
+	reSRTTime = regexp.MustCompile(`(\d+):(\d{2}):(\d{2})[,.](\d{1,3})\s*-->\s*(\d+):(\d{2}):(\d{2})[,.](\d{1,3})`)
+	reSRTAn   = regexp.MustCompile(`\{\\an(\d)\}`)
+	reSRTTag  = regexp.MustCompile(`\{\\[^}]*\}|</?(?:font|span)[^>]*>`)
+	reSRTHTML = regexp.MustCompile(`</?[ibu]>`)
+)
+
+func srtTime(h, m, s, ms string) float64 {
+	hh, _ := strconv.Atoi(h)
+	mm, _ := strconv.Atoi(m)
+	ss, _ := strconv.Atoi(s)
+	frac, _ := strconv.ParseFloat("0."+ms, 64)
+	return float64(hh*3600+mm*60+ss) + frac
+}
+
+func srtToVTT(src string) string {
+	var cues []vttCue
+	var cur *vttCue
+	var text []string
+	flush := func() {
+		if cur != nil {
+			cur.text = cleanCueText(strings.Join(text, "\n"))
+			cues = append(cues, *cur)
+		}
+		cur, text = nil, nil
+	}
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := reSRTTime.FindStringSubmatch(line); m != nil {
+			flush()
+			cur = &vttCue{start: srtTime(m[1], m[2], m[3], m[4]), end: srtTime(m[5], m[6], m[7], m[8])}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if m := reSRTAn.FindStringSubmatch(line); m != nil {
+			an, _ := strconv.Atoi(m[1])
+			cur.settings = alignSettings(an)
+		}
+		line = reSRTTag.ReplaceAllString(line, "")
+		// 只保留 <i><b><u>，其余转义
+		var b strings.Builder
+		last := 0
+		for _, loc := range reSRTHTML.FindAllStringIndex(line, -1) {
+			b.WriteString(vttEscaper.Replace(line[last:loc[0]]))
+			b.WriteString(line[loc[0]:loc[1]])
+			last = loc[1]
+		}
+		b.WriteString(vttEscaper.Replace(line[last:]))
+		text = append(text, b.String())
+	}
+	flush()
+	return writeVTT(cues, "")
+}
+
+// ---- 接口 ----
+
+type subtitleCacheEntry struct {
+	data   string
+	format string // 原始格式 ass/srt/vtt
+	at     time.Time
+}
+
+// 转换结果缓存一小时，最多 200 个
+const (
+	subtitleCacheTTL  = time.Hour
+	subtitleCacheSize = 200
+)
+
+// 外挂字幕读取的超时，结果在多个请求间共享，不跟随单个请求取消
+const subtitleReadTimeout = time.Minute
+
+var (
+	subtitleCacheMu sync.Mutex
+	subtitleCache   = make(map[string]subtitleCacheEntry)
+	subtitleFlight  flightGroup
+)
+
+// readSubtitleFile 读取外挂字幕并转成 UTF-8
+func readSubtitleFile(ctx context.Context, p string) (string, error) {
+	rc, err := storage.Open(ctx, p, 0, maxSubtitleSize+1)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxSubtitleSize {
+		return "", fmt.Errorf("字幕文件过大")
+	}
+	_, lang := splitSubtitleName(path.Base(p))
+	return decodeSubtitle(data, lang), nil
+}
+
+// loadSubtitle 读取字幕（track > 0 时为 MKV 内封字幕轨），format 为 vtt 时再转成 WebVTT
+func loadSubtitle(p string, track int, format string) (subtitleCacheEntry, error) {
+	key := format + "\x00" + strconv.Itoa(track) + "\x00" + p
+	subtitleCacheMu.Lock()
+	if e, ok := subtitleCache[key]; ok && time.Since(e.at) < subtitleCacheTTL {
+		subtitleCacheMu.Unlock()
+		return e, nil
+	}
+	subtitleCacheMu.Unlock()
+
+	v, err := subtitleFlight.Do(key, func() (interface{}, error) {
+		var text, srcFormat string
+		var err error
+		if track > 0 {
+			// 提取可能要读完整个文件，不跟随单个请求取消
+			ctx, cancel := context.WithTimeout(context.Background(), embedSubTimeout)
+			defer cancel()
+			text, srcFormat, err = extractSubtitle(ctx, p, track)
+		} else {
+			srcFormat = subtitleFormat(p)
+			ctx, cancel := context.WithTimeout(context.Background(), subtitleReadTimeout)
+			defer cancel()
+			text, err = readSubtitleFile(ctx, p)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if format == "vtt" {
+			switch srcFormat {
+			case "ass":
+				text = assToVTT(text)
+			case "srt":
+				text = srtToVTT(text)
+			}
+		}
+
+		entry := subtitleCacheEntry{text, srcFormat, time.Now()}
+		subtitleCacheMu.Lock()
+		if len(subtitleCache) >= subtitleCacheSize {
+			var oldest string
+			for k, e := range subtitleCache {
+				if oldest == "" || e.at.Before(subtitleCache[oldest].at) {
+					oldest = k
+				}
+			}
+			delete(subtitleCache, oldest)
+		}
+		subtitleCache[key] = entry
+		subtitleCacheMu.Unlock()
+		return entry, nil
+	})
+	if err != nil {
+		return subtitleCacheEntry{}, err
+	}
+	return v.(subtitleCacheEntry), nil
+}
+
+// GET /api/subtitle?path=/onedrive/anime/xxx/01.sc.ass&format=vtt|raw
+// 内封字幕：path 为 MKV 文件，加上 track=字幕轨编号
+func handleSubtitle(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Query().Get("path")
+	track, _ := strconv.Atoi(r.URL.Query().Get("track"))
+	if p == "" || track <= 0 && subtitleFormat(p) == "" || track > 0 && !isMatroska(p) {
+		http.Error(w, "not a subtitle file", 400)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "raw" {
+		format = "vtt"
+	}
+	sub, err := loadSubtitle(p, track, format)
+	if err != nil {
+		upstreamError(w, p, err)
+		return
+	}
+
+	contentType := "text/vtt; charset=utf-8"
+	if format == "raw" {
+		switch sub.format {
+		case "ass":
+			contentType = "text/x-ssa; charset=utf-8"
+		case "srt":
+			contentType = "application/x-subrip; charset=utf-8"
+		}
+		name := path.Base(p)
+		if track > 0 {
+			name = embeddedSubtitleName(p, track, sub.format)
+		}
+		w.Header().Set("Content-Disposition", "inline; filename*=UTF-8''"+url.PathEscape(name))
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	io.WriteString(w, sub.data)
+}
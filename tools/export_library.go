@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 导出 Jellyfin/Kodi 媒体库：每部番剧一个目录，写 tvshow.nfo，
+// 每集写 episodedetails NFO 和指向站点 /api/stream 的 .strm，不复制视频
+//
+// 用法: go run export_library.go <站点地址> [输出目录，默认 ../library]
+//
+//   library/葬送的芙莉莲 (2023)/tvshow.nfo
+//   library/葬送的芙莉莲 (2023)/Season 01/葬送的芙莉莲 S01E01.strm
+//   library/葬送的芙莉莲 (2023)/Season 01/葬送的芙莉莲 S01E01.nfo
+//   library/葬送的芙莉莲 (2023)/Specials/葬送的芙莉莲 S00E01.strm
+//
+// 重复运行只改写有变化的文件。导出的文件记在输出目录的 .anime-export.json 里，
+// 下次运行只删除清单中列出、这次没再生成的文件；没有清单的非空目录拒绝导出，避免误删已有的媒体库
+
+const manifestFile = ".anime-export.json"
+
+type AnimeInfo struct {
+	ID      int      `json:"id"`
+	Name    string   `json:"name"`
+	NameCN  string   `json:"name_cn"`
+	Year    int      `json:"year"`
+	Date    string   `json:"date"`
+	Summary string   `json:"summary"`
+	Cover   string   `json:"cover"`
+	Score   float64  `json:"score"`
+	Tags    []string `json:"tags"`
+}
+
+type AnimeMapping struct {
+	AnimeID    int      `json:"anime_id,omitempty"`
+	AnimeName  string   `json:"anime_name"`
+	FolderName string   `json:"folder_name"`
+	FolderPath string   `json:"folder_path"`
+	Episodes   []string `json:"episodes,omitempty"`
+}
+
+type nfoRating struct {
+	Name    string  `xml:"name,attr"`
+	Max     int     `xml:"max,attr"`
+	Default bool    `xml:"default,attr"`
+	Value   float64 `xml:"value"`
+}
+
+type nfoUniqueID struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr"`
+	Value   string `xml:",chardata"`
+}
+
+type nfoThumb struct {
+	Aspect string `xml:"aspect,attr"`
+	URL    string `xml:",chardata"`
+}
+
+type tvshowNFO struct {
+	XMLName       xml.Name      `xml:"tvshow"`
+	Title         string        `xml:"title"`
+	OriginalTitle string        `xml:"originaltitle,omitempty"`
+	Plot          string        `xml:"plot,omitempty"`
+	Ratings       []nfoRating   `xml:"ratings>rating,omitempty"`
+	Year          int           `xml:"year,omitempty"`
+	Premiered     string        `xml:"premiered,omitempty"`
+	Tags          []string      `xml:"tag"`
+	Thumbs        []nfoThumb    `xml:"thumb"`
+	UniqueIDs     []nfoUniqueID `xml:"uniqueid"`
+}
+
+type episodeNFO struct {
+	XMLName   xml.Name `xml:"episodedetails"`
+	Title     string   `xml:"title"`
+	ShowTitle string   `xml:"showtitle"`
+	Season    int      `xml:"season"`
+	Episode   int      `xml:"episode"`
+}
+
+var (
+	reBracket  = regexp.MustCompile(`\[[^\]]*\]|【[^】]*】|\([^)]*\)|（[^）]*）`)
+	reSxxExx   = regexp.MustCompile(`(?i)\bS\d{1,2}\s?E(\d{1,4})(?:v(\d))?`)
+	reEpCN     = regexp.MustCompile(`第\s*(\d{1,4})\s*[话話集回]`)
+	reEpDash   = regexp.MustCompile(`\s-\s(\d{1,4})(?:v(\d))?(?:\s|$)`)
+	reEpTag    = regexp.MustCompile(`(?i)[\[【](?:EP?)?(\d{1,4})(?:v(\d))?(?:\s*(?:END|Fin))?[\]】]`)
+	reSpecial  = regexp.MustCompile(`(?i)\b(SP|OVA|OAD|NCOP|NCED|PV|CM|Menu)\s*(\d{1,3})?\b|特别篇|特別篇|总集篇|總集篇|番外`)
+	reSpecTag  = regexp.MustCompile(`(?i)^(SP|OVA|OAD|NCOP|NCED|OP|ED|PV|CM|Menu|Preview|Yokoku|\w*Spot|Trailer|Teaser|特别篇|特別篇|总集篇|總集篇|番外篇?)\s*(\d{1,3})?(?:v\d)?$`)
+	reHalfEp   = regexp.MustCompile(`\s-\s\d{1,4}\.\d|第\s*\d{1,4}\.\d\s*[话話集回]|[\[【]\d{1,4}\.\d[\]】]`)
+	nameFixups = strings.NewReplacer(
+		"/", "／", "\\", "＼", ":", "：", "*", "＊", "?", "？",
+		"\"", "＂", "<", "＜", ">", "＞", "|", "｜",
+	)
+)
+
+type episodeFile struct {
+	Name    string
+	Special bool // 特典、总集篇、x.5 集等，放到 Specials
+	Number  int  // 集数，0 为无法识别
+	Version int
+}
+
+// parseEpisode 只解析导出需要的集数和版本，规则和站点的 episode.go 一致但简化
+func parseEpisode(name string) episodeFile {
+	ep := episodeFile{Name: name}
+	base := strings.TrimSuffix(name, path.Ext(name))
+	if !strings.Contains(base, " ") {
+		base = strings.ReplaceAll(base, "_", " ")
+	}
+	if reHalfEp.MatchString(base) {
+		ep.Special = true
+		return ep
+	}
+	// 标题里的 OVA、特别篇，或者单独一个括号的 [NCOP]、[Yokoku01]
+	title := strings.TrimSpace(reBracket.ReplaceAllString(base, " "))
+	ep.Special = reSpecial.MatchString(title)
+	for _, tag := range reBracket.FindAllString(base, -1) {
+		if reSpecTag.MatchString(strings.TrimSpace(string([]rune(tag)[1 : len([]rune(tag))-1]))) {
+			ep.Special = true
+		}
+	}
+	for _, re := range []*regexp.Regexp{reSxxExx, reEpCN, reEpDash, reEpTag} {
+		if m := re.FindStringSubmatch(base); m != nil {
+			ep.Number, _ = strconv.Atoi(m[1])
+			if len(m) > 2 {
+				ep.Version, _ = strconv.Atoi(m[2])
+			}
+			break
+		}
+	}
+	return ep
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("用法: go run export_library.go <站点地址> [输出目录]")
+		return
+	}
+	site := strings.TrimSuffix(os.Args[1], "/")
+	outDir := "../library"
+	if len(os.Args) > 2 {
+		outDir = os.Args[2]
+	}
+
+	var db []AnimeInfo
+	data, err := os.ReadFile("../data/anime_db.json")
+	if err != nil {
+		fmt.Println("读取番剧数据库失败:", err)
+		return
+	}
+	if err := json.Unmarshal(data, &db); err != nil {
+		fmt.Println("番剧数据库格式错误:", err)
+		return
+	}
+	byID := make(map[int]AnimeInfo, len(db))
+	for _, a := range db {
+		byID[a.ID] = a
+	}
+
+	var mappings []AnimeMapping
+	data, err = os.ReadFile("../data/anime_mapping_onedrive.json")
+	if err != nil {
+		fmt.Println("读取映射表失败:", err)
+		return
+	}
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		fmt.Println("映射表格式错误:", err)
+		return
+	}
+
+	prev, err := loadManifest(outDir)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	written := make(map[string]bool)
+	usedDirs := make(map[string]bool)
+	var shows, episodes, changed int
+	write := func(p string, content []byte) {
+		written[p] = true
+		if old, err := os.ReadFile(p); err == nil && string(old) == string(content) {
+			return
+		}
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, content, 0644); err != nil {
+			fmt.Printf("  写入失败 %s: %v\n", p, err)
+			return
+		}
+		changed++
+	}
+
+	for _, m := range mappings {
+		a, ok := byID[m.AnimeID]
+		if !ok || len(m.Episodes) == 0 {
+			continue
+		}
+		title := a.NameCN
+		if title == "" {
+			title = a.Name
+		}
+		dir := safeName(title)
+		if a.Year > 0 {
+			dir += " (" + strconv.Itoa(a.Year) + ")"
+		}
+		if usedDirs[dir] {
+			dir += " [" + strconv.Itoa(a.ID) + "]"
+		}
+		usedDirs[dir] = true
+		showDir := filepath.Join(outDir, dir)
+
+		show := tvshowNFO{
+			Title:     title,
+			Plot:      strings.ReplaceAll(a.Summary, "\r\n", "\n"),
+			Year:      a.Year,
+			Premiered: a.Date,
+			Tags:      a.Tags,
+			UniqueIDs: []nfoUniqueID{{Type: "bangumi", Default: true, Value: strconv.Itoa(a.ID)}},
+		}
+		if a.Name != title {
+			show.OriginalTitle = a.Name
+		}
+		if a.Score > 0 {
+			show.Ratings = []nfoRating{{Name: "bangumi", Max: 10, Default: true, Value: a.Score}}
+		}
+		if a.Cover != "" {
+			show.Thumbs = []nfoThumb{{Aspect: "poster", URL: a.Cover}}
+		}
+		write(filepath.Join(showDir, "tvshow.nfo"), marshalNFO(show))
+		shows++
+
+		folder := storagePath(m.FolderPath)
+		for _, ep := range assignEpisodes(m.Episodes) {
+			season, seasonDir := 1, "Season 01"
+			if ep.Special {
+				season, seasonDir = 0, "Specials"
+			}
+			base := fmt.Sprintf("%s S%02dE%02d", safeName(title), season, ep.Number)
+			label := fmt.Sprintf("第%d集", ep.Number)
+			if ep.Special {
+				label = strings.TrimSuffix(ep.Name, path.Ext(ep.Name))
+			}
+			streamURL := site + "/api/stream?path=" + url.QueryEscape(folder+"/"+ep.Name)
+			write(filepath.Join(showDir, seasonDir, base+".strm"), []byte(streamURL+"\n"))
+			write(filepath.Join(showDir, seasonDir, base+".nfo"), marshalNFO(episodeNFO{
+				Title: label, ShowTitle: title, Season: season, Episode: ep.Number,
+			}))
+			episodes++
+		}
+	}
+
+	removed := removeStale(outDir, prev, written)
+	if err := saveManifest(outDir, written); err != nil {
+		fmt.Println("保存导出清单失败:", err)
+	}
+	fmt.Printf("完成！%d 部番剧，%d 集，更新 %d 个文件，删除 %d 个过期文件\n", shows, episodes, changed, removed)
+}
+
+// assignEpisodes 按集数去重（保留版本号最高的），识别不出集数的正片和特典按文件名顺序编号
+func assignEpisodes(names []string) []episodeFile {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	best := make(map[int]episodeFile)
+	var regular, specials, unknown []episodeFile
+	for _, name := range sorted {
+		ep := parseEpisode(name)
+		switch {
+		case ep.Special:
+			specials = append(specials, ep)
+		case ep.Number <= 0:
+			unknown = append(unknown, ep)
+		default:
+			if old, ok := best[ep.Number]; !ok || ep.Version > old.Version {
+				best[ep.Number] = ep
+			}
+		}
+	}
+	maxNum := 0
+	for n, ep := range best {
+		regular = append(regular, ep)
+		if n > maxNum {
+			maxNum = n
+		}
+	}
+	for _, ep := range unknown {
+		maxNum++
+		ep.Number = maxNum
+		regular = append(regular, ep)
+	}
+	sort.Slice(regular, func(i, j int) bool { return regular[i].Number < regular[j].Number })
+	for i := range specials {
+		specials[i].Number = i + 1
+	}
+	return append(regular, specials...)
+}
+
+func marshalNFO(v interface{}) []byte {
+	data, _ := xml.MarshalIndent(v, "", "  ")
+	return append([]byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`+"\n"), append(data, '\n')...)
+}
+
+// loadManifest 读取上次导出的文件清单（相对输出目录的路径）。
+// 目录不存在或为空时返回空清单，有其他文件却没有清单时报错
+func loadManifest(root string) (map[string]bool, error) {
+	prev := make(map[string]bool)
+	data, err := os.ReadFile(filepath.Join(root, manifestFile))
+	if os.IsNotExist(err) {
+		entries, err := os.ReadDir(root)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("读取输出目录失败: %v", err)
+		}
+		if len(entries) > 0 {
+			return nil, fmt.Errorf("输出目录 %s 不为空且没有导出清单 %s，为避免删掉其他文件，请指定一个空目录", root, manifestFile)
+		}
+		return prev, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取导出清单失败: %v", err)
+	}
+	var files []string
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("导出清单格式错误: %v", err)
+	}
+	for _, f := range files {
+		prev[f] = true
+	}
+	return prev, nil
+}
+
+func saveManifest(root string, written map[string]bool) error {
+	files := []string{}
+	for p := range written {
+		if rel, err := filepath.Rel(root, p); err == nil {
+			files = append(files, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(files)
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(root, 0755)
+	return os.WriteFile(filepath.Join(root, manifestFile), data, 0644)
+}
+
+// removeStale 删除上次清单里有、这次没有写入的文件，以及因此变空的目录；清单外的文件（如媒体库下载的图片）不动
+func removeStale(root string, prev, written map[string]bool) int {
+	removed := 0
+	for rel := range prev {
+		rel := filepath.FromSlash(rel)
+		if !filepath.IsLocal(rel) {
+			continue
+		}
+		p := filepath.Join(root, rel)
+		if written[p] || os.Remove(p) != nil {
+			continue
+		}
+		removed++
+		// 向上删除变空的目录，非空目录删除会失败
+		for dir := filepath.Dir(p); dir != filepath.Clean(root); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return removed
+}
+
+// storagePath 映射表路径转换为站点存储路径：onedrive:anime/xxx -> /onedrive/anime/xxx
+func storagePath(folderPath string) string {
+	if strings.HasPrefix(folderPath, "onedrive:") {
+		return "/" + strings.Replace(folderPath, ":", "/", 1)
+	}
+	return "/pikpak/" + folderPath
+}
+
+func safeName(s string) string {
+	return strings.TrimRight(strings.TrimSpace(nameFixups.Replace(s)), ".")
+}
@@ -8,6 +8,7 @@ import (
 )
 
 type AnimeMapping struct {
+	AnimeID    int    `json:"anime_id,omitempty"`
 	AnimeName  string `json:"anime_name"`
 	FolderName string `json:"folder_name"`
 	FolderPath string `json:"folder_path"`
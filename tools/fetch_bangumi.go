@@ -20,6 +20,7 @@ type AnimeInfo struct {
 	Cover   string   `json:"cover"`
 	Score   float64  `json:"score"`
 	Tags    []string `json:"tags"`
+	Aliases []string `json:"aliases,omitempty"`
 }
 
 type SearchRequest struct {
@@ -45,6 +46,10 @@ type SubjectData struct {
 	Tags []struct {
 		Name string `json:"name"`
 	} `json:"tags"`
+	Infobox []struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	} `json:"infobox"`
 }
 
 type SearchResponse struct {
@@ -121,6 +126,7 @@ func fetchTopByYear(year int, maxCount int) []AnimeInfo {
 				ID: s.ID, Name: s.Name, NameCN: s.NameCN,
 				Year: year, Date: s.Date, Summary: s.Summary,
 				Cover: s.Image, Score: s.Rating.Score, Tags: tags,
+				Aliases: extractAliases(s),
 			})
 		}
 
@@ -132,3 +138,31 @@ func fetchTopByYear(year int, maxCount int) []AnimeInfo {
 	}
 	return result
 }
+
+// 从 infobox 的"别名"/"英文名"等字段提取别名，供搜索使用
+func extractAliases(s SubjectData) []string {
+	var aliases []string
+	for _, item := range s.Infobox {
+		if item.Key != "别名" && item.Key != "英文名" && item.Key != "罗马字" {
+			continue
+		}
+		// value 可能是字符串，也可能是 [{"k": "...", "v": "..."}]
+		var str string
+		if json.Unmarshal(item.Value, &str) == nil {
+			if str != "" {
+				aliases = append(aliases, str)
+			}
+			continue
+		}
+		var list []struct {
+			V string `json:"v"`
+		}
+		json.Unmarshal(item.Value, &list)
+		for _, v := range list {
+			if v.V != "" {
+				aliases = append(aliases, v.V)
+			}
+		}
+	}
+	return aliases
+}
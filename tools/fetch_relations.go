@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// 从 Bangumi 抓取每部番剧的关联条目（前传/续集/番外篇等），写入 data/anime_relations.json
+// 已抓取过的条目会跳过，中断后重新运行即可继续；加 -f 参数全部重新抓取
+// 用法: cd tools && go run fetch_relations.go
+
+type AnimeInfo struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	NameCN string `json:"name_cn"`
+}
+
+type Relation struct {
+	ID       int    `json:"id"`
+	Relation string `json:"relation"`
+	Name     string `json:"name"`
+	NameCN   string `json:"name_cn"`
+	Cover    string `json:"cover,omitempty"`
+}
+
+type RelatedSubject struct {
+	ID       int    `json:"id"`
+	Type     int    `json:"type"`
+	Name     string `json:"name"`
+	NameCN   string `json:"name_cn"`
+	Relation string `json:"relation"`
+	Images   struct {
+		Large  string `json:"large"`
+		Common string `json:"common"`
+	} `json:"images"`
+}
+
+const relationsFile = "../data/anime_relations.json"
+
+var client = &http.Client{Timeout: 60 * time.Second}
+
+func main() {
+	data, err := os.ReadFile("../data/anime_db.json")
+	if err != nil {
+		fmt.Println("读取 anime_db.json 失败:", err)
+		return
+	}
+	var animes []AnimeInfo
+	json.Unmarshal(data, &animes)
+
+	relations := make(map[int][]Relation)
+	force := len(os.Args) > 1 && os.Args[1] == "-f"
+	if !force {
+		if data, err := os.ReadFile(relationsFile); err == nil {
+			json.Unmarshal(data, &relations)
+		}
+	}
+
+	fetched := 0
+	for i, a := range animes {
+		if _, ok := relations[a.ID]; ok {
+			continue
+		}
+		name := a.NameCN
+		if name == "" {
+			name = a.Name
+		}
+		rels, err := fetchRelations(a.ID)
+		if err != nil {
+			fmt.Printf("[%d/%d] %s: %v\n", i+1, len(animes), name, err)
+			continue
+		}
+		relations[a.ID] = rels
+		fmt.Printf("[%d/%d] %s: %d 个关联\n", i+1, len(animes), name, len(rels))
+
+		fetched++
+		if fetched%20 == 0 {
+			save(relations)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	save(relations)
+	fmt.Printf("\n完成，本次抓取 %d 部，共 %d 部\n", fetched, len(relations))
+}
+
+// 只保留动画条目（type=2），书籍、音乐等不是可播放的资源
+func fetchRelations(id int) ([]Relation, error) {
+	url := fmt.Sprintf("https://api.bgm.tv/v0/subjects/%d/subjects", id)
+	for retry := 0; retry < 3; retry++ {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("User-Agent", "anime-site/1.0")
+		resp, err := client.Do(req)
+		if err != nil {
+			time.Sleep(3 * time.Second)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == 429 {
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		if resp.StatusCode == 404 {
+			return []Relation{}, nil
+		}
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+
+		var subjects []RelatedSubject
+		if err := json.Unmarshal(body, &subjects); err != nil {
+			return nil, err
+		}
+		rels := []Relation{}
+		for _, s := range subjects {
+			if s.Type != 2 {
+				continue
+			}
+			cover := s.Images.Large
+			if cover == "" {
+				cover = s.Images.Common
+			}
+			rels = append(rels, Relation{ID: s.ID, Relation: s.Relation, Name: s.Name, NameCN: s.NameCN, Cover: cover})
+		}
+		return rels, nil
+	}
+	return nil, fmt.Errorf("重试次数过多")
+}
+
+func save(relations map[int][]Relation) {
+	data, _ := json.MarshalIndent(relations, "", "  ")
+	os.WriteFile(relationsFile, data, 0644)
+}
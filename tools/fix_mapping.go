@@ -16,6 +16,7 @@ func init() {
 }
 
 type AnimeMapping struct {
+	AnimeID    int    `json:"anime_id,omitempty"`
 	AnimeName  string `json:"anime_name"`
 	FolderName string `json:"folder_name"`
 	FolderPath string `json:"folder_path"`
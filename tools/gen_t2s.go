@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 生成搜索用的繁简/日文新字体 -> 简体单字对照表 data/t2s.txt
+// 数据来自 OpenCC 词典（通过 Go 模块代理下载 longbridgeapp/opencc）
+// 用法: cd tools && go run gen_t2s.go
+
+const openccZip = "https://proxy.golang.org/github.com/longbridgeapp/opencc/@v/v0.3.13.zip"
+const dictDir = "github.com/longbridgeapp/opencc@v0.3.13/dictionary/"
+
+func main() {
+	fmt.Println("下载 OpenCC 词典...")
+	client := &http.Client{Timeout: 120 * time.Second}
+	resp, err := client.Get(openccZip)
+	if err != nil {
+		fmt.Println("下载失败:", err)
+		return
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		fmt.Println("下载失败:", resp.Status)
+		return
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		fmt.Println("解压失败:", err)
+		return
+	}
+
+	ts := readDict(zr, "TSCharacters.txt")
+	jp := readDict(zr, "JPVariants.txt")
+
+	t2s := make(map[string]string)
+	for from, to := range ts {
+		if from != to {
+			t2s[from] = to
+		}
+	}
+	// JPVariants 是 繁体 -> 日文新字体，反过来映射到简体：撃 -> 擊 -> 击
+	for trad, shin := range jp {
+		simp := trad
+		if s, ok := ts[trad]; ok {
+			simp = s
+		}
+		if shin != simp {
+			if _, exists := t2s[shin]; !exists {
+				t2s[shin] = simp
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(t2s))
+	for k := range t2s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out strings.Builder
+	out.WriteString("# 繁体/日文新字体 -> 简体，由 tools/gen_t2s.go 根据 OpenCC 词典生成\n")
+	for _, k := range keys {
+		out.WriteString(k + "\t" + t2s[k] + "\n")
+	}
+	os.WriteFile("../data/t2s.txt", []byte(out.String()), 0644)
+	fmt.Printf("已生成 data/t2s.txt，共 %d 字\n", len(keys))
+}
+
+// 读取 OpenCC 词典，每行 "字\t候选1 候选2"，只取第一个候选
+func readDict(zr *zip.Reader, name string) map[string]string {
+	dict := make(map[string]string)
+	for _, f := range zr.File {
+		if f.Name != dictDir+name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			fmt.Println("读取失败:", name, err)
+			return dict
+		}
+		scanner := bufio.NewScanner(rc)
+		for scanner.Scan() {
+			parts := strings.SplitN(scanner.Text(), "\t", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			dict[parts[0]] = strings.Fields(parts[1])[0]
+		}
+		rc.Close()
+	}
+	fmt.Printf("%s: %d 条\n", name, len(dict))
+	return dict
+}
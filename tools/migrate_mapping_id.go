@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 给映射表补上 Bangumi ID（anime_id），服务端改为按 ID 查找资源
+// 用法: cd tools && go run migrate_mapping_id.go
+
+type AnimeInfo struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	NameCN string `json:"name_cn"`
+	Year   int    `json:"year"`
+}
+
+type AnimeMapping struct {
+	AnimeID    int      `json:"anime_id,omitempty"`
+	AnimeName  string   `json:"anime_name"`
+	FolderName string   `json:"folder_name"`
+	FolderPath string   `json:"folder_path"`
+	FileID     string   `json:"file_id"`
+	Episodes   []string `json:"episodes,omitempty"`
+	Subtitles  []string `json:"subtitles,omitempty"`
+}
+
+var reNameYear = regexp.MustCompile(`^(.*) \((\d{4})\)$`)
+
+func main() {
+	animeData, err := os.ReadFile("../data/anime_db.json")
+	if err != nil {
+		fmt.Println("读取番剧数据库失败:", err)
+		return
+	}
+	var animes []AnimeInfo
+	json.Unmarshal(animeData, &animes)
+
+	// "名称 (年份)" -> 候选 ID，中文名和原名都建索引
+	byKey := make(map[string][]int)
+	byName := make(map[string][]AnimeInfo)
+	for _, a := range animes {
+		for _, name := range []string{a.NameCN, a.Name} {
+			if name == "" {
+				continue
+			}
+			key := fmt.Sprintf("%s (%d)", name, a.Year)
+			if !containsID(byKey[key], a.ID) {
+				byKey[key] = append(byKey[key], a.ID)
+			}
+			byName[name] = append(byName[name], a)
+		}
+	}
+
+	for _, file := range []string{"../data/anime_mapping.json", "../data/anime_mapping_onedrive.json"} {
+		migrateFile(file, byKey, byName)
+	}
+}
+
+func migrateFile(file string, byKey map[string][]int, byName map[string][]AnimeInfo) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Printf("读取 %s 失败: %v\n", file, err)
+		return
+	}
+	var mappings []AnimeMapping
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		fmt.Printf("解析 %s 失败: %v\n", file, err)
+		return
+	}
+
+	fmt.Printf("\n=== %s (%d 条)\n", file, len(mappings))
+	resolved, skipped := 0, 0
+	var unresolved []string
+	seen := make(map[int]string)
+
+	for i := range mappings {
+		m := &mappings[i]
+		if m.AnimeID != 0 {
+			skipped++
+			seen[m.AnimeID] = m.AnimeName
+			continue
+		}
+
+		ids := byKey[m.AnimeName]
+		switch len(ids) {
+		case 1:
+			m.AnimeID = ids[0]
+			resolved++
+			if other, ok := seen[m.AnimeID]; ok {
+				fmt.Printf("⚠️ 重复: %s 与 %s 都对应 ID %d\n", m.AnimeName, other, m.AnimeID)
+			}
+			seen[m.AnimeID] = m.AnimeName
+		case 0:
+			unresolved = append(unresolved, fmt.Sprintf("%s  未找到%s", m.AnimeName, suggest(m.AnimeName, byName)))
+		default:
+			unresolved = append(unresolved, fmt.Sprintf("%s  有多个候选 ID: %v", m.AnimeName, ids))
+		}
+	}
+
+	output, _ := json.MarshalIndent(mappings, "", "  ")
+	if err := os.WriteFile(file, output, 0644); err != nil {
+		fmt.Printf("保存 %s 失败: %v\n", file, err)
+		return
+	}
+
+	fmt.Printf("新解析 %d 条，已有 ID %d 条，无法解析 %d 条\n", resolved, skipped, len(unresolved))
+	for _, u := range unresolved {
+		fmt.Println("  ❌", u)
+	}
+}
+
+// 名称相同但年份不同的候选，方便手动修正
+func suggest(animeName string, byName map[string][]AnimeInfo) string {
+	m := reNameYear.FindStringSubmatch(animeName)
+	if m == nil {
+		return ""
+	}
+	var hints []string
+	for _, a := range byName[m[1]] {
+		hints = append(hints, strconv.Itoa(a.ID)+"@"+strconv.Itoa(a.Year))
+	}
+	if len(hints) == 0 {
+		return ""
+	}
+	return "，同名候选: " + strings.Join(hints, ", ")
+}
+
+func containsID(ids []int, id int) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
@@ -10,11 +10,13 @@ import (
 )
 
 type AnimeMapping struct {
+	AnimeID    int      `json:"anime_id,omitempty"`
 	AnimeName  string   `json:"anime_name"`
 	FolderName string   `json:"folder_name"`
 	FolderPath string   `json:"folder_path"`
 	FileID     string   `json:"file_id"`
 	Episodes   []string `json:"episodes,omitempty"`
+	Subtitles  []string `json:"subtitles,omitempty"`
 }
 
 func main() {
@@ -34,9 +36,10 @@ func main() {
 		m := &mappings[i]
 		fmt.Printf("[%d/%d] 扫描: %s\n", i+1, len(mappings), m.AnimeName)
 
-		episodes := scanFolderRclone(m.FolderPath)
+		episodes, subtitles := scanFolderRclone(m.FolderPath)
 		m.Episodes = episodes
-		fmt.Printf("  -> 找到 %d 个视频\n", len(episodes))
+		m.Subtitles = subtitles
+		fmt.Printf("  -> 找到 %d 个视频, %d 个字幕\n", len(episodes), len(subtitles))
 	}
 
 	// 保存更新后的映射表
@@ -45,7 +48,7 @@ func main() {
 	fmt.Println("映射表已更新")
 }
 
-func scanFolderRclone(folderPath string) []string {
+func scanFolderRclone(folderPath string) (videos, subtitles []string) {
 	// 转换路径: onedrive:anime/xxx -> onedrive:anime/xxx (rclone格式)
 	// folderPath 已经是 onedrive:anime/xxx 格式
 	rclonePath := folderPath
@@ -55,22 +58,27 @@ func scanFolderRclone(folderPath string) []string {
 	output, err := cmd.Output()
 	if err != nil {
 		fmt.Printf("  rclone 失败: %v\n", err)
-		return nil
+		return nil, nil
 	}
 
 	// 解析文件列表
 	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	var videos []string
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
-		if line != "" && isVideoFile(line) {
+		if line == "" {
+			continue
+		}
+		if isVideoFile(line) {
 			videos = append(videos, line)
+		} else if isSubtitleFile(line) {
+			subtitles = append(subtitles, line)
 		}
 	}
 
 	// 排序
 	sort.Strings(videos)
-	return videos
+	sort.Strings(subtitles)
+	return videos, subtitles
 }
 
 func isVideoFile(name string) bool {
@@ -79,3 +87,10 @@ func isVideoFile(name string) bool {
 		strings.HasSuffix(name, ".avi") || strings.HasSuffix(name, ".webm") ||
 		strings.HasSuffix(name, ".flv") || strings.HasSuffix(name, ".mov")
 }
+
+// 外挂字幕，和视频按文件名配对，如 xxx.sc.ass / xxx.tc.ass
+func isSubtitleFile(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".ass") || strings.HasSuffix(name, ".ssa") ||
+		strings.HasSuffix(name, ".srt") || strings.HasSuffix(name, ".vtt")
+}
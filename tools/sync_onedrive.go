@@ -9,11 +9,13 @@ import (
 )
 
 type AnimeMapping struct {
+	AnimeID    int      `json:"anime_id,omitempty"`
 	AnimeName  string   `json:"anime_name"`
 	FolderName string   `json:"folder_name"`
 	FolderPath string   `json:"folder_path"`
 	FileID     string   `json:"file_id"`
 	Episodes   []string `json:"episodes,omitempty"`
+	Subtitles  []string `json:"subtitles,omitempty"`
 }
 
 func main() {
@@ -49,6 +51,7 @@ func main() {
 		folderName := m.FolderName
 		if found, path := findInOneDrive(folderName, onedriveFolders); found {
 			newMapping := AnimeMapping{
+				AnimeID:    m.AnimeID,
 				AnimeName:  m.AnimeName,
 				FolderName: folderName,
 				FolderPath: "onedrive:anime/" + path,
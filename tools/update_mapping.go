@@ -10,6 +10,7 @@ import (
 // 只做精确匹配，更新已传输到 OneDrive 的文件夹路径
 
 type AnimeMapping struct {
+	AnimeID    int    `json:"anime_id,omitempty"`
 	AnimeName  string `json:"anime_name"`
 	FolderName string `json:"folder_name"`
 	FolderPath string `json:"folder_path"`
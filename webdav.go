@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 只读 WebDAV：按番剧整理的虚拟目录，供 Infuse、Kodi、文件管理器挂载
+//   /dav/番剧名 (年份)/第01集.mkv
+//   /dav/番剧名 (年份)/第01集.chs.ass  外挂字幕，和剧集同名方便播放器自动加载
+// 读取文件时按 /api/get 的规则重定向到直链或走站内代理
+
+const (
+	davPrefix   = "/dav/"
+	davStatTTL  = 10 * time.Minute
+	davStatJobs = 4
+)
+
+// 文件名里不能用或 Windows 不认的字符换成全角
+var davNameReplacer = strings.NewReplacer(
+	"/", "／", "\\", "＼", ":", "：", "*", "＊", "?", "？",
+	"\"", "＂", "<", "＜", ">", "＞", "|", "｜", "\n", " ", "\r", " ", "\t", " ",
+)
+
+func davSafeName(s string) string {
+	return strings.TrimRight(strings.TrimSpace(davNameReplacer.Replace(s)), ".")
+}
+
+// davTree 番剧目录名和 ID 的对应关系，随数据快照重建
+type davTree struct {
+	catalog *Catalog
+	names   []string       // 排好序的目录名
+	ids     map[string]int // 目录名 -> 番剧 ID
+}
+
+var (
+	davTreeMu  sync.Mutex
+	davTreeCur *davTree
+)
+
+func currentDavTree() *davTree {
+	c := currentCatalog()
+	davTreeMu.Lock()
+	defer davTreeMu.Unlock()
+	if davTreeCur != nil && davTreeCur.catalog == c {
+		return davTreeCur
+	}
+	t := &davTree{catalog: c, ids: make(map[string]int)}
+	ids := make([]int, 0, len(c.FolderPath))
+	for id := range c.FolderPath {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		name := davAnimeName(c, id)
+		// 同名同年的番剧用 ID 区分
+		if _, dup := t.ids[name]; dup {
+			name += " [" + strconv.Itoa(id) + "]"
+		}
+		t.ids[name] = id
+		t.names = append(t.names, name)
+	}
+	sort.Strings(t.names)
+	davTreeCur = t
+	return t
+}
+
+// davAnimeName 目录名，如“葬送的芙莉莲 (2023)”
+func davAnimeName(c *Catalog, id int) string {
+	a, ok := c.animeByID[id]
+	if !ok {
+		return strconv.Itoa(id)
+	}
+	name := davSafeName(animeTitle(a))
+	if name == "" {
+		name = strconv.Itoa(id)
+	}
+	if a.Year > 0 {
+		name += " (" + strconv.Itoa(a.Year) + ")"
+	}
+	return name
+}
+
+// davEpisodeBase 剧集的虚拟文件名（不含扩展名），集数补到两位方便按名称排序
+func davEpisodeBase(ep EpisodeInfo) string {
+	if ep.Episode <= 0 {
+		if ep.Special != "" {
+			return davSafeName(ep.Special)
+		}
+		return davSafeName(strings.TrimSuffix(ep.Name, path.Ext(ep.Name)))
+	}
+	whole, frac := math.Modf(ep.Episode)
+	num := fmt.Sprintf("%02d", int(whole))
+	if frac > 0 {
+		num += strings.TrimPrefix(strconv.FormatFloat(frac, 'f', -1, 64), "0")
+	}
+	switch {
+	case ep.Special != "":
+		return davSafeName(ep.Special) + num
+	case ep.Season > 1:
+		return "第" + strconv.Itoa(ep.Season) + "季 第" + num + "集"
+	default:
+		return "第" + num + "集"
+	}
+}
+
+type davFile struct {
+	Name string // 虚拟文件名
+	Path string // 存储路径
+}
+
+// davFiles 番剧目录下的剧集和外挂字幕，同一集有多个版本时后面的加序号
+func davFiles(c *Catalog, id int) []davFile {
+	apiPath, episodes, ok := animeEpisodes(c, id)
+	if !ok {
+		return nil
+	}
+	var files []davFile
+	used := make(map[string]bool)
+	unique := func(base, ext string) string {
+		name := base + ext
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		used[strings.ToLower(name)] = true
+		return name
+	}
+	for _, ep := range episodes {
+		name := unique(davEpisodeBase(ep), strings.ToLower(path.Ext(ep.Name)))
+		files = append(files, davFile{Name: name, Path: ep.Path})
+		base := strings.TrimSuffix(name, path.Ext(name))
+		for _, s := range ep.Subtitles {
+			suffix := strings.ToLower(path.Ext(s.Name))
+			if s.Lang != "" {
+				suffix = "." + s.Lang + suffix
+			}
+			files = append(files, davFile{Name: unique(base, suffix), Path: apiPath + "/" + s.Name})
+		}
+	}
+	return files
+}
+
+// davStats 文件大小和修改时间的短期缓存，列目录时不用每次都问存储后端
+type davStatEntry struct {
+	info FileInfo
+	at   time.Time
+}
+
+var davStats = struct {
+	sync.Mutex
+	data   map[string]davStatEntry
+	flight flightGroup
+}{data: make(map[string]davStatEntry)}
+
+func davStat(ctx context.Context, p string) (FileInfo, error) {
+	davStats.Lock()
+	e, ok := davStats.data[p]
+	davStats.Unlock()
+	if ok && time.Since(e.at) < davStatTTL {
+		return e.info, nil
+	}
+	// 探测过媒体信息的文件直接用当时记录的大小
+	if info, ok := mediaInfos.FileInfo(p); ok {
+		return info, nil
+	}
+	// 结果给同一文件的并发请求共用，不能因为第一个请求断开而失败
+	v, err := davStats.flight.DoContext(ctx, p, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		info, err := storage.Stat(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		davStats.Lock()
+		for k, e := range davStats.data {
+			if time.Since(e.at) >= davStatTTL {
+				delete(davStats.data, k)
+			}
+		}
+		davStats.data[p] = davStatEntry{info, time.Now()}
+		davStats.Unlock()
+		return info, nil
+	})
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return v.(FileInfo), nil
+}
+
+// ---- PROPFIND 响应 ----
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	NS        string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href   string  `xml:"D:href"`
+	Prop   davProp `xml:"D:propstat>D:prop"`
+	Status string  `xml:"D:propstat>D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength string          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	CreationDate  string          `xml:"D:creationdate,omitempty"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+func davDirResponse(href, name string, mod time.Time) davResponse {
+	return davResponse{Href: href, Status: "HTTP/1.1 200 OK", Prop: davProp{
+		DisplayName:  name,
+		ResourceType: davResourceType{Collection: &struct{}{}},
+		LastModified: mod.UTC().Format(http.TimeFormat),
+		CreationDate: mod.UTC().Format(time.RFC3339),
+	}}
+}
+
+// davFileResponse 取不到文件信息时只返回名称，不影响其他文件列出
+func davFileResponse(href, name string, info FileInfo, ok bool) davResponse {
+	resp := davResponse{Href: href, Status: "HTTP/1.1 200 OK", Prop: davProp{
+		DisplayName: name,
+		ContentType: contentTypeOf(name),
+	}}
+	if ok {
+		resp.Prop.ContentLength = strconv.FormatInt(info.Size, 10)
+		resp.Prop.LastModified = info.ModTime.UTC().Format(http.TimeFormat)
+		resp.Prop.CreationDate = info.ModTime.UTC().Format(time.RFC3339)
+		resp.Prop.ETag = fmt.Sprintf(`"%x-%x"`, info.ModTime.Unix(), info.Size)
+	}
+	return resp
+}
+
+func davHref(parts ...string) string {
+	href := strings.TrimSuffix(davPrefix, "/")
+	for _, p := range parts {
+		href += "/" + url.PathEscape(p)
+	}
+	return href
+}
+
+// handleWebDAV /dav/ 只读 WebDAV，支持 OPTIONS、PROPFIND、GET、HEAD
+func handleWebDAV(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(davPrefix, "/")), "/")
+	var parts []string
+	if rest != "" {
+		parts = strings.Split(rest, "/")
+	}
+	if len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD")
+		return
+	case "PROPFIND", "GET", "HEAD":
+	default:
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD")
+		http.Error(w, "read-only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t := currentDavTree()
+	c := t.catalog
+	if len(parts) == 0 {
+		if r.Method == "PROPFIND" {
+			resp := []davResponse{davDirResponse(davHref()+"/", "", c.LoadedAt)}
+			if r.Header.Get("Depth") != "0" {
+				for _, name := range t.names {
+					resp = append(resp, davDirResponse(davHref(name)+"/", name, c.LoadedAt))
+				}
+			}
+			writeMultistatus(w, resp)
+			return
+		}
+		writeDavIndex(w, "/", t.names, true)
+		return
+	}
+
+	id, ok := t.ids[parts[0]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	files := davFiles(c, id)
+
+	if len(parts) == 1 {
+		if r.Method == "PROPFIND" {
+			resp := []davResponse{davDirResponse(davHref(parts[0])+"/", parts[0], c.LoadedAt)}
+			if r.Header.Get("Depth") != "0" {
+				resp = append(resp, davFileResponses(r.Context(), parts[0], files)...)
+			}
+			writeMultistatus(w, resp)
+			return
+		}
+		names := make([]string, len(files))
+		for i, f := range files {
+			names[i] = f.Name
+		}
+		writeDavIndex(w, "/"+parts[0]+"/", names, false)
+		return
+	}
+
+	var file *davFile
+	for i := range files {
+		if files[i].Name == parts[1] {
+			file = &files[i]
+			break
+		}
+	}
+	if file == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "PROPFIND" {
+		info, err := davStat(r.Context(), file.Path)
+		if err != nil {
+			upstreamError(w, file.Path, err)
+			return
+		}
+		writeMultistatus(w, []davResponse{davFileResponse(davHref(parts[0], file.Name), file.Name, info, true)})
+		return
+	}
+	redirectOrStream(w, r, file.Path)
+}
+
+// davFileResponses 并发取各文件的大小和修改时间
+func davFileResponses(ctx context.Context, dir string, files []davFile) []davResponse {
+	resp := make([]davResponse, len(files))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, davStatJobs)
+	for i, f := range files {
+		wg.Add(1)
+		go func(i int, f davFile) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			info, err := davStat(ctx, f.Path)
+			if err != nil {
+				log.Printf("WebDAV 获取文件信息失败 %s: %v", f.Path, err)
+			}
+			resp[i] = davFileResponse(davHref(dir, f.Name), f.Name, info, err == nil)
+		}(i, f)
+	}
+	wg.Wait()
+	return resp
+}
+
+func writeMultistatus(w http.ResponseWriter, resp []davResponse) {
+	data, err := xml.Marshal(davMultistatus{NS: "DAV:", Responses: resp})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// writeDavIndex 浏览器直接打开时给一个简单的目录页
+func writeDavIndex(w http.ResponseWriter, title string, names []string, dirs bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html><meta charset=\"utf-8\"><title>%s</title><h1>%s</h1><ul>", html.EscapeString(title), html.EscapeString(title))
+	if title != "/" {
+		b.WriteString(`<li><a href="../">../</a></li>`)
+	}
+	for _, name := range names {
+		href := url.PathEscape(name)
+		if dirs {
+			href += "/"
+			name += "/"
+		}
+		fmt.Fprintf(&b, `<li><a href="%s">%s</a></li>`, html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString("</ul>")
+	w.Write([]byte(b.String()))
+}